@@ -18,6 +18,7 @@ var (
 	DBName = flag.String("db", "bolt.db", "Bolt database to use")
 	Port   = flag.Int("port", 8080, "Port to serve from")
 	Config = flag.String("config", "", "Config file (JSON)")
+	Follow = flag.String("follow", "", "URL of a primary to replicate from, read-only")
 )
 
 func main() {
@@ -30,7 +31,15 @@ func main() {
 			log.Fatalf("fatal: %s", err)
 		}
 	}
-	handler, err := server.New(*DBName, cfg)
+	var (
+		handler http.Handler
+		err     error
+	)
+	if len(*Follow) > 0 {
+		handler, err = server.NewFollower(*DBName, *Follow, cfg)
+	} else {
+		handler, err = server.New(*DBName, cfg)
+	}
 	if err != nil {
 		log.Fatalf("fatal : %s", err)
 	}
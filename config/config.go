@@ -7,6 +7,7 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	"github.com/echlebek/bolt-server/auth"
 
@@ -29,6 +30,95 @@ func New(path string) (Data, error) {
 }
 
 type Data struct {
-	TLS  auth.TLSConfig
-	CSRF auth.CSRFConfig
+	TLS       auth.TLSConfig
+	CSRF      auth.CSRFConfig
+	Limits    Limits
+	Storage   Storage
+	Metadata  Metadata
+	ChangeLog ChangeLog `yaml:"change_log"`
+	Admin     Admin
+	Webhooks  Webhooks
+}
+
+// Limits holds the limits placed on requests. Zero values select the server's
+// defaults.
+type Limits struct {
+	// MaxValueSize is the size, in bytes, of the largest value that can be
+	// stored in one piece, and of the largest request body that is read into
+	// memory. Request bodies are cut off once they exceed it.
+	MaxValueSize int64 `yaml:"max_value_size"`
+
+	// MaxObjectSize is the size, in bytes, of the largest large object that
+	// can be stored, whether by a single PUT or by an upload session. Large
+	// objects are streamed into chunks, so it may be much larger than
+	// MaxValueSize.
+	MaxObjectSize int64 `yaml:"max_object_size"`
+
+	// MaxListKeys is the most keys returned by a single bucket listing.
+	// Longer listings are split into pages.
+	MaxListKeys int `yaml:"max_list_keys"`
+}
+
+// Storage controls how values are laid out in the database. Zero values select
+// the server's defaults.
+type Storage struct {
+	// LargeObjectSize is the size, in bytes, above which values are stored as
+	// large objects. Large objects are split into chunks that are written in
+	// separate transactions, and are read back a chunk at a time.
+	LargeObjectSize int64 `yaml:"large_object_size"`
+
+	// ChunkSize is the size, in bytes, of the chunks that large objects are
+	// split into.
+	ChunkSize int64 `yaml:"chunk_size"`
+
+	// ETagAlgorithm is the hash that ETags are computed with: "fnv" (the
+	// default), "md5", "sha1", "sha256" or "sha512". Changing it doesn't
+	// affect the ETags of values that are already stored.
+	ETagAlgorithm string `yaml:"etag_algorithm"`
+
+	// UploadExpiry is how long an upload session may last before it is
+	// abandoned and its parts are deleted.
+	UploadExpiry time.Duration `yaml:"upload_expiry"`
+}
+
+// Metadata controls which request header fields are stored with values and
+// returned with them.
+type Metadata struct {
+	// Headers lists the names of the stored header fields. A name ending in
+	// "*" matches every field starting with that prefix. If empty, the
+	// server's default list is used.
+	Headers []string
+}
+
+// ChangeLog controls how long entries are kept in the change log. Entries
+// beyond either limit are compacted away. Zero values select the server's
+// defaults.
+type ChangeLog struct {
+	// MaxEntries is the most entries kept.
+	MaxEntries int64 `yaml:"max_entries"`
+
+	// MaxAge is how long entries are kept.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// Admin controls the admin endpoints.
+type Admin struct {
+	// BackupToken enables GET /?backup. Requests for a backup must send it
+	// as a bearer token in the Authorization header. If empty, backups
+	// can't be downloaded.
+	BackupToken string `yaml:"backup_token"`
+
+	// ReplicationToken enables the replication snapshot and log, which hold
+	// the whole database. Followers send it as a bearer token in the
+	// Authorization header, so it must be the same on the primary and its
+	// followers. If empty, a server can't be followed.
+	ReplicationToken string `yaml:"replication_token"`
+}
+
+// Webhooks controls the delivery of webhooks.
+type Webhooks struct {
+	// AllowPrivateTargets lets hooks be delivered to loopback, link-local and
+	// private network addresses. Otherwise deliveries to them are refused, so
+	// that hooks can't be used to reach services that only the server can.
+	AllowPrivateTargets bool `yaml:"allow_private_targets"`
 }
@@ -0,0 +1,103 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// checkToken checks that req sends token as a bearer token in its
+// Authorization header. If not, or if token is empty, it writes the error
+// response and returns false. An empty token disables the endpoint, which is
+// then reported as not found.
+func checkToken(w http.ResponseWriter, req *http.Request, token string) bool {
+	if token == "" {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return false
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bolt-server"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// backup writes a consistent copy of the whole database, read in a single
+// transaction, so that a live server can be backed up. With "backup=gzip",
+// the copy is gzipped.
+//
+// The copy holds everything, including webhook secrets, lock tokens and
+// upload sessions, so it is only served when the config sets a backup token,
+// and only to requests that send it.
+//
+// The ETag identifies the transaction the copy was read in; as every write
+// transaction changes the file, two copies with the same ETag are the same.
+// A client that sends it back in If-None-Match gets 304 Not Modified if
+// nothing has been written since.
+func (s server) backup(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req, s.cfg.Admin.BackupToken) {
+		return
+	}
+	if cleanPath(req.URL.EscapedPath()) != "/" {
+		http.Error(w, "Bad request: backups are of the root bucket.", http.StatusBadRequest)
+		return
+	}
+	compress := false
+	switch req.URL.Query().Get("backup") {
+	case "":
+	case "gzip":
+		compress = true
+	default:
+		http.Error(w, "Bad request: unknown backup format.", http.StatusBadRequest)
+		return
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		header := make(http.Header)
+		eTag := fmt.Sprintf("tx-%d", tx.ID())
+		if compress {
+			eTag += "-gzip"
+		}
+		header.Set("ETag", eTag)
+		if status := checkPreconditions(header, req); status != 0 {
+			w.Header().Set("ETag", eTag)
+			w.WriteHeader(status)
+			return nil
+		}
+
+		name := filepath.Base(s.db.Path())
+		w.Header().Set("ETag", eTag)
+		if !compress {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+			w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+			_, err := tx.WriteTo(w)
+			return err
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".gz"))
+		gz := gzip.NewWriter(w)
+		if _, err := tx.WriteTo(gz); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		// The response has already started, so all that can be done is to
+		// cut it short.
+		log.Printf("couldn't write backup: %s", err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestBackup(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	s := httptest.NewServer(server{db: db, cfg: config.Data{Admin: config.Admin{BackupToken: "t0ken"}}})
+	defer s.Close()
+	disabled := httptest.NewServer(server{db: db})
+	defer disabled.Close()
+	client := &http.Client{}
+
+	do := func(method, url, body string, header map[string]string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer t0ken")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, b
+	}
+
+	do("PUT", s.URL+"/a/x", "hello", map[string]string{"Content-Type": "text/plain"})
+
+	// Backups hold secrets, so they need the token, and are off without one.
+	resp, _ := do("GET", disabled.URL+"/?backup", "", nil)
+	if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	for _, auth := range []string{"", "Bearer nope", "t0ken"} {
+		resp, _ := do("GET", s.URL+"/?backup", "", map[string]string{"Authorization": auth})
+		if got, want := resp.StatusCode, http.StatusUnauthorized; got != want {
+			t.Errorf("%q: bad status: got %d, want %d", auth, got, want)
+		}
+	}
+
+	resp, backup := do("GET", s.URL+"/?backup", "", nil)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len(backup)); got != want {
+		t.Errorf("bad Content-Length: got %s, want %s", got, want)
+	}
+	eTag := resp.Header.Get("ETag")
+	if eTag == "" {
+		t.Error("missing ETag")
+	}
+
+	// The backup is a database that can be served.
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(td, "backup.db")
+	if err := ioutil.WriteFile(fp, backup, 0600); err != nil {
+		t.Fatal(err)
+	}
+	restoredDB, err := bolt.Open(fp, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restoredDB.Close()
+	restored := httptest.NewServer(server{db: restoredDB})
+	defer restored.Close()
+	resp, body := do("GET", restored.URL+"/a/x", "", nil)
+	if got, want := string(body), "hello"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/plain"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+
+	// Nothing has changed, so the gzipped backup is the same database.
+	resp, body = do("GET", s.URL+"/?backup=gzip", "", nil)
+	if got, want := resp.Header.Get("Content-Type"), "application/gzip"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("ETag"), eTag+"-gzip"; got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unzipped, backup) {
+		t.Error("gzipped backup differs")
+	}
+
+	resp, _ = do("GET", s.URL+"/?backup", "", map[string]string{"If-None-Match": eTag})
+	if got, want := resp.StatusCode, http.StatusNotModified; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	do("PUT", s.URL+"/a/x", "changed", nil)
+	resp, _ = do("GET", s.URL+"/?backup", "", map[string]string{"If-None-Match": eTag})
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	tests := []string{"/a?backup", "/?backup=zip"}
+	for _, path := range tests {
+		resp, _ := do("GET", s.URL+path, "", nil)
+		if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+			t.Errorf("%s: bad status: got %d, want %d", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// errBatchFailed is returned from a batch's transaction to roll it back when
+// one of its operations fails.
+var errBatchFailed = errors.New("batch failed")
+
+// batchOp is an operation in a batch. Header holds the request header fields
+// the operation would have been sent with on its own, such as Content-Type,
+// TTL or If-Match. Value is base64 in JSON.
+type batchOp struct {
+	Op     string            `json:"op"`
+	Path   string            `json:"path"`
+	Value  []byte            `json:"value,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// batchResult is the outcome of an operation in a batch.
+type batchResult struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	ETag   string `json:"etag,omitempty"`
+}
+
+// request returns the request that op stands for, for checking its
+// preconditions and extracting its metadata.
+func (op *batchOp) request() *http.Request {
+	method := "PUT"
+	if op.Op == "delete" {
+		method = "DELETE"
+	}
+	header := make(http.Header)
+	for k, v := range op.Header {
+		header.Set(k, v)
+	}
+	return &http.Request{Method: method, Header: header}
+}
+
+// batch runs a list of put, delete and create_bucket operations in a single
+// transaction. Operation paths are relative to the request path. If any
+// operation fails, none of them take effect, and the response has the failed
+// operation's status. The other operations are reported as 424 Failed
+// Dependency.
+func (s server) batch(w http.ResponseWriter, req *http.Request) {
+	body, err := readBody(req, s.maxValueSize())
+	if err == errTooLarge {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	var b struct {
+		Ops []batchOp `json:"ops"`
+	}
+	if err := json.Unmarshal(body, &b); err != nil || len(b.Ops) == 0 {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	base := cleanPath(req.URL.EscapedPath())
+	for i := range b.Ops {
+		// Operation paths are URL paths, escaped as they would be in a
+		// request of their own, so that keys are stored the same way.
+		u, err := url.Parse("/" + strings.TrimLeft(joinPath(base, b.Ops[i].Path), "/"))
+		if err != nil || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" || strings.Contains(b.Ops[i].Path, "#") {
+			http.Error(w, "Bad request: bad path "+strconv.Quote(b.Ops[i].Path)+".", http.StatusBadRequest)
+			return
+		}
+		b.Ops[i].Path = cleanPath(u.EscapedPath())
+		switch b.Ops[i].Op {
+		case "put", "delete", "create_bucket":
+		default:
+			http.Error(w, "Bad request: unknown op "+b.Ops[i].Op+".", http.StatusBadRequest)
+			return
+		}
+		if b.Ops[i].Path == "/" {
+			http.Error(w, "Bad request: can't "+b.Ops[i].Op+" the root bucket.", http.StatusBadRequest)
+			return
+		}
+	}
+	lists, err := parseIf(req.Header.Get("If"))
+	if err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	tokens := submittedTokens(lists)
+
+	results := make([]batchResult, len(b.Ops))
+	failed := -1
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		locks, err := getLocks(tx)
+		if err != nil {
+			return err
+		}
+		for i := range b.Ops {
+			op := &b.Ops[i]
+			results[i] = batchResult{Op: op.Op, Path: op.Path}
+			for j := range locks {
+				if locks[j].conflicts(lockTarget{path: op.Path, deep: op.Op == "delete"}) && !tokens[locks[j].Token] {
+					results[i].Status = http.StatusLocked
+				}
+			}
+			if results[i].Status == 0 {
+				results[i].Status, results[i].ETag, err = s.applyBatchOp(tx, op)
+				if err != nil {
+					return err
+				}
+			}
+			if results[i].Status >= 300 {
+				failed = i
+				return errBatchFailed
+			}
+		}
+		return nil
+	})
+	status := http.StatusOK
+	if err == errBatchFailed {
+		status = results[failed].Status
+		for i := range results {
+			if i != failed {
+				results[i].Status, results[i].ETag = http.StatusFailedDependency, ""
+			}
+		}
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]batchResult{"results": results})
+}
+
+// applyBatchOp applies op within tx, and returns the status and ETag it would
+// have had as a request of its own. An error is only returned if the
+// transaction can't go on.
+func (s server) applyBatchOp(tx *bolt.Tx, op *batchOp) (int, string, error) {
+	req := op.request()
+	r, err := findResource(tx, op.Path)
+	if err != nil {
+		return 0, "", err
+	}
+	var header http.Header
+	if r != nil {
+		header = r.Header
+	}
+	parts := splitPath(op.Path)
+
+	switch op.Op {
+	case "create_bucket":
+		if r != nil && !r.Collection {
+			return http.StatusConflict, "", nil
+		}
+		if _, err := getOrCreateBoltBucket(tx, parts); err == bolt.ErrIncompatibleValue {
+			return http.StatusConflict, "", nil
+		} else if err != nil {
+			return 0, "", err
+		}
+		if r != nil {
+			return http.StatusNoContent, "", nil
+		}
+		return http.StatusCreated, "", nil
+
+	case "delete":
+		if r == nil {
+			return http.StatusNotFound, "", nil
+		}
+		if checkPreconditions(header, req) != 0 {
+			return http.StatusPreconditionFailed, "", nil
+		}
+		return http.StatusNoContent, "", deleteResource(tx, r)
+	}
+
+	if r != nil && r.Collection {
+		return http.StatusConflict, "", nil
+	}
+	if checkPreconditions(header, req) != 0 {
+		return http.StatusPreconditionFailed, "", nil
+	}
+	hasher, err := s.newBodyHasher(req.Header)
+	if err != nil {
+		return http.StatusBadRequest, "", nil
+	}
+	ttl, err := parseTTL(req.Header)
+	if err != nil {
+		return http.StatusBadRequest, "", nil
+	}
+	hasher.Write(op.Value)
+	if !hasher.verify() {
+		return http.StatusBadRequest, "", nil
+	}
+	value := op.Value
+	newHeader := hasher.valueHeader(s.extractHeader(req.Header), int64(len(value)))
+	setExpiry(newHeader, ttl)
+	if int64(len(value)) > s.largeObjectSize() {
+		m, err := s.putChunks(tx, value)
+		if err != nil {
+			return 0, "", err
+		}
+		manifestJSON, _ := json.Marshal(m)
+		newHeader.Set(manifestHeader, string(manifestJSON))
+		value = []byte(m.ID)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	if err := putValue(tx, op.Path, value, newHeader, header); err == bolt.ErrIncompatibleValue {
+		// A value is in the way of one of the enclosing buckets.
+		return http.StatusConflict, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	if header == nil {
+		return http.StatusCreated, newHeader.Get("ETag"), nil
+	}
+	return http.StatusNoContent, newHeader.Get("ETag"), nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	s := httptest.NewServer(server{
+		db:  db,
+		cfg: config.Data{Storage: config.Storage{LargeObjectSize: 8, ChunkSize: 4}},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	batch := func(path, body string) (int, []batchResult) {
+		resp := do("POST", s.URL+path+"?batch", body)
+		var r struct {
+			Results []batchResult `json:"results"`
+		}
+		if resp.StatusCode < 400 || resp.Header.Get("Content-Type") == "application/json; charset=utf-8" {
+			if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, r.Results
+	}
+	get := func(path string) (int, string) {
+		resp := do("GET", s.URL+path, "")
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	do("PUT", s.URL+"/pkg/old", "stale")
+
+	// "bWFuaWZlc3Q=" is "manifest", and "YSBsYXJnZSBibG9i" is "a large blob".
+	status, results := batch("/pkg", `{"ops": [
+		{"op": "create_bucket", "path": "blobs"},
+		{"op": "put", "path": "blobs/1", "value": "YSBsYXJnZSBibG9i"},
+		{"op": "put", "path": "manifest", "value": "bWFuaWZlc3Q=", "header": {"Content-Type": "text/plain", "If-None-Match": "*"}},
+		{"op": "delete", "path": "old"}
+	]}`)
+	if got, want := status, http.StatusOK; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	for i, want := range []int{http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusNoContent} {
+		if got := results[i].Status; got != want {
+			t.Errorf("op %d: bad status: got %d, want %d", i, got, want)
+		}
+	}
+	if got, want := results[2].Path, "/pkg/manifest"; got != want {
+		t.Errorf("bad path: got %q, want %q", got, want)
+	}
+	if got, want := results[2].ETag, etag([]byte("manifest")); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+	if _, body := get("/pkg/blobs/1"); body != "a large blob" {
+		t.Errorf("bad body: %q", body)
+	}
+	if status, _ := get("/pkg/old"); status != http.StatusNotFound {
+		t.Errorf("bad status: got %d, want %d", status, http.StatusNotFound)
+	}
+	resp := do("GET", s.URL+"/pkg/manifest", "")
+	if got, want := resp.Header.Get("Content-Type"), "text/plain"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+
+	// A failed precondition rolls back the whole batch.
+	status, results = batch("/", `{"ops": [
+		{"op": "put", "path": "/pkg/blobs/2", "value": "Mg=="},
+		{"op": "delete", "path": "/pkg/blobs/1"},
+		{"op": "put", "path": "/pkg/manifest", "value": "bmV3", "header": {"If-Match": "nope"}}
+	]}`)
+	if got, want := status, http.StatusPreconditionFailed; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	for i, want := range []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusPreconditionFailed} {
+		if got := results[i].Status; got != want {
+			t.Errorf("op %d: bad status: got %d, want %d", i, got, want)
+		}
+	}
+	if status, _ := get("/pkg/blobs/2"); status != http.StatusNotFound {
+		t.Errorf("bad status: got %d, want %d", status, http.StatusNotFound)
+	}
+	if _, body := get("/pkg/blobs/1"); body != "a large blob" {
+		t.Errorf("bad body: %q", body)
+	}
+	if _, body := get("/pkg/manifest"); body != "manifest" {
+		t.Errorf("bad body: %q", body)
+	}
+
+	// Paths are URL paths, so keys match those of requests of their own.
+	code, results := batch("/keys", `{"ops": [{"op": "put", "path": "a b", "value": "eA=="}, {"op": "put", "path": "café", "value": "eQ=="}, {"op": "put", "path": "x%2Fy", "value": "eg=="}]}`)
+	if code != http.StatusOK {
+		t.Fatalf("bad status: got %d, want %d: %+v", code, http.StatusOK, results)
+	}
+	for path, want := range map[string]string{"/keys/a%20b": "x", "/keys/caf%C3%A9": "y", "/keys/x%2Fy": "z"} {
+		if code, body := get(path); code != http.StatusOK || body != want {
+			t.Errorf("%s: got %d %q, want %q", path, code, body, want)
+		}
+	}
+
+	for i, test := range []struct {
+		Body         string
+		ExpectedCode int
+	}{
+		{Body: `{"ops": [{"op": "put", "path": "a?b", "value": "eA=="}]}`, ExpectedCode: http.StatusBadRequest},
+		{Body: `{"ops": [{"op": "put", "path": "a#", "value": "eA=="}]}`, ExpectedCode: http.StatusBadRequest},
+		{Body: `{"ops": [{"op": "put", "path": "a%zz", "value": "eA=="}]}`, ExpectedCode: http.StatusBadRequest},
+		{Body: `{"ops": []}`, ExpectedCode: http.StatusBadRequest},
+		{Body: `{"ops": [{"op": "frob", "path": "x"}]}`, ExpectedCode: http.StatusBadRequest},
+		{Body: `{"ops": [{"op": "delete", "path": "/"}]}`, ExpectedCode: http.StatusBadRequest},
+		{Body: `{"ops": [{"op": "delete", "path": "/pkg/nope"}]}`, ExpectedCode: http.StatusNotFound},
+		{Body: `{"ops": [{"op": "put", "path": "/pkg/blobs", "value": "eA=="}]}`, ExpectedCode: http.StatusConflict},
+		{Body: `{"ops": [{"op": "put", "path": "/pkg/manifest/x", "value": "eA=="}]}`, ExpectedCode: http.StatusConflict},
+		{Body: `{"ops": [{"op": "put", "path": "/pkg/x", "value": "eA==", "header": {"Content-MD5": "AAAAAAAAAAAAAAAAAAAAAA=="}}]}`, ExpectedCode: http.StatusBadRequest},
+		{Body: `{"ops": [{"op": "delete", "path": "/pkg"}]}`, ExpectedCode: http.StatusOK},
+	} {
+		if got, _ := batch("/", test.Body); got != test.ExpectedCode {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, test.ExpectedCode)
+		}
+	}
+	if got, want := countChunks(t, db), 0; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+}
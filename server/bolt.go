@@ -7,6 +7,8 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -39,15 +41,6 @@ func getBoltBucketOrValue(bucket *bolt.Bucket, key []byte) (*bolt.Bucket, []byte
 	return b, nil
 }
 
-func listKeys(bucket *bolt.Bucket) (keys []string, err error) {
-	keys = []string{}
-	err = bucket.ForEach(func(k, _ []byte) error {
-		keys = append(keys, string(k))
-		return nil
-	})
-	return
-}
-
 func getBoltBucket(tx *bolt.Tx, parts [][]byte) *bolt.Bucket {
 	b := tx.Bucket(parts[0])
 	if b == nil {
@@ -67,16 +60,252 @@ func getOrCreateBoltBucket(tx *bolt.Tx, parts [][]byte) (*bolt.Bucket, error) {
 	if b == nil {
 		panic("nil root bucket")
 	}
-	var err error
-	for _, p := range parts[1:] {
-		b, err = b.CreateBucketIfNotExists(p)
-		if err != nil {
+	for i, p := range parts[1:] {
+		if child := b.Bucket(p); child != nil {
+			b = child
+			continue
+		}
+		var err error
+		if b, err = b.CreateBucket(p); err != nil {
+			return nil, err
+		}
+		path := string(bucketKey(parts[:i+2]))
+		if err := recordChange(tx, changeEvent{Op: "create_bucket", Path: path}); err != nil {
 			return nil, err
 		}
 	}
 	return b, nil
 }
 
+// putValue stores value at path, creating any enclosing buckets, and records
+// its header. oldHeader is the header of the value being replaced, if any.
+func putValue(tx *bolt.Tx, path string, value []byte, header, oldHeader http.Header) error {
+	parts := splitPath(path)
+	bucket, err := getOrCreateBoltBucket(tx, parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+	key := parts[len(parts)-1]
+	if err := retireValue(tx, path, bucket, key, oldHeader); err != nil {
+		return err
+	}
+	if err := stampVersion(tx, path, header); err != nil {
+		return err
+	}
+	if err := indexExpiry(tx, path, header); err != nil {
+		return err
+	}
+	if header.Get(manifestHeader) != "" {
+		// The value of a large object is its ID.
+		if err := claimChunks(tx, string(value)); err != nil {
+			return err
+		}
+	}
+	if err := bucket.Put(key, value); err != nil {
+		return err
+	}
+	err = recordChange(tx, changeEvent{
+		Op:           "put",
+		Path:         path,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	})
+	if err != nil {
+		return err
+	}
+	return writeHeaderValue(tx, path, header)
+}
+
+// deleteValue deletes the value at path, along with its header.
+func deleteValue(tx *bolt.Tx, path string, header http.Header) error {
+	parts := splitPath(path)
+	bucket := getBoltBucket(tx, parts[:len(parts)-1])
+	if bucket == nil {
+		return bolt.ErrBucketNotFound
+	}
+	key := parts[len(parts)-1]
+	if err := retireValue(tx, path, bucket, key, header); err != nil {
+		return err
+	}
+	if err := tx.Bucket(headerBucket).Delete([]byte(path)); err != nil {
+		return err
+	}
+	if err := deleteProperties(tx, path); err != nil {
+		return err
+	}
+	if err := recordChange(tx, changeEvent{Op: "delete", Path: path}); err != nil {
+		return err
+	}
+	return bucket.Delete(key)
+}
+
+// unlinkValue removes the value at path and its header, leaving its content
+// in place for a value that has taken it over.
+func unlinkValue(tx *bolt.Tx, path string, header http.Header) error {
+	parts := splitPath(path)
+	bucket := getBoltBucket(tx, parts[:len(parts)-1])
+	if bucket == nil {
+		return bolt.ErrBucketNotFound
+	}
+	if err := unindexExpiry(tx, path, header); err != nil {
+		return err
+	}
+	if err := tx.Bucket(headerBucket).Delete([]byte(path)); err != nil {
+		return err
+	}
+	if err := recordChange(tx, changeEvent{Op: "delete", Path: path}); err != nil {
+		return err
+	}
+	return bucket.Delete(parts[len(parts)-1])
+}
+
+// copyValue copies the value at src, which must not be a bucket, to dst.
+// Large objects get chunks of their own. If move is set, the value is moved
+// instead, taking its chunks with it. Either way, the value at dst starts a
+// version history of its own.
+func copyValue(tx *bolt.Tx, src, dst string, move bool) error {
+	parts := splitPath(src)
+	bucket := getBoltBucket(tx, parts[:len(parts)-1])
+	if bucket == nil {
+		return bolt.ErrBucketNotFound
+	}
+	value := append([]byte(nil), bucket.Get(parts[len(parts)-1])...)
+	header, err := getHeaderValue(tx, src)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	newHeader := cloneHeader(header)
+	newHeader.Del(versionHeader)
+	if !move {
+		m, err := getManifest(header)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			if m, err = m.copy(tx); err != nil {
+				return err
+			}
+			manifestJSON, _ := json.Marshal(m)
+			newHeader.Set(manifestHeader, string(manifestJSON))
+			value = []byte(m.ID)
+		}
+		newHeader.Set("Last-Modified", time.Now().UTC().Format(time.RFC1123Z))
+	}
+	oldHeader, err := getHeaderValue(tx, dst)
+	if err != nil {
+		return err
+	}
+	if err := putValue(tx, dst, value, newHeader, oldHeader); err != nil {
+		return err
+	}
+	if move {
+		return unlinkValue(tx, src, header)
+	}
+	return nil
+}
+
+// copyTree copies the bucket at src to dst, along with everything in it
+// unless shallow is set. If move is set, the tree is moved instead.
+func copyTree(tx *bolt.Tx, src, dst string, shallow, move bool) error {
+	bucket := getBoltBucket(tx, splitPath(src))
+	if bucket == nil {
+		return bolt.ErrBucketNotFound
+	}
+	if _, err := getOrCreateBoltBucket(tx, splitPath(dst)); err != nil {
+		return err
+	}
+	if shallow {
+		return nil
+	}
+	keys, buckets := childKeys(bucket)
+	for i, k := range keys {
+		var err error
+		if buckets[i] {
+			err = copyTree(tx, joinPath(src, k), joinPath(dst, k), false, move)
+		} else {
+			err = copyValue(tx, joinPath(src, k), joinPath(dst, k), move)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if move {
+		parts := splitPath(src)
+		if err := getBoltBucket(tx, parts[:len(parts)-1]).DeleteBucket(parts[len(parts)-1]); err != nil {
+			return err
+		}
+		return recordChange(tx, changeEvent{Op: "delete_bucket", Path: src})
+	}
+	return nil
+}
+
+// deleteTree deletes the bucket at path and everything in it, as if each of
+// its values had been deleted in turn.
+func deleteTree(tx *bolt.Tx, path string) error {
+	parts := splitPath(path)
+	parent := getBoltBucket(tx, parts[:len(parts)-1])
+	if parent == nil || parent.Bucket(parts[len(parts)-1]) == nil {
+		return bolt.ErrBucketNotFound
+	}
+	keys, buckets := childKeys(parent.Bucket(parts[len(parts)-1]))
+	for i, k := range keys {
+		var err error
+		if buckets[i] {
+			err = deleteTree(tx, joinPath(path, k))
+		} else {
+			var header http.Header
+			if header, err = getHeaderValue(tx, joinPath(path, k)); err == nil {
+				err = deleteValue(tx, joinPath(path, k), header)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := deleteProperties(tx, path); err != nil {
+		return err
+	}
+	if err := parent.DeleteBucket(parts[len(parts)-1]); err != nil {
+		return err
+	}
+	return recordChange(tx, changeEvent{Op: "delete_bucket", Path: path})
+}
+
+// childKeys returns the keys in bucket, and whether each of them is a bucket.
+// Unlike ForEach, it allows the bucket to be modified afterwards.
+func childKeys(bucket *bolt.Bucket) (keys []string, buckets []bool) {
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		keys = append(keys, string(k))
+		buckets = append(buckets, v == nil)
+	}
+	return keys, buckets
+}
+
+// joinPath returns the path of key within the bucket at path.
+func joinPath(path, key string) string {
+	return strings.TrimSuffix(path, "/") + "/" + key
+}
+
+// retireValue disposes of the value at key, which is about to be overwritten
+// or deleted. If versioning is turned on for the bucket, the value is kept in
+// its version history. Otherwise, its chunks are freed.
+func retireValue(tx *bolt.Tx, path string, bucket *bolt.Bucket, key []byte, header http.Header) error {
+	if header == nil {
+		return nil
+	}
+	if err := unindexExpiry(tx, path, header); err != nil {
+		return err
+	}
+	if versioningEnabled(tx, path) {
+		return archiveVersion(tx, path, header, bucket.Get(key))
+	}
+	return deleteContent(tx, header)
+}
+
 func getHeaderValue(tx *bolt.Tx, path string) (http.Header, error) {
 	var header http.Header
 
@@ -0,0 +1,215 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// defaultChangeLogEntries is the most entries kept in the change log when
+	// the config doesn't say otherwise.
+	defaultChangeLogEntries = 100000
+
+	// defaultChangeLogAge is how long change log entries are kept when the
+	// config doesn't say otherwise.
+	defaultChangeLogAge = 7 * 24 * time.Hour
+
+	// compactBatchSize is the most change log entries that are compacted in
+	// a single transaction.
+	compactBatchSize = 1000
+)
+
+// changeBucket is the change log. Its keys are sequence numbers, big-endian,
+// and its values are changeEvents as JSON.
+var changeBucket = append([]byte{0}, []byte("changes")...)
+
+// errCompacted is returned when changes are asked for from a sequence number
+// that has been compacted away.
+var errCompacted = errors.New("change log compacted")
+
+func createChangeBucketIfNotExists(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(changeBucket)
+		return err
+	})
+}
+
+func (s server) changeLogEntries() int64 {
+	if s.cfg.ChangeLog.MaxEntries > 0 {
+		return s.cfg.ChangeLog.MaxEntries
+	}
+	return defaultChangeLogEntries
+}
+
+func (s server) changeLogAge() time.Duration {
+	if s.cfg.ChangeLog.MaxAge > 0 {
+		return s.cfg.ChangeLog.MaxAge
+	}
+	return defaultChangeLogAge
+}
+
+func changeKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// recordChange appends e to the change log, under the next sequence number,
+// queues it for any webhooks it concerns, and publishes it to watchers once tx
+// commits. It is called wherever a value is stored or deleted.
+func recordChange(tx *bolt.Tx, e changeEvent) error {
+	bucket := tx.Bucket(changeBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	e.Seq, e.Path = seq, cleanPath(e.Path)
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put(changeKey(seq), b); err != nil {
+		return err
+	}
+	if err := enqueueWebhooks(tx, e); err != nil {
+		return err
+	}
+	publishChange(tx, e)
+	return nil
+}
+
+// oldestChange returns the sequence number of the oldest entry in the change
+// log. If the log is empty, it is the number the next entry will get.
+func oldestChange(tx *bolt.Tx) uint64 {
+	bucket := tx.Bucket(changeBucket)
+	if k, _ := bucket.Cursor().First(); k != nil {
+		return binary.BigEndian.Uint64(k)
+	}
+	return bucket.Sequence() + 1
+}
+
+// readChanges returns up to limit changes to path or the values beneath it,
+// starting at sequence number since, along with the number to carry on from.
+// If entries from since onwards have been compacted away, errCompacted is
+// returned. A since of zero starts at the oldest entry, and a limit of zero
+// means no limit.
+func readChanges(tx *bolt.Tx, path string, since uint64, limit int) ([]changeEvent, uint64, error) {
+	if since == 0 {
+		since = oldestChange(tx)
+	} else if since < oldestChange(tx) {
+		return nil, 0, errCompacted
+	}
+	bucket := tx.Bucket(changeBucket)
+	next := bucket.Sequence() + 1
+	changes := []changeEvent{}
+	c := bucket.Cursor()
+	for k, v := c.Seek(changeKey(since)); k != nil; k, v = c.Next() {
+		if limit > 0 && len(changes) == limit {
+			next = binary.BigEndian.Uint64(k)
+			break
+		}
+		var e changeEvent
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, 0, err
+		}
+		if e.Path == path || isWithin(e.Path, path) {
+			changes = append(changes, e)
+		}
+	}
+	return changes, next, nil
+}
+
+// getChanges writes the change log entries for the request path and the
+// values beneath it, from the sequence number in the "since" query
+// parameter. The response includes the sequence number to ask for next, so
+// that a client can carry on where it left off.
+func (s server) getChanges(w http.ResponseWriter, req *http.Request) {
+	var since uint64
+	if v := req.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Bad request.", http.StatusBadRequest)
+			return
+		}
+	}
+	path := cleanPath(req.URL.EscapedPath())
+	var (
+		changes []changeEvent
+		next    uint64
+	)
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		changes, next, err = readChanges(tx, path, since, s.maxListKeys())
+		return err
+	})
+	if err == errCompacted {
+		http.Error(w, "Changes no longer available.", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Changes []changeEvent `json:"changes"`
+		Next    uint64        `json:"next"`
+	}{changes, next})
+}
+
+// compactChanges deletes the change log entries that are older than the
+// retention age, or beyond the most entries kept.
+func (s server) compactChanges(now time.Time) error {
+	cutoff := now.Add(-s.changeLogAge())
+	for {
+		var n int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(changeBucket)
+			last := bucket.Sequence()
+			var keys [][]byte
+			c := bucket.Cursor()
+			for k, v := c.First(); k != nil && len(keys) < compactBatchSize; k, v = c.Next() {
+				if last-binary.BigEndian.Uint64(k) < uint64(s.changeLogEntries()) {
+					var e changeEvent
+					if err := json.Unmarshal(v, &e); err != nil {
+						return err
+					}
+					if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil && !t.Before(cutoff) {
+						break
+					}
+				}
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			n = len(keys)
+			for _, k := range keys {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || n < compactBatchSize {
+			return err
+		}
+	}
+}
+
+// compactChangesEvery calls compactChanges every interval, forever.
+func (s server) compactChangesEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := s.compactChanges(now); err != nil {
+			log.Printf("couldn't compact change log: %s", err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestChangeLog(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	srv := server{
+		db: db,
+		cfg: config.Data{
+			Limits:    config.Limits{MaxListKeys: 2},
+			ChangeLog: config.ChangeLog{MaxEntries: 3},
+		},
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	type page struct {
+		Changes []changeEvent `json:"changes"`
+		Next    uint64        `json:"next"`
+	}
+	get := func(path string) (int, page) {
+		resp := do("GET", path, "", nil)
+		var p page
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, p
+	}
+
+	do("PUT", "/a/x", "1", nil)
+	do("PUT", "/b/y", "2", nil)
+	do("PUT", "/a/x", "3", nil)
+	do("DELETE", "/a/x", "", nil)
+	do("PUT", "/a/sub/z", "4", nil)
+
+	// Pages of /a's changes, carrying on from each page's next.
+	var changes []changeEvent
+	for since := uint64(0); ; {
+		status, p := get("/a?changes&since=" + strconv.FormatUint(since, 10))
+		if status != http.StatusOK {
+			t.Fatalf("bad status: got %d, want %d", status, http.StatusOK)
+		}
+		if len(p.Changes) == 0 {
+			break
+		}
+		changes = append(changes, p.Changes...)
+		since = p.Next
+	}
+	expected := []struct {
+		Seq  uint64
+		Op   string
+		Path string
+	}{
+		{1, "create_bucket", "/a"},
+		{2, "put", "/a/x"},
+		{5, "put", "/a/x"},
+		{6, "delete", "/a/x"},
+		{7, "create_bucket", "/a/sub"},
+		{8, "put", "/a/sub/z"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("bad changes: got %+v", changes)
+	}
+	for i, want := range expected {
+		got := changes[i]
+		if got.Seq != want.Seq || got.Op != want.Op || got.Path != want.Path {
+			t.Errorf("change %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if got, want := changes[2].ETag, etag([]byte("3")); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+
+	// A failed request logs nothing.
+	do("PUT", "/a/sub/z", "5", map[string]string{"If-Match": "nope"})
+	if _, p := get("/?changes&since=9"); len(p.Changes) != 0 || p.Next != 9 {
+		t.Errorf("bad page: %+v", p)
+	}
+
+	if err := srv.compactChanges(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get("/?changes&since=5"); status != http.StatusGone {
+		t.Errorf("bad status: got %d, want %d", status, http.StatusGone)
+	}
+	if _, p := get("/?changes"); len(p.Changes) != 2 || p.Changes[0].Seq != 6 {
+		t.Errorf("bad page after compaction: %+v", p)
+	}
+	if err := srv.compactChanges(time.Now().Add(defaultChangeLogAge + time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if status, p := get("/?changes&since=9"); status != http.StatusOK || len(p.Changes) != 0 {
+		t.Errorf("bad page after compaction: %d %+v", status, p)
+	}
+	if status, _ := get("/?changes&since=8"); status != http.StatusGone {
+		t.Errorf("bad status: got %d, want %d", status, http.StatusGone)
+	}
+	if status, _ := get("/?changes&since=soon"); status != http.StatusBadRequest {
+		t.Errorf("bad status: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// So is a PUT of just a value's metadata.
+	do("PUT", "/a/sub/z?metadata", "", map[string]string{"Content-Type": "application/json"})
+	if _, p := get("/a?changes&since=9"); len(p.Changes) != 1 || p.Changes[0].Op != "put" || !p.Changes[0].Metadata {
+		t.Errorf("bad page: %+v", p)
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	do("PUT", "/feed/a", "1", nil)
+	do("PUT", "/feed/b", "2", nil)
+	do("PUT", "/feed/c", "3", nil)
+
+	resp := do("GET", "/feed?watch", "", map[string]string{"Last-Event-ID": "1"})
+	defer resp.Body.Close()
+	do("PUT", "/feed/d", "4", nil)
+
+	r := bufio.NewReader(resp.Body)
+	var ids []string
+	for len(ids) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		}
+	}
+	if got, want := strings.Join(ids, ","), "2,3,4"; got != want {
+		t.Errorf("bad event IDs: got %s, want %s", got, want)
+	}
+}
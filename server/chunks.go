@@ -0,0 +1,437 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// defaultLargeObjectSize is the size above which values are stored as
+	// large objects when the config doesn't say otherwise.
+	defaultLargeObjectSize = 1 << 22
+
+	// defaultChunkSize is the size of the chunks that large objects are
+	// split into when the config doesn't say otherwise.
+	defaultChunkSize = 1 << 20
+
+	// manifestHeader is the header field holding a large object's manifest.
+	manifestHeader = internalHeaderPrefix + "Manifest"
+
+	// orphanGrace is how long the chunks of an object that hasn't been
+	// committed are kept after the last one was written, before they are
+	// taken to be orphaned and collected.
+	orphanGrace = time.Hour
+)
+
+var (
+	chunkBucket = append([]byte{0}, []byte("chunks")...)
+	// pendingBucket holds the objects that writeChunks is writing, keyed by
+	// ID, until a transaction commits their manifest. Each entry holds the
+	// time the last chunk was written, as big-endian Unix seconds, followed
+	// by the number of chunks written.
+	pendingBucket   = append([]byte{0}, []byte("pending")...)
+	errMissingChunk = errors.New("missing chunk")
+)
+
+// manifest describes a large object. The object's content is stored in the
+// chunk bucket, split into chunks of ChunkSize bytes, and the value stored
+// under its key is the object's ID.
+//
+// Objects assembled from an upload session have no chunks of their own.
+// Instead, their content is the concatenation of their parts.
+type manifest struct {
+	ID        string     `json:"id"`
+	Size      int64      `json:"size"`
+	ChunkSize int64      `json:"chunk_size,omitempty"`
+	Chunks    int64      `json:"chunks,omitempty"`
+	Parts     []manifest `json:"parts,omitempty"`
+}
+
+func createChunkBucketIfNotExists(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(chunkBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(pendingBucket)
+		return err
+	})
+}
+
+func (s server) largeObjectSize() int64 {
+	if s.cfg.Storage.LargeObjectSize > 0 {
+		return s.cfg.Storage.LargeObjectSize
+	}
+	return defaultLargeObjectSize
+}
+
+func (s server) chunkSize() int64 {
+	if s.cfg.Storage.ChunkSize > 0 {
+		return s.cfg.Storage.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// getManifest returns the manifest stored in header, or nil if header doesn't
+// belong to a large object.
+func getManifest(header http.Header) (*manifest, error) {
+	v := header.Get(manifestHeader)
+	if v == "" {
+		return nil, nil
+	}
+	var m manifest
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func newObjectID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func chunkKey(id string, index int64) []byte {
+	key := make([]byte, len(id)+8)
+	copy(key, id)
+	binary.BigEndian.PutUint64(key[len(id):], uint64(index))
+	return key
+}
+
+// deleteChunks deletes the first n chunks of the object with the given ID.
+func deleteChunks(tx *bolt.Tx, id string, n int64) error {
+	bucket := tx.Bucket(chunkBucket)
+	for i := int64(0); i < n; i++ {
+		if err := bucket.Delete(chunkKey(id, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete deletes the chunks of m and its parts.
+func (m *manifest) delete(tx *bolt.Tx) error {
+	for i := range m.Parts {
+		if err := m.Parts[i].delete(tx); err != nil {
+			return err
+		}
+	}
+	return deleteChunks(tx, m.ID, m.Chunks)
+}
+
+// copy duplicates the chunks of m and its parts under new IDs, and returns
+// the manifest of the copy.
+func (m *manifest) copy(tx *bolt.Tx) (*manifest, error) {
+	id, err := newObjectID()
+	if err != nil {
+		return nil, err
+	}
+	c := *m
+	c.ID = id
+	c.Parts = make([]manifest, len(m.Parts))
+	for i := range m.Parts {
+		p, err := m.Parts[i].copy(tx)
+		if err != nil {
+			return nil, err
+		}
+		c.Parts[i] = *p
+	}
+	bucket := tx.Bucket(chunkBucket)
+	for i := int64(0); i < m.Chunks; i++ {
+		chunk := bucket.Get(chunkKey(m.ID, i))
+		if chunk == nil {
+			return nil, errMissingChunk
+		}
+		if err := bucket.Put(chunkKey(id, i), append([]byte(nil), chunk...)); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// deleteContent deletes the chunks of the value described by header, if it's
+// a large object. It must be called whenever a value is overwritten or deleted.
+func deleteContent(tx *bolt.Tx, header http.Header) error {
+	m, err := getManifest(header)
+	if err != nil || m == nil {
+		return err
+	}
+	return m.delete(tx)
+}
+
+// chunkReader reads the content of a large object from the chunk bucket, a
+// chunk at a time. It is only valid for the life of the transaction that the
+// bucket belongs to.
+type chunkReader struct {
+	bucket *bolt.Bucket
+	m      *manifest
+}
+
+func (r chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(r.m.Parts) > 0 {
+		return r.readPartsAt(p, off)
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.m.Size {
+			return n, io.EOF
+		}
+		chunk := r.bucket.Get(chunkKey(r.m.ID, off/r.m.ChunkSize))
+		if chunk == nil {
+			return n, errMissingChunk
+		}
+		c := copy(p[n:], chunk[off%r.m.ChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (r chunkReader) readPartsAt(p []byte, off int64) (int, error) {
+	n := 0
+	for i := range r.m.Parts {
+		part := &r.m.Parts[i]
+		if n == len(p) {
+			break
+		}
+		if off >= part.Size {
+			off -= part.Size
+			continue
+		}
+		c, err := chunkReader{bucket: r.bucket, m: part}.ReadAt(p[n:], off)
+		n += c
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		off = 0
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// valueContent returns a reader for a stored value and its size. For large
+// objects, value is the object's ID and the content is read from its chunks.
+func valueContent(tx *bolt.Tx, header http.Header, value []byte) (io.ReaderAt, int64, error) {
+	m, err := getManifest(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	if m == nil {
+		return bytes.NewReader(value), int64(len(value)), nil
+	}
+	return chunkReader{bucket: tx.Bucket(chunkBucket), m: m}, m.Size, nil
+}
+
+// writeChunks stores the content of body in the chunk bucket and returns its
+// manifest. Each chunk is written in its own transaction as it is
+// read, so that the content never has to fit into the memory of a single
+// transaction. If body holds more than max bytes, errTooLarge is returned, and
+// errBadRequest is returned if it can't be read. No chunks are left behind
+// when an error is returned.
+//
+// The object stays in the pending bucket until the transaction that commits
+// its manifest claims it, so that its chunks are collected if the server
+// stops before then.
+func (s server) writeChunks(body io.Reader, max int64) (*manifest, error) {
+	id, err := newObjectID()
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{ID: id, ChunkSize: s.chunkSize()}
+
+	buf := make([]byte, m.ChunkSize)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if m.Size+int64(n) > max {
+				s.freeChunks(m)
+				return nil, errTooLarge
+			}
+			err := s.db.Update(func(tx *bolt.Tx) error {
+				pending := tx.Bucket(pendingBucket)
+				if m.Chunks > 0 && pending.Get([]byte(m.ID)) == nil {
+					// The collector took the object for an orphan.
+					return errMissingChunk
+				}
+				if err := tx.Bucket(chunkBucket).Put(chunkKey(m.ID, m.Chunks), buf[:n]); err != nil {
+					return err
+				}
+				return pending.Put([]byte(m.ID), pendingEntry(time.Now(), m.Chunks+1))
+			})
+			if err != nil {
+				s.freeChunks(m)
+				return nil, err
+			}
+			m.Chunks++
+			m.Size += int64(n)
+		}
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && n > 0) {
+			break
+		}
+		if err != nil {
+			log.Println(err)
+			s.freeChunks(m)
+			return nil, errBadRequest
+		}
+	}
+	return m, nil
+}
+
+// putChunks stores value as a large object within tx, for values that
+// arrive in full rather than being streamed, and returns its manifest.
+func (s server) putChunks(tx *bolt.Tx, value []byte) (*manifest, error) {
+	id, err := newObjectID()
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{ID: id, ChunkSize: s.chunkSize(), Size: int64(len(value))}
+	bucket := tx.Bucket(chunkBucket)
+	for off := int64(0); off < m.Size; off += m.ChunkSize {
+		end := off + m.ChunkSize
+		if end > m.Size {
+			end = m.Size
+		}
+		if err := bucket.Put(chunkKey(m.ID, m.Chunks), value[off:end]); err != nil {
+			return nil, err
+		}
+		m.Chunks++
+	}
+	return m, nil
+}
+
+// freeChunks deletes the chunks of an object that never got committed.
+func (s server) freeChunks(m *manifest) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := claimChunks(tx, m.ID); err != nil {
+			return err
+		}
+		return m.delete(tx)
+	})
+	if err != nil {
+		log.Printf("couldn't delete chunks of %s: %s", m.ID, err)
+	}
+}
+
+func pendingEntry(t time.Time, chunks int64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+	binary.BigEndian.PutUint64(b[8:], uint64(chunks))
+	return b
+}
+
+// claimChunks takes the object with the given ID out of the pending bucket,
+// within the transaction that commits its manifest.
+func claimChunks(tx *bolt.Tx, id string) error {
+	return tx.Bucket(pendingBucket).Delete([]byte(id))
+}
+
+// collectOrphans deletes the chunks of the objects that writeChunks last wrote
+// to before now less orphanGrace, and that were never committed. Up to
+// sweepBatchSize objects are deleted in each transaction.
+func (s server) collectOrphans(now time.Time) error {
+	cutoff := now.Add(-orphanGrace).Unix()
+	var after []byte
+	for {
+		var n int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			pending := tx.Bucket(pendingBucket)
+			var ids [][]byte
+			c := pending.Cursor()
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && n < sweepBatchSize; k, v = c.Next() {
+				n++
+				after = append([]byte(nil), k...)
+				if len(v) == 16 && int64(binary.BigEndian.Uint64(v)) < cutoff {
+					ids = append(ids, after)
+				}
+			}
+			for _, id := range ids {
+				chunks := int64(binary.BigEndian.Uint64(pending.Get(id)[8:]))
+				if err := deleteChunks(tx, string(id), chunks); err != nil {
+					return err
+				}
+				if err := pending.Delete(id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || n < sweepBatchSize {
+			return err
+		}
+	}
+}
+
+// collectOrphansEvery calls collectOrphans every interval, forever.
+func (s server) collectOrphansEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := s.collectOrphans(now); err != nil {
+			log.Printf("couldn't collect orphaned chunks: %s", err)
+		}
+	}
+}
+
+// writeChunksError writes the response for an error from writeChunks.
+func writeChunksError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTooLarge:
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+	case errBadRequest:
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+	default:
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+	}
+}
+
+// putLargeObject stores body as a large object. Its chunks are written as the
+// body is read, and then the manifest and key are written in a final
+// transaction, making the new object visible atomically.
+func (s server) putLargeObject(w http.ResponseWriter, req *http.Request, body io.Reader, hasher *bodyHasher, ttl time.Duration) {
+	m, err := s.writeChunks(io.TeeReader(body, hasher), s.maxObjectSize())
+	if err == nil && req.ContentLength > 0 && req.ContentLength != m.Size {
+		s.freeChunks(m)
+		err = errBadRequest
+	}
+	if err != nil {
+		writeChunksError(w, err)
+		return
+	}
+	if !hasher.verify() {
+		s.freeChunks(m)
+		http.Error(w, "Digest mismatch.", http.StatusBadRequest)
+		return
+	}
+
+	manifestJSON, _ := json.Marshal(m)
+	header := hasher.valueHeader(s.extractHeader(req.Header), m.Size)
+	header.Set(manifestHeader, string(manifestJSON))
+	setExpiry(header, ttl)
+	if err := s.commitValue(w, req, []byte(m.ID), header); err != nil {
+		s.freeChunks(m)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
+)
+
+func countChunks(t *testing.T, db *bolt.DB) int {
+	var n int
+	err := db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(chunkBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestLargeObjects(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	s := httptest.NewServer(server{
+		db: db,
+		cfg: config.Data{
+			Limits:  config.Limits{MaxValueSize: 50, MaxObjectSize: 1000},
+			Storage: config.Storage{LargeObjectSize: 20, ChunkSize: 8},
+		},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	body := make([]byte, 100)
+	for i := range body {
+		body[i] = byte('a' + i%26)
+	}
+
+	put := func(body io.Reader) *http.Response {
+		req, err := http.NewRequest("PUT", s.URL+"/foo/bar", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := put(bytes.NewReader(body))
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("ETag"), etag(body); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+	if got, want := countChunks(t, db), 13; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+
+	resp, err := client.Get(s.URL + "/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Errorf("bad body: got %q, want %q", string(b), string(body))
+	}
+	if got, want := resp.Header.Get("Content-Length"), "100"; got != want {
+		t.Errorf("bad Content-Length: got %q, want %q", got, want)
+	}
+	if got := resp.Header.Get(manifestHeader); got != "" {
+		t.Errorf("manifest leaked to client: %q", got)
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"/foo/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=6-17")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), string(body[6:18]); got != want {
+		t.Errorf("bad range body: got %q, want %q", got, want)
+	}
+
+	// Large objects are limited by max_object_size rather than
+	// max_value_size, and a chunked upload that exceeds it leaves nothing
+	// behind.
+	resp = put(struct{ io.Reader }{bytes.NewReader(make([]byte, 1001))})
+	if got, want := resp.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp = put(bytes.NewReader(make([]byte, 1001)))
+	if got, want := resp.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := countChunks(t, db), 13; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+
+	// Overwriting a large object with a small value frees its chunks.
+	resp = put(bytes.NewReader([]byte("small")))
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := countChunks(t, db), 0; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+
+	resp = put(struct{ io.Reader }{bytes.NewReader(body)})
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	req, err = http.NewRequest("DELETE", s.URL+"/foo/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := countChunks(t, db), 0; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+}
+
+func TestCollectOrphans(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	srv := server{
+		db: db,
+		cfg: config.Data{
+			Limits:  config.Limits{MaxValueSize: 50, MaxObjectSize: 1000},
+			Storage: config.Storage{LargeObjectSize: 20, ChunkSize: 8},
+		},
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+
+	body := make([]byte, 100)
+	for i := range body {
+		body[i] = byte('a' + i%26)
+	}
+	req, err := http.NewRequest("PUT", s.URL+"/foo/bar", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	// Committing the object claims its chunks.
+	err = db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(pendingBucket).Stats().KeyN; n != 0 {
+			t.Errorf("object still pending after commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks written by a request that never got to commit, as when the
+	// server stops, are left over.
+	for i := 0; i < sweepBatchSize+1; i++ {
+		if _, err := srv.writeChunks(bytes.NewReader(body[:10]), 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := countChunks(t, db), 13+2*(sweepBatchSize+1); got != want {
+		t.Fatalf("bad number of chunks: got %d, want %d", got, want)
+	}
+	if err := srv.collectOrphans(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countChunks(t, db), 13+2*(sweepBatchSize+1); got != want {
+		t.Errorf("chunks collected too soon: got %d, want %d", got, want)
+	}
+	if err := srv.collectOrphans(time.Now().Add(2 * orphanGrace)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countChunks(t, db), 13; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+
+	resp, err := http.Get(s.URL + "/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Errorf("bad body: got %q, want %q", string(b), string(body))
+	}
+}
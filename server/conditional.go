@@ -0,0 +1,148 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkPreconditions evaluates the conditional headers of req against the
+// stored header of the target resource, in the order given by RFC 7232
+// section 6. A nil header means that the resource does not exist.
+//
+// It returns 0 if the request should be processed, or otherwise the status
+// code (304 or 412) that should be sent in its place.
+func checkPreconditions(header http.Header, req *http.Request) int {
+	if _, ok := req.Header["If-Match"]; ok {
+		if !checkIfMatch(header, req) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := parseDateHeader(req.Header, "If-Unmodified-Since"); ok {
+		if lm, ok := lastModified(header); ok && lm.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	isRead := req.Method == "GET" || req.Method == "HEAD"
+
+	if _, ok := req.Header["If-None-Match"]; ok {
+		if checkIfNoneMatch(header, req) {
+			if isRead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := parseDateHeader(req.Header, "If-Modified-Since"); ok && isRead {
+		if lm, ok := lastModified(header); ok && !lm.After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// returns whether or not the stored ETag matched any of the If-Match values,
+// using the strong comparison function
+func checkIfMatch(header http.Header, req *http.Request) bool {
+	if header == nil {
+		return false
+	}
+	eTag := header.Get("ETag")
+	for _, m := range etagList(req.Header["If-Match"]) {
+		if m == "*" || (eTag != "" && etagsMatch(eTag, m, false)) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns whether or not the ETag matched any of the If-None-Match values,
+// using the weak comparison function
+func checkIfNoneMatch(header http.Header, req *http.Request) bool {
+	if header == nil {
+		return false
+	}
+	eTag := header.Get("ETag")
+	for _, m := range etagList(req.Header["If-None-Match"]) {
+		if m == "*" || (eTag != "" && etagsMatch(eTag, m, true)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfRange reports whether the Range header of req should be honoured.
+// If-Range holds either an entity tag or a date; when it doesn't match the
+// current representation, the whole value is sent instead.
+func checkIfRange(header http.Header, req *http.Request) bool {
+	v := strings.TrimSpace(req.Header.Get("If-Range"))
+	if v == "" {
+		return true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		lm, ok := lastModified(header)
+		return ok && lm.Equal(t)
+	}
+	eTag := header.Get("ETag")
+	return eTag != "" && etagsMatch(eTag, v, false)
+}
+
+// etagList splits the comma separated entity tags found in vs.
+func etagList(vs []string) []string {
+	var tags []string
+	for _, v := range vs {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// etagsMatch compares the stored ETag with one supplied by a client. Stored
+// ETags are unquoted, but clients may quote them. Weak tags only match when
+// weak is true.
+func etagsMatch(stored, tag string, weak bool) bool {
+	if strings.HasPrefix(tag, "W/") {
+		if !weak {
+			return false
+		}
+		tag = tag[2:]
+	}
+	return strings.Trim(tag, `"`) == strings.Trim(stored, `"`)
+}
+
+// lastModified parses the stored Last-Modified field, which is written in
+// RFC 1123 format with a numeric zone.
+func lastModified(header http.Header) (time.Time, bool) {
+	v := header.Get("Last-Modified")
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC1123Z, v); err == nil {
+		return t, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// parseDateHeader parses the HTTP-date in the named request header. Invalid
+// dates are ignored, as required by RFC 7232.
+func parseDateHeader(h http.Header, name string) (time.Time, bool) {
+	v := h.Get(name)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	t.Parallel()
+	modified := time.Date(2017, 3, 4, 5, 56, 10, 0, time.UTC)
+	stored := make(http.Header)
+	stored.Set("ETag", "mHb90hhuT7g=")
+	stored.Set("Last-Modified", modified.Format(time.RFC1123Z))
+
+	before := modified.Add(-time.Hour).Format(http.TimeFormat)
+	at := modified.Format(http.TimeFormat)
+	after := modified.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		Method   string
+		Header   map[string]string
+		Missing  bool
+		Expected int
+	}{
+		{Method: "GET", Expected: 0},
+		{Method: "GET", Header: map[string]string{"If-Match": `"mHb90hhuT7g="`}, Expected: 0},
+		{Method: "GET", Header: map[string]string{"If-Match": "foo, bar"}, Expected: 412},
+		{Method: "PUT", Header: map[string]string{"If-Match": "*"}, Missing: true, Expected: 412},
+		{Method: "PUT", Header: map[string]string{"If-Match": "foo"}, Missing: true, Expected: 412},
+		{Method: "GET", Header: map[string]string{"If-Match": "W/mHb90hhuT7g="}, Expected: 412},
+		{Method: "PUT", Header: map[string]string{"If-Unmodified-Since": before}, Expected: 412},
+		{Method: "PUT", Header: map[string]string{"If-Unmodified-Since": at}, Expected: 0},
+		{Method: "PUT", Header: map[string]string{"If-Unmodified-Since": "garbage"}, Expected: 0},
+		// If-Match takes precedence over If-Unmodified-Since
+		{Method: "PUT", Header: map[string]string{"If-Match": "mHb90hhuT7g=", "If-Unmodified-Since": before}, Expected: 0},
+		{Method: "GET", Header: map[string]string{"If-None-Match": "W/mHb90hhuT7g="}, Expected: 304},
+		{Method: "HEAD", Header: map[string]string{"If-None-Match": "foo, mHb90hhuT7g="}, Expected: 304},
+		{Method: "DELETE", Header: map[string]string{"If-None-Match": "*"}, Expected: 412},
+		{Method: "PUT", Header: map[string]string{"If-None-Match": "*"}, Missing: true, Expected: 0},
+		{Method: "GET", Header: map[string]string{"If-Modified-Since": at}, Expected: 304},
+		{Method: "GET", Header: map[string]string{"If-Modified-Since": after}, Expected: 304},
+		{Method: "GET", Header: map[string]string{"If-Modified-Since": before}, Expected: 0},
+		{Method: "PUT", Header: map[string]string{"If-Modified-Since": after}, Expected: 0},
+		// If-None-Match takes precedence over If-Modified-Since
+		{Method: "GET", Header: map[string]string{"If-None-Match": "foo", "If-Modified-Since": after}, Expected: 0},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest(test.Method, "/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.Header {
+			req.Header.Set(k, v)
+		}
+		header := stored
+		if test.Missing {
+			header = nil
+		}
+		if got, want := checkPreconditions(header, req), test.Expected; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	req, err := http.NewRequest("PUT", s.URL+"/foo", strings.NewReader("foobarbaz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eTag := resp.Header.Get("ETag")
+	lm, err := time.Parse(time.RFC1123Z, resp.Header.Get("Last-Modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create-only PUTs fail once the value exists.
+	req, err = http.NewRequest("PUT", s.URL+"/foo", strings.NewReader("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", "*")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusPreconditionFailed; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	tests := []struct {
+		Method       string
+		Header       map[string]string
+		ExpectedCode int
+		Expected     string
+	}{
+		{
+			Method:       "GET",
+			Header:       map[string]string{"If-Modified-Since": lm.Format(http.TimeFormat)},
+			ExpectedCode: http.StatusNotModified,
+		},
+		{
+			Method:       "HEAD",
+			Header:       map[string]string{"If-Modified-Since": lm.Format(http.TimeFormat)},
+			ExpectedCode: http.StatusNotModified,
+		},
+		{
+			Method:       "GET",
+			Header:       map[string]string{"If-Modified-Since": lm.Add(-time.Minute).Format(http.TimeFormat)},
+			ExpectedCode: http.StatusOK,
+			Expected:     "foobarbaz",
+		},
+		{
+			Method:       "GET",
+			Header:       map[string]string{"If-Unmodified-Since": lm.Add(-time.Minute).Format(http.TimeFormat)},
+			ExpectedCode: http.StatusPreconditionFailed,
+			Expected:     "Precondition failed.\n",
+		},
+		{
+			Method:       "GET",
+			Header:       map[string]string{"Range": "bytes=0-2", "If-Range": eTag},
+			ExpectedCode: http.StatusPartialContent,
+			Expected:     "foo",
+		},
+		{
+			Method:       "GET",
+			Header:       map[string]string{"Range": "bytes=0-2", "If-Range": lm.Format(http.TimeFormat)},
+			ExpectedCode: http.StatusPartialContent,
+			Expected:     "foo",
+		},
+		{
+			Method:       "GET",
+			Header:       map[string]string{"Range": "bytes=0-2", "If-Range": `"stale"`},
+			ExpectedCode: http.StatusOK,
+			Expected:     "foobarbaz",
+		},
+		{
+			Method:       "GET",
+			Header:       map[string]string{"Range": "bytes=0-2", "If-Range": lm.Add(-time.Minute).Format(http.TimeFormat)},
+			ExpectedCode: http.StatusOK,
+			Expected:     "foobarbaz",
+		},
+		{
+			Method:       "DELETE",
+			Header:       map[string]string{"If-Unmodified-Since": lm.Add(-time.Minute).Format(http.TimeFormat)},
+			ExpectedCode: http.StatusPreconditionFailed,
+			Expected:     "Precondition failed.\n",
+		},
+		{
+			Method:       "DELETE",
+			Header:       map[string]string{"If-Unmodified-Since": lm.Format(http.TimeFormat)},
+			ExpectedCode: http.StatusNoContent,
+		},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest(test.Method, s.URL+"/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.Header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), test.Expected; got != want {
+			t.Errorf("test %d: bad body: got %q, want %q", i, got, want)
+		}
+	}
+}
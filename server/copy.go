@@ -0,0 +1,180 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/boltdb/bolt"
+)
+
+// isCopyRequest reports whether req copies or moves the value or bucket at
+// its path, and if so, whether it moves it. Besides the WebDAV COPY and MOVE
+// methods, a POST with a "copy" or "move" query parameter naming the
+// destination does the same.
+func isCopyRequest(req *http.Request) (move, ok bool) {
+	switch req.Method {
+	case "COPY":
+		return false, true
+	case "MOVE":
+		return true, true
+	case "POST":
+		query := req.URL.Query()
+		if _, ok := query["move"]; ok {
+			return true, true
+		}
+		_, ok := query["copy"]
+		return false, ok
+	}
+	return false, false
+}
+
+// destination returns the path that req copies or moves to, named by its
+// Destination header, or by its query for a POST. It returns 0 and the path,
+// or the status to fail the request with.
+func destination(req *http.Request) (string, int) {
+	v := req.Header.Get("Destination")
+	if req.Method == "POST" {
+		if move, _ := isCopyRequest(req); move {
+			v = req.URL.Query().Get("move")
+		} else {
+			v = req.URL.Query().Get("copy")
+		}
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Path == "" {
+		return "", http.StatusBadRequest
+	}
+	if u.Host != "" && u.Host != req.Host {
+		return "", http.StatusBadGateway
+	}
+	return cleanPath(u.EscapedPath()), 0
+}
+
+// copyOrMove copies or moves a value or bucket, along with the headers of
+// the values and their dead properties. Everything happens in a single
+// transaction, so the destination is never seen half written, and a move
+// never leaves both or neither of the source and destination behind.
+func (s server) copyOrMove(w http.ResponseWriter, req *http.Request) {
+	move, _ := isCopyRequest(req)
+	src := cleanPath(req.URL.EscapedPath())
+	dst, code := destination(req)
+	if code != 0 {
+		http.Error(w, http.StatusText(code)+".", code)
+		return
+	}
+	var shallow bool
+	switch req.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		shallow = true
+	default:
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	if move && shallow {
+		// A MOVE always takes everything beneath the source with it.
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	overwrite := true
+	switch req.Header.Get("Overwrite") {
+	case "", "T":
+	case "F":
+		overwrite = false
+	default:
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	if src == "/" || dst == "/" || dst == src || isWithin(dst, src) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var created bool
+	err := s.update(req, func(tx *bolt.Tx) error {
+		r, err := findResource(tx, src)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		if checkPreconditions(r.Header, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		parts := splitPath(dst)
+		if getBoltBucket(tx, parts[:len(parts)-1]) == nil {
+			msg, status = "Conflict.", http.StatusConflict
+			return errBadRequest
+		}
+		d, err := findResource(tx, dst)
+		if err != nil {
+			return err
+		}
+		if d != nil && !overwrite {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		if d != nil {
+			if err := deleteResource(tx, d); err != nil {
+				return err
+			}
+		}
+		created = d == nil
+		if r.Collection {
+			err = copyTree(tx, src, dst, shallow, move)
+		} else {
+			err = copyValue(tx, src, dst, move)
+		}
+		if err != nil {
+			return err
+		}
+		if err := copyProperties(tx, src, dst, shallow, move); err != nil {
+			return err
+		}
+		if move {
+			return deleteLocks(tx, src)
+		}
+		return nil
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	if created {
+		w.Header().Set("Location", dst)
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteResource deletes r, along with everything beneath it and any locks
+// on it.
+func deleteResource(tx *bolt.Tx, r *davResource) error {
+	var err error
+	if r.Collection {
+		err = deleteTree(tx, r.Path)
+	} else {
+		err = deleteValue(tx, r.Path, r.Header)
+	}
+	if err != nil {
+		return err
+	}
+	return deleteLocks(tx, r.Path)
+}
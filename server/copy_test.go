@@ -0,0 +1,87 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCopyMoveAction(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("PUT", "/conf/app/settings", `{"debug":true}`, map[string]string{"Content-Type": "application/json"})
+	eTag := resp.Header.Get("ETag")
+	do("PUT", "/conf/app/empty", "", nil)
+
+	tests := []struct {
+		Method, Path string
+		Header       map[string]string
+		ExpectedCode int
+	}{
+		{Method: "POST", Path: "/conf/app/settings?copy=/conf/app/backup", ExpectedCode: http.StatusCreated},
+		{Method: "POST", Path: "/conf/app/settings?copy=/conf/app/backup", Header: map[string]string{"Overwrite": "F"}, ExpectedCode: http.StatusPreconditionFailed},
+		{Method: "POST", Path: "/conf/app/settings?copy=/conf/app/backup", Header: map[string]string{"If-Match": "nope"}, ExpectedCode: http.StatusPreconditionFailed},
+		{Method: "POST", Path: "/conf/app/settings?copy=/conf/app/backup", Header: map[string]string{"If-Match": eTag}, ExpectedCode: http.StatusNoContent},
+		{Method: "POST", Path: "/conf/nope?copy=/conf/other", ExpectedCode: http.StatusNotFound},
+		{Method: "POST", Path: "/conf/app/settings?copy=/missing/settings", ExpectedCode: http.StatusConflict},
+		{Method: "POST", Path: "/conf/app/settings?copy=", ExpectedCode: http.StatusBadRequest},
+		{Method: "POST", Path: "/conf?move=/conf/app/conf", ExpectedCode: http.StatusForbidden},
+		{Method: "POST", Path: "/conf?move=/renamed", ExpectedCode: http.StatusCreated},
+		{Method: "MOVE", Path: "/renamed/app/backup", Header: map[string]string{"Destination": "/renamed/app/settings", "Overwrite": "F"}, ExpectedCode: http.StatusPreconditionFailed},
+		{Method: "MOVE", Path: "/renamed/app/backup", Header: map[string]string{"Destination": "/renamed/app/settings"}, ExpectedCode: http.StatusNoContent},
+	}
+	for i, test := range tests {
+		resp := do(test.Method, test.Path, "", test.Header)
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+	}
+
+	for path, want := range map[string]int{
+		"/conf":                 http.StatusNotFound,
+		"/renamed/app/backup":   http.StatusNotFound,
+		"/renamed/app/empty":    http.StatusOK,
+		"/renamed/app/settings": http.StatusOK,
+	} {
+		if got := do("GET", path, "", nil).StatusCode; got != want {
+			t.Errorf("%s: bad status: got %d, want %d", path, got, want)
+		}
+	}
+
+	resp = do("GET", "/renamed/app/settings", "", nil)
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("ETag"), eTag; got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"debug":true}`; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// counterContentType is the Content-Type of counters created by a POST.
+const counterContentType = "text/plain; charset=utf-8"
+
+// errNotCounter is returned when a counter operation meets a value that
+// isn't a decimal integer.
+var errNotCounter = errors.New("not a counter")
+
+// counterStep returns how much a POST with the given query changes a counter
+// by: 1 for "incr", -1 for "decr", or the amount given as their value. ok is
+// false if the query doesn't ask for either.
+func counterStep(query url.Values) (step int64, ok bool, err error) {
+	for _, q := range []struct {
+		name string
+		sign int64
+	}{{"incr", 1}, {"decr", -1}} {
+		v, ok := query[q.name]
+		if !ok {
+			continue
+		}
+		if v[0] == "" {
+			return q.sign, true, nil
+		}
+		n, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil || n == math.MinInt64 {
+			return 0, true, errBadRequest
+		}
+		return q.sign * n, true, nil
+	}
+	return 0, false, nil
+}
+
+// count atomically adds step to the counter at the request path, and writes
+// its new value. The counter is a value holding a decimal integer; one that
+// doesn't exist yet starts at zero.
+func (s server) count(w http.ResponseWriter, req *http.Request, step int64) {
+	path := cleanPath(req.URL.EscapedPath())
+	parts := splitPath(path)
+	if len(parts) == 1 {
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	ttl, err := parseTTL(req.Header)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var (
+		header http.Header
+		n      int64
+	)
+	err = s.update(req, func(tx *bolt.Tx) error {
+		r, err := findResource(tx, path)
+		if err != nil {
+			return err
+		}
+		if r != nil && r.Collection {
+			msg, status = "Not a counter.", http.StatusConflict
+			return errNotCounter
+		}
+		var oldHeader http.Header
+		if r != nil {
+			oldHeader = r.Header
+		}
+		if checkPreconditions(oldHeader, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		metadata := http.Header{"Content-Type": {counterContentType}}
+		var old int64
+		if r != nil {
+			if old, err = counterValue(tx, path, oldHeader); err == errNotCounter {
+				msg, status = "Not a counter.", http.StatusConflict
+				return err
+			} else if err != nil {
+				return err
+			}
+			metadata = s.extractHeader(oldHeader)
+		}
+		n = old + step
+		if (step > 0 && n < old) || (step < 0 && n > old) {
+			msg, status = "Counter overflow.", http.StatusConflict
+			return errNotCounter
+		}
+		header, err = s.rewriteValue(tx, path, []byte(strconv.FormatInt(n, 10)), metadata, ttl, oldHeader)
+		if err == bolt.ErrIncompatibleValue {
+			msg, status = "Conflict.", http.StatusConflict
+		}
+		return err
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("ETag", header.Get("ETag"))
+	w.Header().Set("Last-Modified", header.Get("Last-Modified"))
+	writePublicHeaders(header, w)
+	w.Header().Set("Content-Type", counterContentType)
+	fmt.Fprint(w, n)
+}
+
+// counterValue returns the integer stored at path, or errNotCounter if the
+// value isn't one.
+func counterValue(tx *bolt.Tx, path string, header http.Header) (int64, error) {
+	if m, err := getManifest(header); err != nil || m != nil {
+		return 0, errNotCounter
+	}
+	parts := splitPath(path)
+	value := getBoltBucket(tx, parts[:len(parts)-1]).Get(parts[len(parts)-1])
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, errNotCounter
+	}
+	return n, nil
+}
+
+// sequenceKey returns the key for a bucket's nth sequence number. Keys are
+// zero padded, so that they sort in the order they were allocated.
+func sequenceKey(n uint64) string {
+	return fmt.Sprintf("%020d", n)
+}
+
+// postSequence stores the request body in the bucket at the request path,
+// under a key allocated from the bucket's sequence, and reports the new
+// value's path in the Location header.
+func (s server) postSequence(w http.ResponseWriter, req *http.Request) {
+	path := cleanPath(req.URL.EscapedPath())
+	if path == "/" {
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	hasher, err := s.newBodyHasher(req.Header)
+	var ttl time.Duration
+	if err == nil {
+		ttl, err = parseTTL(req.Header)
+	}
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	body, err := readBody(req, s.maxValueSize())
+	if err == errTooLarge {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	hasher.Write(body)
+	if !hasher.verify() {
+		http.Error(w, "Digest mismatch.", http.StatusBadRequest)
+		return
+	}
+	header := hasher.valueHeader(s.extractHeader(req.Header), int64(len(body)))
+	setExpiry(header, ttl)
+
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var key string
+	err = s.update(req, func(tx *bolt.Tx) error {
+		bucket := getBoltBucket(tx, splitPath(path))
+		if bucket == nil {
+			r, err := findResource(tx, path)
+			if err != nil {
+				return err
+			}
+			if r != nil {
+				w.Header().Set("Allow", allowedMethods)
+				msg, status = "Method not allowed.", http.StatusMethodNotAllowed
+			} else {
+				msg, status = "Not found.", http.StatusNotFound
+			}
+			return errNotFound
+		}
+		// Keys that were PUT by hand are skipped rather than overwritten.
+		for {
+			n, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			key = sequenceKey(n)
+			if k, _ := bucket.Cursor().Seek([]byte(key)); string(k) != key {
+				break
+			}
+		}
+		value := body
+		if int64(len(value)) > s.largeObjectSize() {
+			m, err := s.putChunks(tx, value)
+			if err != nil {
+				return err
+			}
+			manifestJSON, _ := json.Marshal(m)
+			header.Set(manifestHeader, string(manifestJSON))
+			value = []byte(m.ID)
+		}
+		key = joinPath(path, key)
+		return putValue(tx, key, value, header, nil)
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	writePutResponse(w, key, header, true)
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	// Concurrent increments are never lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do("POST", "/stats/hits?incr", "", nil)
+		}()
+	}
+	wg.Wait()
+	if _, body := do("GET", "/stats/hits", "", nil); body != "20" {
+		t.Errorf("bad counter: got %q, want %q", body, "20")
+	}
+
+	do("PUT", "/stats/name", "not a number", nil)
+	do("PUT", "/stats/max", "9223372036854775807", nil)
+	resp, _ := do("GET", "/stats/hits", "", nil)
+	eTag := resp.Header.Get("ETag")
+
+	tests := []struct {
+		Path         string
+		Header       map[string]string
+		ExpectedCode int
+		Expected     string
+	}{
+		{Path: "/stats/hits?incr=5", ExpectedCode: http.StatusOK, Expected: "25"},
+		{Path: "/stats/hits?decr", ExpectedCode: http.StatusOK, Expected: "24"},
+		{Path: "/stats/hits?decr=30", ExpectedCode: http.StatusOK, Expected: "-6"},
+		{Path: "/stats/hits?incr", Header: map[string]string{"If-Match": eTag}, ExpectedCode: http.StatusPreconditionFailed},
+		{Path: "/stats/hits?incr=lots", ExpectedCode: http.StatusBadRequest},
+		{Path: "/stats/new?decr=2", ExpectedCode: http.StatusOK, Expected: "-2"},
+		{Path: "/stats/name?incr", ExpectedCode: http.StatusConflict},
+		{Path: "/stats/max?incr", ExpectedCode: http.StatusConflict},
+		{Path: "/stats?incr", ExpectedCode: http.StatusConflict},
+	}
+	for i, test := range tests {
+		resp, body := do("POST", test.Path, "", test.Header)
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+			continue
+		}
+		if test.ExpectedCode == http.StatusOK && body != test.Expected {
+			t.Errorf("test %d: bad body: got %q, want %q", i, body, test.Expected)
+		}
+	}
+	resp, _ = do("GET", "/stats/new", "", nil)
+	if got, want := resp.Header.Get("Content-Type"), counterContentType; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+
+	// A counter keeps its TTL when it is incremented without one.
+	resp, _ = do("POST", "/stats/window?incr", "", map[string]string{"TTL": "3600"})
+	expires := resp.Header.Get("Expires-At")
+	if expires == "" {
+		t.Fatal("missing Expires-At")
+	}
+	resp, body := do("POST", "/stats/window?incr", "", nil)
+	if got, want := resp.Header.Get("Expires-At"), expires; got != want {
+		t.Errorf("bad Expires-At: got %q, want %q", got, want)
+	}
+	if got, want := body, "2"; got != want {
+		t.Errorf("bad counter: got %q, want %q", got, want)
+	}
+	if resp, _ := do("GET", "/stats/window", "", nil); resp.Header.Get("Expires-At") != expires {
+		t.Errorf("bad Expires-At: got %q, want %q", resp.Header.Get("Expires-At"), expires)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	post := func(path, body string) *http.Response {
+		req, err := http.NewRequest("POST", s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	req, err := http.NewRequest("PUT", s.URL+"/queue/"+sequenceKey(2), strings.NewReader("by hand"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	var locations []string
+	for _, body := range []string{"first", "second"} {
+		resp := post("/queue", body)
+		if got, want := resp.StatusCode, http.StatusCreated; got != want {
+			t.Fatalf("bad status: got %d, want %d", got, want)
+		}
+		locations = append(locations, resp.Header.Get("Location"))
+	}
+	for i, want := range []string{"/queue/" + sequenceKey(1), "/queue/" + sequenceKey(3)} {
+		if got := locations[i]; got != want {
+			t.Errorf("bad Location: got %q, want %q", got, want)
+		}
+	}
+	resp, err := http.Get(s.URL + locations[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "second"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/plain"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+
+	if got, want := post("/nope", "x").StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := post(locations[0], "x").StatusCode, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// etagHashes are the hashes that ETags can be computed with.
+var etagHashes = map[string]func() hash.Hash{
+	"fnv":    func() hash.Hash { return fnv.New64a() },
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// digestHashes are the digest algorithms that clients can send with a body,
+// keyed by their lower-case names in the HTTP Hash Algorithm registry.
+var digestHashes = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+func (s server) newETagHash() hash.Hash {
+	if f, ok := etagHashes[s.cfg.Storage.ETagAlgorithm]; ok {
+		return f()
+	}
+	return fnv.New64a()
+}
+
+// bodyHasher computes the ETag and digest of a value's content as it is
+// written, and checks the content against the digests sent by the client.
+type bodyHasher struct {
+	etag   hash.Hash
+	sha256 hash.Hash
+	want   map[string][]byte
+	got    map[string]hash.Hash
+}
+
+// newBodyHasher returns a bodyHasher that checks the digests found in the
+// Content-MD5, Digest and Repr-Digest fields of h. Digests using unknown
+// algorithms are ignored, and malformed ones are an error.
+func (s server) newBodyHasher(h http.Header) (*bodyHasher, error) {
+	b := &bodyHasher{
+		etag:   s.newETagHash(),
+		sha256: sha256.New(),
+		want:   make(map[string][]byte),
+		got:    make(map[string]hash.Hash),
+	}
+	if v := h.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("bad Content-MD5: %s", err)
+		}
+		if err := b.expect("md5", sum); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range h["Digest"] {
+		for _, d := range strings.Split(v, ",") {
+			eq := strings.IndexByte(d, '=')
+			if eq < 0 {
+				return nil, fmt.Errorf("bad Digest: %q", d)
+			}
+			if !knownDigest(d[:eq]) {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(d[eq+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("bad Digest: %s", err)
+			}
+			if err := b.expect(d[:eq], sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, v := range h["Repr-Digest"] {
+		for _, d := range strings.Split(v, ",") {
+			if semi := strings.IndexByte(d, ';'); semi >= 0 {
+				d = d[:semi]
+			}
+			eq := strings.IndexByte(d, '=')
+			if eq < 0 {
+				return nil, fmt.Errorf("bad Repr-Digest: %q", d)
+			}
+			if !knownDigest(d[:eq]) {
+				continue
+			}
+			value := strings.TrimSpace(d[eq+1:])
+			if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return nil, fmt.Errorf("bad Repr-Digest: %q", d)
+			}
+			sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+			if err != nil {
+				return nil, fmt.Errorf("bad Repr-Digest: %s", err)
+			}
+			if err := b.expect(d[:eq], sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func knownDigest(algorithm string) bool {
+	_, ok := digestHashes[strings.ToLower(strings.TrimSpace(algorithm))]
+	return ok
+}
+
+func (b *bodyHasher) expect(algorithm string, sum []byte) error {
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	newHash := digestHashes[algorithm]
+	if want, ok := b.want[algorithm]; ok && !bytes.Equal(want, sum) {
+		return fmt.Errorf("conflicting %s digests", algorithm)
+	}
+	b.want[algorithm] = sum
+	if _, ok := b.got[algorithm]; !ok {
+		b.got[algorithm] = newHash()
+	}
+	return nil
+}
+
+func (b *bodyHasher) Write(p []byte) (int, error) {
+	b.etag.Write(p)
+	b.sha256.Write(p)
+	for _, h := range b.got {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify reports whether the content written matches every digest that the
+// client sent.
+func (b *bodyHasher) verify() bool {
+	for algorithm, h := range b.got {
+		if !bytes.Equal(h.Sum(nil), b.want[algorithm]) {
+			return false
+		}
+	}
+	return true
+}
+
+// valueHeader returns the header to store for the content written to b,
+// including its ETag and digest.
+func (b *bodyHasher) valueHeader(metadata http.Header, size int64) http.Header {
+	header := newValueHeader(metadata, size, etagOf(b.etag))
+	sum := base64.StdEncoding.EncodeToString(b.sha256.Sum(nil))
+	header.Set("Digest", "SHA-256="+sum)
+	header.Set("Repr-Digest", "sha-256=:"+sum+":")
+	return header
+}
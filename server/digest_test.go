@@ -0,0 +1,126 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestDigestVerification(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	body := "foobarbaz"
+	md5Sum := md5.Sum([]byte(body))
+	sha256Sum := sha256.Sum256([]byte(body))
+	goodMD5 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	goodSHA256 := base64.StdEncoding.EncodeToString(sha256Sum[:])
+	bad := base64.StdEncoding.EncodeToString([]byte("nope"))
+
+	tests := []struct {
+		Header       map[string]string
+		ExpectedCode int
+	}{
+		{Header: map[string]string{"Content-MD5": goodMD5}, ExpectedCode: http.StatusCreated},
+		{Header: map[string]string{"Content-MD5": bad}, ExpectedCode: http.StatusBadRequest},
+		{Header: map[string]string{"Content-MD5": "%%%"}, ExpectedCode: http.StatusBadRequest},
+		{Header: map[string]string{"Digest": "SHA-256=" + goodSHA256 + ",MD5=" + goodMD5}, ExpectedCode: http.StatusNoContent},
+		{Header: map[string]string{"Digest": "SHA-256=" + bad}, ExpectedCode: http.StatusBadRequest},
+		{Header: map[string]string{"Digest": "UNIXsum=30637"}, ExpectedCode: http.StatusNoContent},
+		{Header: map[string]string{"Repr-Digest": "sha-256=:" + goodSHA256 + ":"}, ExpectedCode: http.StatusNoContent},
+		{Header: map[string]string{"Repr-Digest": "sha-512=:" + bad + ":"}, ExpectedCode: http.StatusBadRequest},
+		{Header: map[string]string{"Repr-Digest": "sha-256=" + goodSHA256}, ExpectedCode: http.StatusBadRequest},
+		{Header: map[string]string{"Content-MD5": goodMD5, "Repr-Digest": "md5=:" + bad + ":"}, ExpectedCode: http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("PUT", s.URL+"/foo", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.Header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err := http.NewRequest(method, s.URL+"/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.Header.Get("Repr-Digest"), "sha-256=:"+goodSHA256+":"; got != want {
+			t.Errorf("%s: bad Repr-Digest: got %q, want %q", method, got, want)
+		}
+		if got, want := resp.Header.Get("Digest"), "SHA-256="+goodSHA256; got != want {
+			t.Errorf("%s: bad Digest: got %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestETagAlgorithm(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	client := &http.Client{}
+
+	// Store a value with the default algorithm.
+	s := httptest.NewServer(server{db: db})
+	req, err := http.NewRequest("PUT", s.URL+"/foo", strings.NewReader("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	oldETag := resp.Header.Get("ETag")
+	if got, want := oldETag, etag([]byte("foobar")); got != want {
+		t.Fatalf("bad ETag: got %q, want %q", got, want)
+	}
+
+	s = httptest.NewServer(server{
+		db:  db,
+		cfg: config.Data{Storage: config.Storage{ETagAlgorithm: "sha256"}},
+	})
+	defer s.Close()
+
+	// The stored ETag still works in preconditions.
+	req, err = http.NewRequest("PUT", s.URL+"/foo", strings.NewReader("foobarbaz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Match", oldETag)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	sum := sha256.Sum256([]byte("foobarbaz"))
+	if got, want := resp.Header.Get("ETag"), base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+}
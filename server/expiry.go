@@ -0,0 +1,164 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// expiresHeader is the header field holding the time that a value with a
+	// TTL expires. It is sent to clients as Expires-At.
+	expiresHeader = internalHeaderPrefix + "Expires"
+
+	// sweepBatchSize is the most expired values that the sweeper deletes in
+	// a single transaction.
+	sweepBatchSize = 100
+)
+
+// expiryBucket indexes the values that have a TTL. Its keys are the time the
+// value expires, as big-endian Unix seconds, followed by the value's path.
+var expiryBucket = append([]byte{0}, []byte("expiry")...)
+
+func createExpiryBucketIfNotExists(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(expiryBucket)
+		return err
+	})
+}
+
+// parseTTL returns the time to live requested by the TTL field of h, or zero
+// if there isn't one. The TTL is given in seconds, or as a duration such as
+// "90m".
+func parseTTL(h http.Header) (time.Duration, error) {
+	v := h.Get("TTL")
+	if v == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if n, nerr := strconv.ParseInt(v, 10, 64); nerr == nil {
+		ttl, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("bad TTL: %q", v)
+	}
+	return ttl, nil
+}
+
+// setExpiry makes the value with the given header expire after ttl. A zero
+// ttl means that the value never expires.
+func setExpiry(header http.Header, ttl time.Duration) {
+	if ttl > 0 {
+		header.Set(expiresHeader, time.Now().Add(ttl).UTC().Format(time.RFC1123Z))
+	}
+}
+
+// expiresAt returns the time that the value with the given header expires,
+// or false if it has no TTL.
+func expiresAt(header http.Header) (time.Time, bool) {
+	t, err := time.Parse(time.RFC1123Z, header.Get(expiresHeader))
+	return t, err == nil
+}
+
+// expired reports whether the value with the given header expired before
+// now.
+func expired(header http.Header, now time.Time) bool {
+	t, ok := expiresAt(header)
+	return ok && !now.Before(t)
+}
+
+func expiryKey(t time.Time, path string) []byte {
+	key := make([]byte, 8+len(path))
+	binary.BigEndian.PutUint64(key, uint64(t.Unix()))
+	copy(key[8:], path)
+	return key
+}
+
+// indexExpiry adds the value at path to the expiry index, if it has a TTL.
+func indexExpiry(tx *bolt.Tx, path string, header http.Header) error {
+	if t, ok := expiresAt(header); ok {
+		return tx.Bucket(expiryBucket).Put(expiryKey(t, path), []byte{})
+	}
+	return nil
+}
+
+// unindexExpiry removes the value at path from the expiry index.
+func unindexExpiry(tx *bolt.Tx, path string, header http.Header) error {
+	if t, ok := expiresAt(header); ok {
+		return tx.Bucket(expiryBucket).Delete(expiryKey(t, path))
+	}
+	return nil
+}
+
+// getLiveHeader is like getHeaderValue, except that a value that has expired
+// is treated as though it doesn't exist. Writable transactions delete it.
+func getLiveHeader(tx *bolt.Tx, path string) (http.Header, error) {
+	header, err := getHeaderValue(tx, path)
+	if err != nil || !expired(header, time.Now()) {
+		return header, err
+	}
+	if tx.Writable() {
+		if err := deleteValue(tx, path, header); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// sweepExpired deletes the values that expired before now. Values are
+// deleted a batch at a time, each batch in its own transaction, so that the
+// sweeper never holds the write lock for long.
+func (s server) sweepExpired(now time.Time) error {
+	for {
+		var n int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			index := tx.Bucket(expiryBucket)
+			var keys [][]byte
+			c := index.Cursor()
+			for k, _ := c.First(); k != nil && len(keys) < sweepBatchSize; k, _ = c.Next() {
+				if int64(binary.BigEndian.Uint64(k)) > now.Unix() {
+					break
+				}
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			n = len(keys)
+			for _, k := range keys {
+				path := string(k[8:])
+				header, err := getHeaderValue(tx, path)
+				if err != nil {
+					return err
+				}
+				if header != nil && expired(header, now) {
+					if err := deleteValue(tx, path, header); err != nil {
+						return err
+					}
+				}
+				if err := index.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || n < sweepBatchSize {
+			return err
+		}
+	}
+}
+
+// sweepExpiredEvery calls sweepExpired every interval, forever.
+func (s server) sweepExpiredEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := s.sweepExpired(now); err != nil {
+			log.Printf("couldn't delete expired values: %s", err)
+		}
+	}
+}
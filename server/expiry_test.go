@@ -0,0 +1,127 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestParseTTL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		Value string
+		TTL   time.Duration
+		Error bool
+	}{
+		{Value: "", TTL: 0},
+		{Value: "60", TTL: time.Minute},
+		{Value: "90m", TTL: 90 * time.Minute},
+		{Value: "0", Error: true},
+		{Value: "-5", Error: true},
+		{Value: "soon", Error: true},
+	}
+	for i, test := range tests {
+		h := make(http.Header)
+		if test.Value != "" {
+			h.Set("TTL", test.Value)
+		}
+		ttl, err := parseTTL(h)
+		if test.Error {
+			if err == nil {
+				t.Errorf("test %d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %s", i, err)
+		}
+		if ttl != test.TTL {
+			t.Errorf("test %d: got %s, want %s", i, ttl, test.TTL)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	srv := server{db: db}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url, body, ttl string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != "" {
+			req.Header.Set("TTL", ttl)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if got, want := do("PUT", s.URL+"/reports/bad", "foo", "never").StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp := do("PUT", s.URL+"/reports/a", "foo", "1")
+	if resp.Header.Get("Expires-At") == "" {
+		t.Error("missing Expires-At")
+	}
+	do("PUT", s.URL+"/reports/b", "bar", "1h")
+	do("PUT", s.URL+"/reports/c", "baz", "")
+
+	// Expired values are gone before the sweeper gets to them.
+	time.Sleep(1100 * time.Millisecond)
+	for _, method := range []string{"GET", "HEAD"} {
+		if got, want := do(method, s.URL+"/reports/a", "", "").StatusCode, http.StatusNotFound; got != want {
+			t.Errorf("%s: bad status: got %d, want %d", method, got, want)
+		}
+	}
+	if got, want := do("GET", s.URL+"/reports/b", "", "").StatusCode, http.StatusOK; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	if err := srv.sweepExpired(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := getBoltBucket(tx, splitPath("/reports"))
+		for key, want := range map[string]bool{"a": false, "b": false, "c": true} {
+			if got := bucket.Get([]byte(key)) != nil; got != want {
+				t.Errorf("%s: got present=%v, want %v", key, got, want)
+			}
+		}
+		if n := tx.Bucket(expiryBucket).Stats().KeyN; n != 0 {
+			t.Errorf("expiry index has %d keys left", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value that is overwritten without a TTL no longer expires.
+	do("PUT", s.URL+"/reports/d", "foo", "1")
+	resp = do("PUT", s.URL+"/reports/d", "bar", "")
+	if resp.Header.Get("Expires-At") != "" {
+		t.Error("unexpected Expires-At")
+	}
+	if err := srv.sweepExpired(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := do("GET", s.URL+"/reports/d", "", "").StatusCode, http.StatusOK; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+}
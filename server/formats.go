@@ -0,0 +1,278 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Listing is a page of a bucket listing.
+type Listing struct {
+	// Path is the path of the bucket.
+	Path string
+
+	// Entries are the keys in the page. Unless Detail is set, only their
+	// names are filled in.
+	Entries []Entry
+
+	// Detail is set if the client asked for a detailed listing.
+	Detail bool
+
+	// Next is the URL of the next page of the listing, if there is one.
+	Next string
+}
+
+// ListingFormat is a format that bucket listings can be written in.
+type ListingFormat struct {
+	// MediaType is the media type that clients ask for the format by.
+	MediaType string
+
+	// ContentType is the Content-Type of listings in the format. It defaults
+	// to MediaType.
+	ContentType string
+
+	// Encode writes a listing to w.
+	Encode func(w io.Writer, l *Listing) error
+}
+
+// ndjsonFlushLines is how many lines of an NDJSON listing are written between
+// flushes.
+const ndjsonFlushLines = 100
+
+// listingFormats are the formats that bucket listings are available in, in
+// the order the server prefers them.
+var listingFormats = struct {
+	sync.RWMutex
+	formats []ListingFormat
+}{
+	formats: []ListingFormat{
+		{MediaType: "text/plain", ContentType: "text/plain; charset=utf-8", Encode: encodeText},
+		{MediaType: "application/json", ContentType: "application/json; charset=utf-8", Encode: encodeJSON},
+		{MediaType: "application/xml", ContentType: "application/xml; charset=utf-8", Encode: encodeXML},
+		{MediaType: "text/html", ContentType: "text/html; charset=utf-8", Encode: encodeHTML},
+		{MediaType: "application/x-ndjson", ContentType: "application/x-ndjson", Encode: encodeNDJSON},
+		{MediaType: "text/csv", ContentType: "text/csv; charset=utf-8", Encode: encodeCSV},
+		{MediaType: "application/msgpack", ContentType: "application/msgpack", Encode: encodeMsgpack},
+	},
+}
+
+// RegisterListingFormat makes bucket listings available in format f. A
+// format that is already registered for the same media type is replaced;
+// otherwise the new format is the least preferred one.
+func RegisterListingFormat(f ListingFormat) {
+	if f.ContentType == "" {
+		f.ContentType = f.MediaType
+	}
+	listingFormats.Lock()
+	defer listingFormats.Unlock()
+	for i := range listingFormats.formats {
+		if listingFormats.formats[i].MediaType == f.MediaType {
+			listingFormats.formats[i] = f
+			return
+		}
+	}
+	listingFormats.formats = append(listingFormats.formats, f)
+}
+
+// listingTypes returns the media types of the registered listing formats.
+func listingTypes() []string {
+	listingFormats.RLock()
+	defer listingFormats.RUnlock()
+	types := make([]string, len(listingFormats.formats))
+	for i, f := range listingFormats.formats {
+		types[i] = f.MediaType
+	}
+	return types
+}
+
+func listingFormat(mediaType string) ListingFormat {
+	listingFormats.RLock()
+	defer listingFormats.RUnlock()
+	for _, f := range listingFormats.formats {
+		if f.MediaType == mediaType {
+			return f
+		}
+	}
+	panic("unknown listing format " + mediaType)
+}
+
+// writeListing writes a page of a bucket listing, in the format negotiated
+// with the client. If there are more keys to come, the URL of the next page
+// is given in a Link header, and in the body where the format allows.
+func writeListing(w http.ResponseWriter, req *http.Request, l *Listing) {
+	w.Header().Add("Vary", "Accept")
+	types := listingTypes()
+	mediaType := negotiate(req, types)
+	if mediaType == "" {
+		writeNotAcceptable(w, types)
+		return
+	}
+	f := listingFormat(mediaType)
+	if l.Next != "" {
+		w.Header().Set("Link", "<"+l.Next+`>; rel="next"`)
+	}
+	w.Header().Set("Content-Type", f.ContentType)
+	if err := f.Encode(w, l); err != nil {
+		log.Println(err)
+	}
+}
+
+// names returns the names of the entries in l.
+func (l *Listing) names() []string {
+	names := make([]string, len(l.Entries))
+	for i, e := range l.Entries {
+		names[i] = e.Name
+	}
+	return names
+}
+
+// encodeText writes a key per line. Detailed listings have tab-separated
+// fields.
+func encodeText(w io.Writer, l *Listing) error {
+	for _, e := range l.Entries {
+		var err error
+		if l.Detail {
+			_, err = fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", e.Name, e.Kind, e.Size, e.ContentType, e.ETag, e.LastModified)
+		} else {
+			_, err = fmt.Fprintln(w, e.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeJSON writes an array of keys, or of entries for detailed listings.
+func encodeJSON(w io.Writer, l *Listing) error {
+	if l.Detail {
+		return json.NewEncoder(w).Encode(l.Entries)
+	}
+	return json.NewEncoder(w).Encode(l.names())
+}
+
+// encodeNDJSON writes a line of JSON per key, so that clients can process
+// listings as they arrive. The response is flushed every ndjsonFlushLines
+// lines.
+func encodeNDJSON(w io.Writer, l *Listing) error {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for i, e := range l.Entries {
+		var v interface{} = e.Name
+		if l.Detail {
+			v = e
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if flusher != nil && (i+1)%ndjsonFlushLines == 0 {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+func encodeXML(w io.Writer, l *Listing) error {
+	type bucket struct {
+		XMLName xml.Name `xml:"bucket"`
+		Keys    []string `xml:"key"`
+		Entries []Entry
+		Next    string `xml:"next,omitempty"`
+	}
+
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	b := bucket{Next: l.Next}
+	if l.Detail {
+		b.Entries = l.Entries
+	} else {
+		b.Keys = l.names()
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(b)
+}
+
+func encodeHTML(w io.Writer, l *Listing) error {
+	if l.Detail {
+		return entriesTmpl.Execute(w, &EntryPkg{Path: l.Path, Entries: l.Entries, Next: l.Next})
+	}
+	return keysTmpl.Execute(w, &KeyPkg{Path: l.Path, Keys: l.names(), Next: l.Next})
+}
+
+// encodeCSV writes a header row followed by a row per key. Buckets have no
+// size.
+func encodeCSV(w io.Writer, l *Listing) error {
+	cw := csv.NewWriter(w)
+	if l.Detail {
+		cw.Write([]string{"name", "kind", "size", "content_type", "etag", "last_modified"})
+	} else {
+		cw.Write([]string{"name"})
+	}
+	for _, e := range l.Entries {
+		if l.Detail {
+			var size string
+			if e.Kind != "bucket" {
+				size = strconv.FormatInt(e.Size, 10)
+			}
+			cw.Write([]string{e.Name, e.Kind, size, e.ContentType, e.ETag, e.LastModified})
+		} else {
+			cw.Write([]string{e.Name})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// encodeMsgpack writes an array of keys, or of maps describing entries for
+// detailed listings, with the same fields as JSON listings.
+func encodeMsgpack(w io.Writer, l *Listing) error {
+	b := appendMsgpackArray(nil, len(l.Entries))
+	for _, e := range l.Entries {
+		if !l.Detail {
+			b = appendMsgpackString(b, e.Name)
+			continue
+		}
+		fields := [][2]string{
+			{"name", e.Name},
+			{"kind", e.Kind},
+			{"content_type", e.ContentType},
+			{"etag", e.ETag},
+			{"last_modified", e.LastModified},
+		}
+		n := 2
+		for _, f := range fields[2:] {
+			if f[1] != "" {
+				n++
+			}
+		}
+		if e.Size > 0 {
+			n++
+		}
+		b = appendMsgpackMap(b, n)
+		for _, f := range fields[:2] {
+			b = appendMsgpackString(appendMsgpackString(b, f[0]), f[1])
+		}
+		if e.Size > 0 {
+			b = appendMsgpackInt(appendMsgpackString(b, "size"), e.Size)
+		}
+		for _, f := range fields[2:] {
+			if f[1] != "" {
+				b = appendMsgpackString(appendMsgpackString(b, f[0]), f[1])
+			}
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
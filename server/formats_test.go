@@ -0,0 +1,122 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListingFormats(t *testing.T) {
+	RegisterListingFormat(ListingFormat{
+		MediaType: "application/x-test-listing",
+		Encode: func(w io.Writer, l *Listing) error {
+			_, err := fmt.Fprintf(w, "%s: %d keys", l.Path, len(l.Entries))
+			return err
+		},
+	})
+
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url, body, accept string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	do("PUT", s.URL+"/foo", "foobar", "")
+	do("PUT", s.URL+"/bar,baz", "", "")
+
+	tests := []struct {
+		Path, Accept string
+		ContentType  string
+		Expected     string
+	}{
+		{
+			Path:        "/",
+			Accept:      "application/x-ndjson",
+			ContentType: "application/x-ndjson",
+			Expected:    "\"bar,baz\"\n\"foo\"\n",
+		},
+		{
+			Path:        "/",
+			Accept:      "text/csv",
+			ContentType: "text/csv; charset=utf-8",
+			Expected:    "name\n\"bar,baz\"\nfoo\n",
+		},
+		{
+			Path:        "/?prefix=bar&detail",
+			Accept:      "text/csv",
+			ContentType: "text/csv; charset=utf-8",
+			Expected:    "name,kind,size,content_type,etag,last_modified\n\"bar,baz\",bucket,,,,\n",
+		},
+		{
+			Path:        "/",
+			Accept:      "application/msgpack",
+			ContentType: "application/msgpack",
+			Expected:    "\x92\xa7bar,baz\xa3foo",
+		},
+		{
+			Path:        "/?prefix=bar&detail",
+			Accept:      "application/msgpack",
+			ContentType: "application/msgpack",
+			Expected:    "\x91\x82\xa4name\xa7bar,baz\xa4kind\xa6bucket",
+		},
+		{
+			Path:        "/",
+			Accept:      "application/x-test-listing",
+			ContentType: "application/x-test-listing",
+			Expected:    "/: 2 keys",
+		},
+	}
+	for i, test := range tests {
+		resp := do("GET", s.URL+test.Path, "", test.Accept)
+		if got, want := resp.Header.Get("Content-Type"), test.ContentType; got != want {
+			t.Errorf("test %d: bad Content-Type: got %q, want %q", i, got, want)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), test.Expected; got != want {
+			t.Errorf("test %d: bad body: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		Encoded  []byte
+		Expected []byte
+	}{
+		{appendMsgpackString(nil, ""), []byte{0xa0}},
+		{appendMsgpackString(nil, strings.Repeat("a", 32))[:2], []byte{0xd9, 32}},
+		{appendMsgpackString(nil, strings.Repeat("a", 256))[:3], []byte{0xda, 1, 0}},
+		{appendMsgpackInt(nil, 5), []byte{5}},
+		{appendMsgpackInt(nil, 300), []byte{0xd3, 0, 0, 0, 0, 0, 0, 1, 44}},
+		{appendMsgpackArray(nil, 15), []byte{0x9f}},
+		{appendMsgpackArray(nil, 16), []byte{0xdc, 0, 16}},
+		{appendMsgpackMap(nil, 1<<16), []byte{0xdf, 0, 1, 0, 0}},
+	}
+	for i, test := range tests {
+		if !bytes.Equal(test.Encoded, test.Expected) {
+			t.Errorf("test %d: got %x, want %x", i, test.Encoded, test.Expected)
+		}
+	}
+}
@@ -8,13 +8,16 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/fnv"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,39 +35,58 @@ func splitPath(path string) [][]byte {
 	return parts
 }
 
-// returns whether or not the ETag matched any of the If-None-Match values
-func checkIfNoneMatch(storedHeader http.Header, req *http.Request) bool {
-	if nm := req.Header["If-None-Match"]; len(nm) > 0 {
-		for _, m := range nm {
-			if m == "*" || m == storedHeader.Get("ETag") {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 func (s server) getBucketOrValue(w http.ResponseWriter, req *http.Request) {
 	var (
-		keys []string
-		err  error
+		keys    []string
+		entries []Entry
+		more    bool
 	)
 
 	parts := splitPath(req.URL.EscapedPath())
+	opts, err := parseListOptions(req.URL.Query(), s.maxListKeys())
+	if err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	recursive, depth, err := parseTreeOptions(req.URL.Query())
+	if err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	_, detail := req.URL.Query()["detail"]
+	list := func(tx *bolt.Tx, bucket *bolt.Bucket) (err error) {
+		if recursive {
+			return writeTree(w, req, tx, bucket, req.URL.EscapedPath(), depth)
+		}
+		opts.Hide = hideExpired(tx, bucket, req.URL.EscapedPath(), time.Now())
+		keys, more, err = listKeys(bucket, opts)
+		if err != nil {
+			return err
+		}
+		if detail {
+			entries, err = describeKeys(tx, bucket, req.URL.EscapedPath(), keys)
+			return err
+		}
+		entries = make([]Entry, len(keys))
+		for i, k := range keys {
+			entries[i].Name = k
+		}
+		return nil
+	}
 
 	err = s.db.View(func(tx *bolt.Tx) error {
-		header, err := getHeaderValue(tx, req.URL.EscapedPath())
+		header, err := getLiveHeader(tx, req.URL.EscapedPath())
 		if err != nil {
 			return fmt.Errorf("couldn't get header: %s", err)
 		}
 
 		if header != nil {
-			if checkIfNoneMatch(header, req) {
-				hdr := make(http.Header)
-				hdr.Set("ETag", header.Get("ETag"))
-				writeHeader(hdr, w)
-				w.WriteHeader(http.StatusNotModified)
+			switch checkPreconditions(header, req) {
+			case http.StatusNotModified:
+				writeNotModified(header, w)
 				return nil
+			case http.StatusPreconditionFailed:
+				return errPreconditionFailed
 			}
 		}
 
@@ -77,8 +99,7 @@ func (s server) getBucketOrValue(w http.ResponseWriter, req *http.Request) {
 			return bolt.ErrBucketNotFound
 		}
 		if len(parts) == 1 {
-			keys, err = listKeys(bucket)
-			return err
+			return list(tx, bucket)
 		}
 
 		var value []byte
@@ -86,33 +107,12 @@ func (s server) getBucketOrValue(w http.ResponseWriter, req *http.Request) {
 		if bucket == nil && value == nil {
 			return bolt.ErrBucketNotFound
 		} else if bucket != nil {
-			keys, err = listKeys(bucket)
-			return err
+			return list(tx, bucket)
+		} else if header == nil {
+			// The value has expired.
+			return bolt.ErrBucketNotFound
 		} else if value != nil {
-			if _, ok := req.Header["Range"]; ok {
-				ranges, err := ranger.ParseHeader(req.Header, len(value))
-				if err != nil {
-					if err == ranger.Error {
-						return err
-					}
-					return errBadRequest
-				}
-				header.Del("ETag")
-				header.Del("Content-Length")
-				w.WriteHeader(http.StatusPartialContent)
-				writeHeader(header, w)
-				for _, r := range ranges {
-					_, err := w.Write(value[r.Start : r.Stop+1])
-					if err != nil {
-						return err
-					}
-				}
-				return nil
-			} else {
-				writeHeader(header, w)
-				_, err := w.Write(value)
-				return err
-			}
+			return writeValue(w, req, tx, header, value)
 		}
 		return nil
 	})
@@ -126,6 +126,12 @@ func (s server) getBucketOrValue(w http.ResponseWriter, req *http.Request) {
 	} else if err == errBadRequest {
 		http.Error(w, "Bad request.", http.StatusBadRequest)
 		return
+	} else if err == errPreconditionFailed {
+		http.Error(w, "Precondition failed.", http.StatusPreconditionFailed)
+		return
+	} else if err == errNotAcceptable {
+		http.Error(w, "Not acceptable.", http.StatusNotAcceptable)
+		return
 	} else if err != nil {
 		log.Println(err)
 		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
@@ -133,169 +139,314 @@ func (s server) getBucketOrValue(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if keys != nil {
-		writeKeys(w, req, keys)
+		var next string
+		if more {
+			next = nextPage(req.URL, keys[len(keys)-1])
+		}
+		writeListing(w, req, &Listing{
+			Path:    req.URL.EscapedPath(),
+			Entries: entries,
+			Detail:  detail,
+			Next:    next,
+		})
 	}
 }
 
-func isText(hdr string) bool {
-	return (hdr == "" ||
-		strings.HasPrefix(hdr, "text/*") ||
-		strings.HasPrefix(hdr, "text/plain") ||
-		strings.HasPrefix(hdr, "*/*"))
-}
-
-func writeKeys(w http.ResponseWriter, req *http.Request, keys []string) {
-	accept := req.Header.Get("Accept")
-	if isText(accept) {
-		for _, k := range keys {
-			if _, err := fmt.Fprintln(w, k); err != nil {
-				log.Println(err)
-			}
+// writeValue writes a stored value and its header, or the ranges of it that
+// the request asks for. Values are only available in their stored
+// Content-Type, so errNotAcceptable is returned if the client doesn't accept
+// it.
+func writeValue(w http.ResponseWriter, req *http.Request, tx *bolt.Tx, header http.Header, value []byte) error {
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		w.Header().Add("Vary", "Accept")
+		if !acceptable(req, contentType) {
+			return errNotAcceptable
 		}
-		return
 	}
-	if strings.HasPrefix(accept, "application/json") {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		if err := json.NewEncoder(w).Encode(keys); err != nil {
-			log.Println(err)
-		}
-		return
+	content, size, err := valueContent(tx, header, value)
+	if err != nil {
+		return err
 	}
-	if strings.HasPrefix(accept, "application/xml") {
-		type bucket struct {
-			Keys []string `xml:"key"`
+	w.Header().Set("Accept-Ranges", "bytes")
+	if _, ok := req.Header["Range"]; ok && checkIfRange(header, req) {
+		ranges, err := ranger.ParseHeader(req.Header, int(size))
+		if err != nil {
+			if err == ranger.Error {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				return err
+			}
+			return errBadRequest
 		}
+		return writeRanges(w, header, content, int(size), ranges)
+	}
+	writeHeader(header, w)
+	if req.Method == "HEAD" {
+		return nil
+	}
+	_, err = io.Copy(w, io.NewSectionReader(content, 0, size))
+	return err
+}
 
-		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-		if _, err := w.Write([]byte(xml.Header)); err != nil {
-			log.Println(err)
-		}
-		enc := xml.NewEncoder(w)
-		enc.Indent("", "  ")
-		if err := enc.Encode(bucket{keys}); err != nil {
-			log.Println(err)
-		}
-		return
+// writeRanges writes the requested ranges of content, which is size bytes long,
+// as a 206 response. A single range is written as-is and described by the
+// Content-Range header. Several ranges are written as a multipart/byteranges
+// body with one part per range, as described in RFC 7233.
+func writeRanges(w http.ResponseWriter, header http.Header, content io.ReaderAt, size int, ranges []ranger.Range) error {
+	if len(ranges) == 1 {
+		r := ranges[0]
+		header.Set("Content-Range", contentRange(r, size))
+		header.Set("Content-Length", strconv.Itoa(r.Stop-r.Start+1))
+		writeHeader(header, w)
+		w.WriteHeader(http.StatusPartialContent)
+		_, err := io.Copy(w, io.NewSectionReader(content, int64(r.Start), int64(r.Stop-r.Start+1)))
+		return err
 	}
-	if strings.HasPrefix(accept, "text/html") {
-		pkg := &KeyPkg{
-			Path: req.URL.EscapedPath(),
-			Keys: keys,
+
+	contentType := header.Get("Content-Type")
+	mw := multipart.NewWriter(w)
+	header.Del("Content-Length")
+	header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	writeHeader(header, w)
+	w.WriteHeader(http.StatusPartialContent)
+	for _, r := range ranges {
+		partHeader := make(textproto.MIMEHeader)
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
 		}
-		if err := keysTmpl.Execute(w, pkg); err != nil {
-			log.Println(err)
+		partHeader.Set("Content-Range", contentRange(r, size))
+		part, err := mw.CreatePart(partHeader)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, io.NewSectionReader(content, int64(r.Start), int64(r.Stop-r.Start+1))); err != nil {
+			return err
 		}
-		return
 	}
+	return mw.Close()
 }
 
-func badPutOrDeleteHeaders(w http.ResponseWriter, req *http.Request) bool {
-	if req.ContentLength > 1<<24 {
-		http.Error(w, "Request too large.", http.StatusBadRequest)
-		return true
-	}
-	if req.Header.Get("If-None-Match") != "" {
-		http.Error(w, "Precondition failed.", http.StatusPreconditionFailed)
+func contentRange(r ranger.Range, size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Stop, size)
+}
+
+func (s server) badPutOrDeleteHeaders(w http.ResponseWriter, req *http.Request) bool {
+	if req.ContentLength > s.maxPutSize() {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
 		return true
 	}
 	return false
 }
 
-func checkIfMatch(header http.Header, req *http.Request) bool {
-	if header == nil {
-		for _, m := range req.Header["If-Match"] {
-			if m == "*" {
-				return false
-			}
-		}
-		return true
+// readBody reads a request body of any length, including chunked bodies. It
+// stops as soon as more than max bytes have been read, returning the bytes
+// read so far along with errTooLarge.
+func readBody(req *http.Request, max int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if req.ContentLength > 0 && req.ContentLength <= max {
+		buf.Grow(int(req.ContentLength))
 	}
-	matches, ok := req.Header["If-Match"]
-	if !ok {
-		return true
+	n, err := buf.ReadFrom(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return nil, err
 	}
-	if eTag := header.Get("ETag"); eTag != "" {
-		for _, m := range matches {
-			if eTag == m || m == "*" {
-				return true
-			}
-		}
+	if n > max {
+		return buf.Bytes(), errTooLarge
 	}
-	return false
+	return buf.Bytes(), nil
 }
 
 func (s server) putBucketOrValue(w http.ResponseWriter, req *http.Request) {
-	if badPutOrDeleteHeaders(w, req) {
+	if s.badPutOrDeleteHeaders(w, req) {
 		return
 	}
 	parts := splitPath(req.URL.EscapedPath())
-	key := parts[len(parts)-1]
-	msg := "Out of cheese."
-	status := 500
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		alreadyExists := false
-		if req.ContentLength > 0 {
-			header, err := getHeaderValue(tx, req.URL.EscapedPath())
-			if err != nil {
-				log.Printf("couldn't get header: %s", err)
-				return err
-			}
-			if header != nil {
-				alreadyExists = true
-			}
-			if !checkIfMatch(header, req) {
-				msg, status = "Precondition failed.", http.StatusPreconditionFailed
-				return errors.New("precondition failed")
-			}
-			parts = parts[:len(parts)-1]
-			if len(parts) == 0 {
-				msg, status = "Cannot PUT a value in the root bucket.", http.StatusBadRequest
-				return errors.New("request to put value in root bucket")
-			}
+
+	var (
+		buf    []byte
+		hasher *bodyHasher
+		ttl    time.Duration
+	)
+	if req.ContentLength != 0 {
+		if len(parts) == 1 {
+			http.Error(w, "Cannot PUT a value in the root bucket.", http.StatusBadRequest)
+			return
+		}
+		var err error
+		hasher, err = s.newBodyHasher(req.Header)
+		if err == nil {
+			ttl, err = parseTTL(req.Header)
 		}
-		bucket, err := getOrCreateBoltBucket(tx, parts)
 		if err != nil {
-			msg, status = "Error processing request.", http.StatusInternalServerError
+			http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+		// Preconditions are checked before the body is read, so that a client
+		// that sent "Expect: 100-continue" isn't asked for a body that will
+		// be rejected. They are checked again once the write transaction is
+		// open.
+		var precondition int
+		err = s.db.View(func(tx *bolt.Tx) error {
+			header, err := getLiveHeader(tx, req.URL.EscapedPath())
+			precondition = checkPreconditions(header, req)
+			return err
+		})
+		if err != nil {
+			log.Printf("couldn't get header: %s", err)
+			http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+			return
+		}
+		if precondition != 0 {
+			http.Error(w, "Precondition failed.", http.StatusPreconditionFailed)
+			return
+		}
+		// The body is read in full before the write transaction is opened, so
+		// that slow clients don't hold the database's write lock. Bodies that
+		// turn out to be too large for a single value are streamed into a
+		// large object instead.
+		limit, large := s.maxValueSize(), false
+		if s.largeObjectSize() < limit {
+			limit, large = s.largeObjectSize(), true
+		}
+		buf, err = readBody(req, limit)
+		if err == errTooLarge && large {
+			s.putLargeObject(w, req, io.MultiReader(bytes.NewReader(buf), req.Body), hasher, ttl)
+			return
+		} else if err == errTooLarge {
+			http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
 			log.Println(err)
+			http.Error(w, "Bad request.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(buf) == 0 {
+		err := s.update(req, func(tx *bolt.Tx) error {
+			_, err := getOrCreateBoltBucket(tx, parts)
 			return err
+		})
+		if err == errLocked {
+			writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+			return
 		}
-		if req.ContentLength > 0 {
-			buf := make([]byte, req.ContentLength)
-			_, err := io.ReadFull(req.Body, buf)
-			if err != nil && err == io.ErrUnexpectedEOF {
-				msg, status = "Bad request.", http.StatusBadRequest
-			}
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-			if err := bucket.Put(key, buf); err != nil {
-				log.Println(err)
-				return err
-			}
-			header := extractHeader(req.Header)
-			eTag := etag(buf)
-			header.Set("ETag", eTag)
-			lastModified := time.Now().UTC().Format(time.RFC1123Z)
-			header.Set("Last-Modified", lastModified)
-			if err := writeHeaderValue(tx, req.URL.EscapedPath(), header); err != nil {
-				return tx.Rollback()
-			}
-			w.Header().Set("ETag", eTag)
-			w.Header().Set("Last-Modified", lastModified)
-			if !alreadyExists {
-				w.Header().Set("Location", req.URL.EscapedPath())
-				w.WriteHeader(http.StatusCreated)
-			} else {
-				w.WriteHeader(http.StatusNoContent)
-			}
-			return nil
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Error processing request.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	hasher.Write(buf)
+	if !hasher.verify() {
+		http.Error(w, "Digest mismatch.", http.StatusBadRequest)
+		return
+	}
+	header := hasher.valueHeader(s.extractHeader(req.Header), int64(len(buf)))
+	setExpiry(header, ttl)
+	s.commitValue(w, req, buf, header)
+}
+
+// newValueHeader returns the header to store for a new value, given the
+// metadata extracted from the request that created it.
+func newValueHeader(metadata http.Header, size int64, eTag string) http.Header {
+	header := make(http.Header)
+	for k, v := range metadata {
+		header[k] = v
+	}
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Set("ETag", eTag)
+	header.Set("Last-Modified", time.Now().UTC().Format(time.RFC1123Z))
+	return header
+}
+
+// commitValue stores value and its header at the request path, provided the
+// request's preconditions still hold, and writes the response.
+func (s server) commitValue(w http.ResponseWriter, req *http.Request, value []byte, header http.Header) error {
+	path := req.URL.EscapedPath()
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var created bool
+	err := s.update(req, func(tx *bolt.Tx) error {
+		oldHeader, err := getLiveHeader(tx, path)
+		if err != nil {
+			log.Printf("couldn't get header: %s", err)
+			return err
+		}
+		if checkPreconditions(oldHeader, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		created = oldHeader == nil
+		if err := putValue(tx, path, value, header, oldHeader); err != nil {
+			log.Println(err)
+			return err
 		}
 		return nil
 	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return err
+	}
 	if err != nil {
 		http.Error(w, msg, status)
-		return
+		return err
+	}
+	writePutResponse(w, path, header, created)
+	return nil
+}
+
+// readValue returns the whole content of a stored value.
+func readValue(tx *bolt.Tx, header http.Header, value []byte) ([]byte, error) {
+	content, size, err := valueContent(tx, header, value)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if n, err := content.ReadAt(buf, 0); err != nil && !(err == io.EOF && int64(n) == size) {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// rewriteValue stores content at path in place of the value with oldHeader,
+// and returns the new header. The value keeps its TTL, unless ttl gives a new
+// one.
+func (s server) rewriteValue(tx *bolt.Tx, path string, content []byte, metadata http.Header, ttl time.Duration, oldHeader http.Header) (http.Header, error) {
+	hasher, err := s.newBodyHasher(nil)
+	if err != nil {
+		return nil, err
+	}
+	hasher.Write(content)
+	header := hasher.valueHeader(metadata, int64(len(content)))
+	if ttl > 0 {
+		setExpiry(header, ttl)
+	} else if v := oldHeader.Get(expiresHeader); v != "" {
+		header.Set(expiresHeader, v)
+	}
+	value := content
+	if int64(len(value)) > s.largeObjectSize() {
+		m, err := s.putChunks(tx, value)
+		if err != nil {
+			return nil, err
+		}
+		manifestJSON, _ := json.Marshal(m)
+		header.Set(manifestHeader, string(manifestJSON))
+		value = []byte(m.ID)
+	}
+	return header, putValue(tx, path, value, header, oldHeader)
+}
+
+// writePutResponse reports that a value with the given header was stored at
+// path.
+func writePutResponse(w http.ResponseWriter, path string, header http.Header, created bool) {
+	w.Header().Set("ETag", header.Get("ETag"))
+	w.Header().Set("Last-Modified", header.Get("Last-Modified"))
+	writePublicHeaders(header, w)
+	if created {
+		w.Header().Set("Location", path)
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
@@ -307,7 +458,7 @@ func writeHeaderValue(tx *bolt.Tx, path string, header http.Header) error {
 }
 
 func (s server) deleteBucketOrKey(w http.ResponseWriter, req *http.Request) {
-	if badPutOrDeleteHeaders(w, req) {
+	if s.badPutOrDeleteHeaders(w, req) {
 		return
 	}
 	parts := [][]byte{{'/'}}
@@ -322,37 +473,50 @@ func (s server) deleteBucketOrKey(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	var msg, status = "Out of cheese.", http.StatusInternalServerError
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		header, err := getHeaderValue(tx, req.URL.EscapedPath())
+	err := s.update(req, func(tx *bolt.Tx) error {
+		header, err := getLiveHeader(tx, req.URL.EscapedPath())
 		if err != nil {
 			log.Printf("couldn't get header: %s", err)
 			return err
 		}
-		if !checkIfMatch(header, req) {
+		if header == nil && getBoltBucket(tx, parts) == nil {
+			msg, status = "Not found.", http.StatusNotFound
+			return errors.New("Not found")
+		}
+		if checkPreconditions(header, req) != 0 {
 			msg, status = "Precondition failed.", http.StatusPreconditionFailed
-			return errors.New("precondition failed")
+			return errPreconditionFailed
 		}
 		if header == nil {
-			msg, status = "Not found.", http.StatusNotFound
-			return errors.New("Not found")
+			// Buckets have no header, and are deleted along with everything
+			// in them.
+			if depth := req.Header.Get("Depth"); depth != "" && depth != "infinity" {
+				msg, status = "Bad request.", http.StatusBadRequest
+				return errBadRequest
+			}
+			if err := deleteTree(tx, cleanPath(req.URL.EscapedPath())); err != nil {
+				return err
+			}
+			return deleteLocks(tx, cleanPath(req.URL.EscapedPath()))
 		}
-		bucket := getBoltBucket(tx, parts[:len(parts)-1])
-		if bucket == nil {
+		err = deleteValue(tx, string(escapedPath), header)
+		if err == nil {
+			err = deleteLocks(tx, cleanPath(req.URL.EscapedPath()))
+		}
+		if err == bolt.ErrBucketNotFound {
 			// We got the header, but not the content. Something is seriously
 			// wrong.
 			msg, status = "Internal server error.", http.StatusInternalServerError
 			log.Printf("Can't find content for valid header: %+v", header)
-			return bolt.ErrBucketNotFound
-		}
-		if err := tx.Bucket(headerBucket).Delete(escapedPath); err != nil {
-			return err
-		}
-		if err := bucket.Delete(parts[len(parts)-1]); err != nil {
+		} else if err != nil {
 			log.Printf("error: %s (rolling back tx)", err)
-			return tx.Rollback()
 		}
-		return nil
+		return err
 	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
 	if err != nil {
 		http.Error(w, msg, status)
 		return
@@ -360,17 +524,51 @@ func (s server) deleteBucketOrKey(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// base64 encoded etag
+// base64 encoded etag, computed with the default algorithm
 func etag(b []byte) string {
 	h := fnv.New64a()
 	h.Write(b)
+	return etagOf(h)
+}
+
+// etagOf returns the etag of the content written to h.
+func etagOf(h hash.Hash) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-func extractHeader(h http.Header) http.Header {
+func (s server) metadataFields() []string {
+	if len(s.cfg.Metadata.Headers) > 0 {
+		return s.cfg.Metadata.Headers
+	}
+	return headerFieldsToExtract
+}
+
+// isMetadataField reports whether the header field named key is stored with
+// values. Fields ending in "*" in the allowlist match by prefix.
+func (s server) isMetadataField(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	if strings.HasPrefix(key, internalHeaderPrefix) {
+		return false
+	}
+	for _, f := range s.metadataFields() {
+		if strings.HasSuffix(f, "*") {
+			if strings.HasPrefix(key, http.CanonicalHeaderKey(strings.TrimSuffix(f, "*"))) {
+				return true
+			}
+		} else if key == http.CanonicalHeaderKey(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractHeader returns the fields of h that are stored with values.
+func (s server) extractHeader(h http.Header) http.Header {
 	result := make(http.Header)
-	for _, k := range headerFieldsToExtract {
-		values := h[k]
+	for k, values := range h {
+		if !s.isMetadataField(k) {
+			continue
+		}
 		for _, v := range values {
 			result.Add(k, v)
 		}
@@ -378,19 +576,101 @@ func extractHeader(h http.Header) http.Header {
 	return result
 }
 
+// putMetadata replaces the stored metadata of a value with the metadata in
+// the request's header, leaving its content alone. The value's Content-Length
+// and ETag are kept, and its Last-Modified time is updated.
+func (s server) putMetadata(w http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > 0 {
+		http.Error(w, "Metadata updates can't have a body.", http.StatusBadRequest)
+		return
+	}
+	path := req.URL.EscapedPath()
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var header http.Header
+	err := s.update(req, func(tx *bolt.Tx) error {
+		oldHeader, err := getLiveHeader(tx, path)
+		if err != nil {
+			log.Printf("couldn't get header: %s", err)
+			return err
+		}
+		if oldHeader == nil || len(splitPath(path)) == 1 {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		if checkPreconditions(oldHeader, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		header = s.extractHeader(req.Header)
+		for k, v := range oldHeader {
+			if !s.isMetadataField(k) || k == "Content-Length" {
+				header[k] = v
+			}
+		}
+		header.Set("Last-Modified", time.Now().UTC().Format(time.RFC1123Z))
+		if err := writeHeaderValue(tx, path, header); err != nil {
+			return err
+		}
+		return recordChange(tx, changeEvent{
+			Op:           "put",
+			Path:         path,
+			ETag:         header.Get("ETag"),
+			LastModified: header.Get("Last-Modified"),
+			Metadata:     true,
+		})
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		http.Error(w, msg, status)
+		return
+	}
+	writePutResponse(w, path, header, false)
+}
+
+// writeHeader copies a stored header to w, leaving out the fields that are
+// only for the server's own use, unless they are listed in publicHeaders.
 func writeHeader(header http.Header, w http.ResponseWriter) {
 	for key, values := range header {
+		if strings.HasPrefix(key, internalHeaderPrefix) {
+			continue
+		}
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	writePublicHeaders(header, w)
+}
+
+// writePublicHeaders copies the internal fields of header that clients may
+// see to w, under their public names.
+func writePublicHeaders(header http.Header, w http.ResponseWriter) {
+	for internal, public := range publicHeaders {
+		if v := header.Get(internal); v != "" {
+			w.Header().Set(public, v)
+		}
+	}
+}
+
+// writeNotModified writes a 304 response carrying the validators of header.
+func writeNotModified(header http.Header, w http.ResponseWriter) {
+	hdr := make(http.Header)
+	for _, k := range []string{"ETag", "Last-Modified"} {
+		if v := header.Get(k); v != "" {
+			hdr.Set(k, v)
+		}
+	}
+	writeHeader(hdr, w)
+	w.WriteHeader(http.StatusNotModified)
 }
 
 func (s server) getHeader(w http.ResponseWriter, req *http.Request) {
 	var header http.Header
 	err := s.db.View(func(tx *bolt.Tx) error {
 		var err error
-		header, err = getHeaderValue(tx, req.URL.EscapedPath())
+		header, err = getLiveHeader(tx, req.URL.EscapedPath())
 		return err
 	})
 	if err == bolt.ErrBucketNotFound {
@@ -407,5 +687,18 @@ func (s server) getHeader(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	switch checkPreconditions(header, req) {
+	case http.StatusNotModified:
+		writeNotModified(header, w)
+		return
+	case http.StatusPreconditionFailed:
+		http.Error(w, "Precondition failed.", http.StatusPreconditionFailed)
+		return
+	}
+	if !acceptable(req, header.Get("Content-Type")) {
+		http.Error(w, "Not acceptable.", http.StatusNotAcceptable)
+		return
+	}
+
 	writeHeader(header, w)
 }
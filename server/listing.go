@@ -0,0 +1,230 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// defaultMaxListKeys is the most keys returned by a bucket listing when the
+// config doesn't say otherwise.
+const defaultMaxListKeys = 1000
+
+// listOptions select a page of a bucket listing. Keys are listed in byte
+// order, or in reverse if Reverse is set, in which case Start and After bound
+// the listing from above.
+type listOptions struct {
+	// Prefix restricts the listing to keys starting with it.
+	Prefix []byte
+
+	// Start is the first key that may be listed.
+	Start []byte
+
+	// After is the key that the listing continues from. It isn't listed
+	// itself.
+	After []byte
+
+	// Limit is the most keys listed.
+	Limit int
+
+	Reverse bool
+
+	// Hide, if set, reports whether a key is left out of the listing.
+	Hide func(key []byte) (bool, error)
+}
+
+func (s server) maxListKeys() int {
+	if s.cfg.Limits.MaxListKeys > 0 {
+		return s.cfg.Limits.MaxListKeys
+	}
+	return defaultMaxListKeys
+}
+
+// parseListOptions reads listing options from the prefix, start, after, limit
+// and reverse query parameters. The limit can't be more than max.
+func parseListOptions(query url.Values, max int) (listOptions, error) {
+	opts := listOptions{Limit: max}
+	if v, ok := query["prefix"]; ok {
+		opts.Prefix = []byte(v[0])
+	}
+	if v, ok := query["start"]; ok {
+		opts.Start = []byte(v[0])
+	}
+	if v, ok := query["after"]; ok {
+		opts.After = []byte(v[0])
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return opts, errBadRequest
+		}
+		if limit < max {
+			opts.Limit = limit
+		}
+	}
+	if v, ok := query["reverse"]; ok && v[0] != "false" {
+		opts.Reverse = true
+	}
+	return opts, nil
+}
+
+// successor returns the first key that sorts after every key starting with
+// prefix, or nil if there is no such key.
+func successor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			next := append([]byte(nil), prefix[:i+1]...)
+			next[i]++
+			return next
+		}
+	}
+	return nil
+}
+
+// lowerBound returns the smallest key that opts allows.
+func (opts listOptions) lowerBound() []byte {
+	bound := opts.Prefix
+	if bytes.Compare(opts.Start, bound) > 0 {
+		bound = opts.Start
+	}
+	if opts.After != nil {
+		if after := append(append([]byte(nil), opts.After...), 0); bytes.Compare(after, bound) > 0 {
+			bound = after
+		}
+	}
+	return bound
+}
+
+// upperBound returns the first key above those that opts allows, or nil if
+// there is no bound.
+func (opts listOptions) upperBound() []byte {
+	var bound []byte
+	lower := func(b []byte) {
+		if bound == nil || bytes.Compare(b, bound) < 0 {
+			bound = b
+		}
+	}
+	if len(opts.Prefix) > 0 {
+		if b := successor(opts.Prefix); b != nil {
+			lower(b)
+		}
+	}
+	if opts.Start != nil {
+		lower(append(append([]byte(nil), opts.Start...), 0))
+	}
+	if opts.After != nil {
+		lower(opts.After)
+	}
+	return bound
+}
+
+// listKeys returns the page of keys in bucket that opts selects, and whether
+// there are more keys after it. Sub-buckets are listed along with values.
+func listKeys(bucket *bolt.Bucket, opts listOptions) (keys []string, more bool, err error) {
+	keys = []string{}
+	c := bucket.Cursor()
+	var k []byte
+	next := c.Next
+	if opts.Reverse {
+		next = c.Prev
+		if bound := opts.upperBound(); bound == nil {
+			k, _ = c.Last()
+		} else if k, _ = c.Seek(bound); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+	} else {
+		k, _ = c.Seek(opts.lowerBound())
+	}
+	for ; k != nil; k, _ = next() {
+		if !bytes.HasPrefix(k, opts.Prefix) {
+			break
+		}
+		if opts.Hide != nil {
+			hide, err := opts.Hide(k)
+			if err != nil {
+				return nil, false, err
+			}
+			if hide {
+				continue
+			}
+		}
+		if len(keys) == opts.Limit {
+			return keys, true, nil
+		}
+		keys = append(keys, string(k))
+	}
+	return keys, false, nil
+}
+
+// Entry describes a key in a detailed bucket listing. Sub-buckets only have a
+// name and a kind.
+type Entry struct {
+	XMLName      xml.Name `json:"-" xml:"entry"`
+	Name         string   `json:"name" xml:"name,attr"`
+	Kind         string   `json:"kind" xml:"kind,attr"`
+	Size         int64    `json:"size,omitempty" xml:"size,omitempty"`
+	ContentType  string   `json:"content_type,omitempty" xml:"content_type,omitempty"`
+	ETag         string   `json:"etag,omitempty" xml:"etag,omitempty"`
+	LastModified string   `json:"last_modified,omitempty" xml:"last_modified,omitempty"`
+	Children     []Entry  `json:"children,omitempty" xml:"entry"`
+}
+
+// hideExpired returns a Hide function for listings of the bucket at path that
+// leaves out the values that have expired by now, but haven't been swept yet.
+func hideExpired(tx *bolt.Tx, bucket *bolt.Bucket, path string, now time.Time) func([]byte) (bool, error) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	return func(k []byte) (bool, error) {
+		if bucket.Bucket(k) != nil {
+			return false, nil
+		}
+		header, err := getHeaderValue(tx, prefix+string(k))
+		return expired(header, now), err
+	}
+}
+
+// describeKeys returns the entries for keys, which belong to the bucket at
+// path, taking the details of values from their stored headers.
+func describeKeys(tx *bolt.Tx, bucket *bolt.Bucket, path string, keys []string) ([]Entry, error) {
+	entries := make([]Entry, 0, len(keys))
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for _, k := range keys {
+		if bucket.Bucket([]byte(k)) != nil {
+			entries = append(entries, Entry{Name: k, Kind: "bucket"})
+			continue
+		}
+		header, err := getHeaderValue(tx, prefix+k)
+		if err != nil {
+			return nil, err
+		}
+		e := Entry{Name: k, Kind: "value"}
+		if header != nil {
+			e.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+			e.ContentType = header.Get("Content-Type")
+			e.ETag = header.Get("ETag")
+			e.LastModified = header.Get("Last-Modified")
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// nextPage returns the URL of the page of a listing that follows the one
+// ending with last.
+func nextPage(u *url.URL, last string) string {
+	query := u.Query()
+	query.Del("start")
+	query.Set("after", last)
+	next := url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: query.Encode()}
+	return next.String()
+}
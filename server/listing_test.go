@@ -0,0 +1,252 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestListKeys(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("/"))
+		for _, k := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+			if err := bucket.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Query string
+		Keys  []string
+		More  bool
+	}{
+		{Query: "", Keys: []string{"a", "ab", "abc", "b", "ba", "c"}},
+		{Query: "limit=2", Keys: []string{"a", "ab"}, More: true},
+		{Query: "limit=100", Keys: []string{"a", "ab", "abc", "b", "ba", "c"}},
+		{Query: "prefix=a", Keys: []string{"a", "ab", "abc"}},
+		{Query: "prefix=a&after=ab", Keys: []string{"abc"}},
+		{Query: "start=ab&limit=2", Keys: []string{"ab", "abc"}, More: true},
+		{Query: "after=b", Keys: []string{"ba", "c"}},
+		{Query: "prefix=z", Keys: []string{}},
+		{Query: "reverse", Keys: []string{"c", "ba", "b", "abc", "ab", "a"}},
+		{Query: "reverse&prefix=b", Keys: []string{"ba", "b"}},
+		{Query: "reverse&prefix=a&start=abb", Keys: []string{"ab", "a"}},
+		{Query: "reverse&after=b&limit=2", Keys: []string{"abc", "ab"}, More: true},
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, test := range tests {
+			query, err := url.ParseQuery(test.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := parseListOptions(query, 10)
+			if err != nil {
+				t.Errorf("%q: %s", test.Query, err)
+				continue
+			}
+			keys, more, err := listKeys(tx.Bucket([]byte("/")), opts)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(keys, test.Keys) || more != test.More {
+				t.Errorf("%q: got %q (more: %v), want %q (more: %v)", test.Query, keys, more, test.Keys, test.More)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"limit=0", "limit=-1", "limit=lots"} {
+		query, _ := url.ParseQuery(q)
+		if _, err := parseListOptions(query, 10); err == nil {
+			t.Errorf("%q: expected error", q)
+		}
+	}
+}
+
+func TestPaginatedListing(t *testing.T) {
+	t.Parallel()
+	s := httptest.NewServer(server{
+		db:  getBoltDB(t),
+		cfg: config.Data{Limits: config.Limits{MaxListKeys: 2}},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	for _, x := range []string{"/foo", "/bar", "/baz"} {
+		req, err := http.NewRequest("PUT", s.URL+x, strings.NewReader("foobarbaz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Follow the Link headers through the pages of the listing.
+	var keys []string
+	next := "/?limit=5"
+	for pages := 0; next != ""; pages++ {
+		if pages > 2 {
+			t.Fatal("too many pages")
+		}
+		req, err := http.NewRequest("GET", s.URL+next, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []string
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, page...)
+		next = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			if !strings.HasSuffix(link, `>; rel="next"`) {
+				t.Fatalf("bad Link: %q", link)
+			}
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	if got, want := keys, []string{"bar", "baz", "foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bad keys: got %q, want %q", got, want)
+	}
+}
+
+func TestDetailedListing(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	do("PUT", s.URL+"/a/sub", "", nil)
+	resp := do("PUT", s.URL+"/a/x", "foobar", map[string]string{"Content-Type": "text/csv"})
+	lastModified := resp.Header.Get("Last-Modified")
+
+	want := []Entry{
+		{Name: "sub", Kind: "bucket"},
+		{Name: "x", Kind: "value", Size: 6, ContentType: "text/csv", ETag: etag([]byte("foobar")), LastModified: lastModified},
+	}
+
+	resp = do("GET", s.URL+"/a?detail", "", map[string]string{"Accept": "application/json"})
+	var got []Entry
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad entries: got %+v, want %+v", got, want)
+	}
+
+	resp = do("GET", s.URL+"/a/?detail", "", map[string]string{"Accept": "application/x-ndjson"})
+	if got, want := resp.Header.Get("Content-Type"), "application/x-ndjson"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for i := range want {
+		var e Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(e, want[i]) {
+			t.Errorf("bad entry %d: got %+v, want %+v", i, e, want[i])
+		}
+	}
+
+	resp = do("GET", s.URL+"/a?detail", "", map[string]string{"Accept": "application/xml"})
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`<entry name="sub" kind="bucket"></entry>`, `<entry name="x" kind="value">`, `<content_type>text/csv</content_type>`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("XML listing is missing %s:\n%s", s, b)
+		}
+	}
+}
+
+func TestListingHidesExpired(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url, body string, header map[string]string) string {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	do("PUT", s.URL+"/e/live", "foo", nil)
+	do("PUT", s.URL+"/e/dead", "bar", map[string]string{"TTL": "1"})
+	do("PUT", s.URL+"/e/sub/gone", "baz", map[string]string{"TTL": "1"})
+
+	// Expired values aren't listed, even before the sweeper gets to them.
+	time.Sleep(1100 * time.Millisecond)
+	tests := []struct {
+		Path   string
+		Accept string
+	}{
+		{"/e", "text/plain"},
+		{"/e?detail", "application/json"},
+		{"/e?recursive", "text/plain"},
+		{"/e?recursive&detail", "application/json"},
+		{"/e?recursive", "application/xml"},
+	}
+	for _, test := range tests {
+		body := do("GET", s.URL+test.Path, "", map[string]string{"Accept": test.Accept})
+		if !strings.Contains(body, "live") || strings.Contains(body, "dead") || strings.Contains(body, "gone") {
+			t.Errorf("%s %s: bad listing: %s", test.Path, test.Accept, body)
+		}
+	}
+}
@@ -0,0 +1,598 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// defaultLockTimeout is how long a lock lasts when the client doesn't ask
+	// for a timeout the server is willing to grant.
+	defaultLockTimeout = time.Hour
+
+	// maxLockTimeout is the longest timeout a lock can be granted.
+	maxLockTimeout = 24 * time.Hour
+)
+
+// lockBucket holds the WebDAV locks, keyed by lock token.
+var lockBucket = append([]byte{0}, []byte("locks")...)
+
+// davLock is a WebDAV write lock on the resource at Root, and everything
+// beneath it if Deep is set. Owner is the XML content of the owner element
+// the client sent.
+type davLock struct {
+	Token   string        `json:"token"`
+	Root    string        `json:"root"`
+	Deep    bool          `json:"deep,omitempty"`
+	Shared  bool          `json:"shared,omitempty"`
+	Owner   string        `json:"owner,omitempty"`
+	Timeout time.Duration `json:"timeout"`
+	Expires time.Time     `json:"expires"`
+}
+
+// lockInfo is the body of a LOCK request.
+type lockInfo struct {
+	XMLName   xml.Name     `xml:"DAV: lockinfo"`
+	Exclusive *struct{}    `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{}    `xml:"DAV: lockscope>shared"`
+	Write     *struct{}    `xml:"DAV: locktype>write"`
+	Owner     *rawProperty `xml:"DAV: owner"`
+}
+
+// ifCondition is a condition in an If header. It holds either a lock token
+// or an entity tag.
+type ifCondition struct {
+	Not   bool
+	Token string
+	ETag  string
+}
+
+// ifList is a parenthesized list of conditions in an If header, which holds
+// if all of its conditions do. Resource is the resource the conditions are
+// about; it is empty for the resource the request is for.
+type ifList struct {
+	Resource   string
+	Conditions []ifCondition
+}
+
+// lockTarget is a path that a request modifies. If deep is set, whatever is
+// beneath it is modified too.
+type lockTarget struct {
+	path string
+	deep bool
+}
+
+func createLockBucketIfNotExists(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(lockBucket)
+		return err
+	})
+}
+
+// covers reports whether l locks the resource at path.
+func (l *davLock) covers(path string) bool {
+	return l.Root == path || (l.Deep && isWithin(path, l.Root))
+}
+
+// conflicts reports whether l is in the way of a lock on target.
+func (l *davLock) conflicts(target lockTarget) bool {
+	return l.covers(target.path) || (target.deep && isWithin(l.Root, target.path))
+}
+
+// xml returns the activelock element describing l.
+func (l *davLock) xml() string {
+	scope, depth := "exclusive", "0"
+	if l.Shared {
+		scope = "shared"
+	}
+	if l.Deep {
+		depth = "infinity"
+	}
+	var owner string
+	if l.Owner != "" {
+		owner = "<D:owner>" + l.Owner + "</D:owner>"
+	}
+	remaining := l.Expires.Sub(time.Now()) / time.Second
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf("<D:activelock><D:locktype><D:write/></D:locktype>"+
+		"<D:lockscope><D:%s/></D:lockscope><D:depth>%s</D:depth>%s"+
+		"<D:timeout>Second-%d</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken>"+
+		"<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+		scope, depth, owner, remaining, escapeXML(l.Token), escapeXML(l.Root))
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// getLocks returns the locks that haven't expired. Writable transactions
+// delete the ones that have.
+func getLocks(tx *bolt.Tx) ([]davLock, error) {
+	var (
+		locks   []davLock
+		expired [][]byte
+	)
+	now := time.Now()
+	bucket := tx.Bucket(lockBucket)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var l davLock
+		if err := json.Unmarshal(v, &l); err != nil {
+			return err
+		}
+		if now.After(l.Expires) {
+			expired = append(expired, k)
+		} else {
+			locks = append(locks, l)
+		}
+		return nil
+	})
+	if err != nil || !tx.Writable() {
+		return locks, err
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return locks, nil
+}
+
+func putLock(tx *bolt.Tx, l *davLock) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(lockBucket).Put([]byte(l.Token), b)
+}
+
+// deleteLocks deletes the locks on the resource at path and on everything
+// beneath it.
+func deleteLocks(tx *bolt.Tx, path string) error {
+	locks, err := getLocks(tx)
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if l.Root == path || isWithin(l.Root, path) {
+			if err := tx.Bucket(lockBucket).Delete([]byte(l.Token)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseIf parses an If header, as described in RFC 4918 section 10.4.
+func parseIf(v string) ([]ifList, error) {
+	var (
+		lists    []ifList
+		resource string
+	)
+	errBad := fmt.Errorf("bad If header: %q", v)
+	for v = strings.TrimSpace(v); v != ""; v = strings.TrimSpace(v) {
+		var end int
+		switch v[0] {
+		case '<':
+			if end = strings.IndexByte(v, '>'); end < 0 {
+				return nil, errBad
+			}
+			u, err := url.Parse(v[1:end])
+			if err != nil {
+				return nil, errBad
+			}
+			resource = cleanPath(u.EscapedPath())
+		case '(':
+			if end = strings.IndexByte(v, ')'); end < 0 {
+				return nil, errBad
+			}
+			conditions, err := parseIfConditions(v[1:end])
+			if err != nil {
+				return nil, errBad
+			}
+			lists = append(lists, ifList{Resource: resource, Conditions: conditions})
+		default:
+			return nil, errBad
+		}
+		v = v[end+1:]
+	}
+	return lists, nil
+}
+
+func parseIfConditions(v string) ([]ifCondition, error) {
+	var conditions []ifCondition
+	for v = strings.TrimSpace(v); v != ""; v = strings.TrimSpace(v) {
+		var c ifCondition
+		if strings.HasPrefix(v, "Not") {
+			c.Not = true
+			v = strings.TrimSpace(v[3:])
+		}
+		if v == "" {
+			return nil, errBadRequest
+		}
+		closer := map[byte]byte{'<': '>', '[': ']'}[v[0]]
+		end := strings.IndexByte(v, closer)
+		if closer == 0 || end < 0 {
+			return nil, errBadRequest
+		}
+		if v[0] == '<' {
+			c.Token = v[1:end]
+		} else {
+			c.ETag = v[1:end]
+		}
+		conditions = append(conditions, c)
+		v = v[end+1:]
+	}
+	if len(conditions) == 0 {
+		return nil, errBadRequest
+	}
+	return conditions, nil
+}
+
+// evalIf reports whether any of the lists of an If header hold for the
+// request to path. A lock token condition holds if the token is that of a
+// lock on the resource.
+func evalIf(tx *bolt.Tx, path string, lists []ifList, locks []davLock) (bool, error) {
+	for _, list := range lists {
+		resource := path
+		if list.Resource != "" {
+			resource = list.Resource
+		}
+		r, err := findResource(tx, resource)
+		if err != nil {
+			return false, err
+		}
+		holds := true
+		for _, c := range list.Conditions {
+			var ok bool
+			if c.Token != "" {
+				for i := range locks {
+					ok = ok || (locks[i].Token == c.Token && locks[i].covers(resource))
+				}
+			} else if r != nil && r.Header != nil {
+				ok = etagsMatch(r.Header.Get("ETag"), c.ETag, false)
+			}
+			if ok == c.Not {
+				holds = false
+				break
+			}
+		}
+		if holds {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// submittedTokens returns the lock tokens named in an If header.
+func submittedTokens(lists []ifList) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, list := range lists {
+		for _, c := range list.Conditions {
+			if c.Token != "" && !c.Not {
+				tokens[c.Token] = true
+			}
+		}
+	}
+	return tokens
+}
+
+// lockTargets returns the paths that req modifies, for the methods that
+// locks protect against.
+func lockTargets(req *http.Request) []lockTarget {
+	path := cleanPath(req.URL.EscapedPath())
+	query := req.URL.Query()
+	if _, ok := query["webhooks"]; ok {
+		// Webhooks don't change what they watch.
+		return nil
+	}
+	if _, ok := query["upload"]; ok {
+		// Uploading parts, or aborting, changes nothing until the upload is
+		// committed to its path.
+		if req.Method == "POST" {
+			return []lockTarget{{path: path}}
+		}
+		return nil
+	}
+	if isVersionRequest(req) {
+		switch {
+		case query["versioning"] != nil && req.Method == "PUT":
+			// Versioning applies to everything in the bucket.
+			return []lockTarget{{path: path, deep: true}}
+		case query["version"] != nil && req.Method == "DELETE",
+			query["restore"] != nil && req.Method == "POST":
+			return []lockTarget{{path: path}}
+		}
+		return nil
+	}
+	if move, ok := isCopyRequest(req); ok {
+		var targets []lockTarget
+		if move {
+			targets = append(targets, lockTarget{path: path, deep: true})
+		}
+		if dst, code := destination(req); code == 0 {
+			targets = append(targets, lockTarget{path: dst, deep: true})
+		}
+		return targets
+	}
+	switch req.Method {
+	case "PUT", "PATCH", "PROPPATCH", "MKCOL":
+		return []lockTarget{{path: path}}
+	case "POST":
+		// Batches check the locks on each of their operations, and creating
+		// an upload session changes nothing yet. Otherwise, a POST changes a
+		// counter, or adds a value to a bucket.
+		_, batch := query["batch"]
+		_, uploads := query["uploads"]
+		if !batch && !uploads {
+			return []lockTarget{{path: path}}
+		}
+	case "DELETE":
+		return []lockTarget{{path: path, deep: true}}
+	}
+	return nil
+}
+
+// checkLocks evaluates the If header of req, and checks that the client holds
+// the locks on whatever req modifies, by naming their tokens in the If
+// header. If not, it writes the error response and returns false.
+func (s server) checkLocks(w http.ResponseWriter, req *http.Request) bool {
+	targets := lockTargets(req)
+	_, hasIf := req.Header["If"]
+	if len(targets) == 0 && !hasIf {
+		return true
+	}
+	lists, err := parseIf(req.Header.Get("If"))
+	if err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return false
+	}
+	var status int
+	err = s.db.View(func(tx *bolt.Tx) error {
+		locks, err := getLocks(tx)
+		if err != nil {
+			return err
+		}
+		if hasIf {
+			ok, err := evalIf(tx, cleanPath(req.URL.EscapedPath()), lists, locks)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				status = http.StatusPreconditionFailed
+				return nil
+			}
+		}
+		if lockedOut(locks, targets, submittedTokens(lists)) {
+			status = http.StatusLocked
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+	case status == http.StatusPreconditionFailed:
+		http.Error(w, "Precondition failed.", status)
+	case status == http.StatusLocked:
+		writeDAVError(w, status, "lock-token-submitted")
+	default:
+		return true
+	}
+	return false
+}
+
+// lockedOut reports whether any of locks conflicts with targets without its
+// token being among those submitted.
+func lockedOut(locks []davLock, targets []lockTarget, tokens map[string]bool) bool {
+	for i := range locks {
+		for _, t := range targets {
+			if locks[i].conflicts(t) && !tokens[locks[i].Token] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errLocked is returned from a write transaction that found a lock on what it
+// would modify, taken after checkLocks ran.
+var errLocked = errors.New("locked")
+
+// update is like s.db.Update, but checks the locks on whatever req modifies
+// again inside the transaction, so that a lock taken since checkLocks can't
+// be written past. It returns errLocked if one has been.
+func (s server) update(req *http.Request, fn func(*bolt.Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if targets := lockTargets(req); len(targets) > 0 {
+			lists, err := parseIf(req.Header.Get("If"))
+			if err != nil {
+				return err
+			}
+			locks, err := getLocks(tx)
+			if err != nil {
+				return err
+			}
+			if lockedOut(locks, targets, submittedTokens(lists)) {
+				return errLocked
+			}
+		}
+		return fn(tx)
+	})
+}
+
+// lockTimeout parses a Timeout header, which lists the timeouts the client
+// would like in order of preference. The first one that is no longer than
+// maxLockTimeout is granted.
+func lockTimeout(h http.Header) time.Duration {
+	for _, v := range strings.Split(h.Get("Timeout"), ",") {
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, "Second-") {
+			continue
+		}
+		d, err := time.ParseDuration(v[len("Second-"):] + "s")
+		if err == nil && d > 0 && d <= maxLockTimeout {
+			return d
+		}
+	}
+	return defaultLockTimeout
+}
+
+// lock creates a lock, or refreshes one named in the If header when there is
+// no body. Locking a path where nothing is stored creates an empty value.
+func (s server) lock(w http.ResponseWriter, req *http.Request) {
+	var info lockInfo
+	hasBody, err := readDAVBody(req, &info)
+	if err != nil || (hasBody && (info.Write == nil || (info.Exclusive == nil) == (info.Shared == nil))) {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	var deep bool
+	switch req.Header.Get("Depth") {
+	case "", "infinity":
+		deep = true
+	case "0":
+	default:
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	lists, err := parseIf(req.Header.Get("If"))
+	if err != nil || (!hasBody && len(lists) == 0) {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+
+	path := cleanPath(req.URL.EscapedPath())
+	timeout := lockTimeout(req.Header)
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var (
+		l       *davLock
+		created bool
+	)
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		locks, err := getLocks(tx)
+		if err != nil {
+			return err
+		}
+		if !hasBody {
+			tokens := submittedTokens(lists)
+			for i := range locks {
+				if tokens[locks[i].Token] && locks[i].covers(path) {
+					l = &locks[i]
+				}
+			}
+			if l == nil {
+				msg, status = "Precondition failed.", http.StatusPreconditionFailed
+				return errPreconditionFailed
+			}
+			l.Timeout, l.Expires = timeout, time.Now().Add(timeout)
+			return putLock(tx, l)
+		}
+
+		l = &davLock{Root: path, Deep: deep, Shared: info.Shared != nil, Timeout: timeout, Expires: time.Now().Add(timeout)}
+		if info.Owner != nil {
+			l.Owner = info.Owner.InnerXML
+		}
+		for i := range locks {
+			if locks[i].conflicts(lockTarget{path: path, deep: deep}) && !(l.Shared && locks[i].Shared) {
+				msg, status = "Locked.", http.StatusLocked
+				return errPreconditionFailed
+			}
+		}
+		r, err := findResource(tx, path)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			parts := splitPath(path)
+			if getBoltBucket(tx, parts[:len(parts)-1]) == nil {
+				msg, status = "Conflict.", http.StatusConflict
+				return errBadRequest
+			}
+			hasher, err := s.newBodyHasher(nil)
+			if err != nil {
+				return err
+			}
+			if err := putValue(tx, path, []byte{}, hasher.valueHeader(nil, 0), nil); err != nil {
+				return err
+			}
+			created = true
+		}
+		if l.Token, err = newLockToken(); err != nil {
+			return err
+		}
+		return putLock(tx, l)
+	})
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+
+	if hasBody {
+		w.Header().Set("Lock-Token", "<"+l.Token+">")
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	fmt.Fprintf(w, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>`+"\n", xml.Header, l.xml())
+}
+
+// unlock removes the lock named by the Lock-Token header.
+func (s server) unlock(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimSpace(req.Header.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	token = token[1 : len(token)-1]
+	path := cleanPath(req.URL.EscapedPath())
+
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		locks, err := getLocks(tx)
+		if err != nil {
+			return err
+		}
+		for i := range locks {
+			if locks[i].Token == token && locks[i].covers(path) {
+				return tx.Bucket(lockBucket).Delete([]byte(token))
+			}
+		}
+		msg, status = "Conflict.", http.StatusConflict
+		return errBadRequest
+	})
+	if status == http.StatusConflict {
+		writeDAVError(w, status, "lock-token-matches-request-uri")
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import "encoding/binary"
+
+// The functions below append MessagePack encodings of values to b. Only the
+// types needed for bucket listings are supported. See
+// https://github.com/msgpack/msgpack/blob/master/spec.md.
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = append(b, 0xda, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+	default:
+		b = append(b, 0xdb, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	if i >= 0 && i < 128 {
+		return append(b, byte(i))
+	}
+	b = append(b, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(b)-8:], uint64(i))
+	return b
+}
+
+func appendMsgpackArray(b []byte, n int) []byte {
+	return appendMsgpackHeader(b, n, 0x90, 0xdc)
+}
+
+func appendMsgpackMap(b []byte, n int) []byte {
+	return appendMsgpackHeader(b, n, 0x80, 0xde)
+}
+
+// appendMsgpackHeader appends the header of an array or map with n elements,
+// given the type's fix and 16-bit markers. The 32-bit marker follows the
+// 16-bit one.
+func appendMsgpackHeader(b []byte, n int, fix, marker16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n < 1<<16:
+		b = append(b, marker16, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+	default:
+		b = append(b, marker16+1, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+	}
+	return b
+}
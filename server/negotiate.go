@@ -0,0 +1,125 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// mediaRange is a media range from an Accept header.
+type mediaRange struct {
+	Type, Subtype string
+	Q             float64
+
+	// Index is the position of the range in the header.
+	Index int
+}
+
+// parseAccept parses the media ranges of Accept header field values. Ranges
+// that can't be parsed are left out.
+func parseAccept(values []string) []mediaRange {
+	var ranges []mediaRange
+	for _, v := range values {
+		for _, r := range strings.Split(v, ",") {
+			if strings.TrimSpace(r) == "" {
+				continue
+			}
+			mediaType, params, err := mime.ParseMediaType(r)
+			if err != nil {
+				continue
+			}
+			slash := strings.IndexByte(mediaType, '/')
+			if slash < 0 {
+				continue
+			}
+			mr := mediaRange{
+				Type:    mediaType[:slash],
+				Subtype: mediaType[slash+1:],
+				Q:       1,
+				Index:   len(ranges),
+			}
+			if q, ok := params["q"]; ok {
+				if mr.Q, err = strconv.ParseFloat(q, 64); err != nil || mr.Q < 0 || mr.Q > 1 {
+					continue
+				}
+			}
+			ranges = append(ranges, mr)
+		}
+	}
+	return ranges
+}
+
+// match returns how specifically r matches mediaType: 2 for an exact match,
+// 1 for a match of "type/*", 0 for a match of "*/*", and -1 for no match.
+func (r mediaRange) match(mediaType string) int {
+	slash := strings.IndexByte(mediaType, '/')
+	typ, subtype := mediaType[:slash], mediaType[slash+1:]
+	switch {
+	case r.Type == "*" && r.Subtype == "*":
+		return 0
+	case r.Type == typ && r.Subtype == "*":
+		return 1
+	case r.Type == typ && r.Subtype == subtype:
+		return 2
+	}
+	return -1
+}
+
+// negotiate chooses which of the media types in offers to send in response
+// to req, as described in RFC 7231, section 5.3.2. Each offer gets the
+// quality of the most specific media range that matches it, and the offer
+// with the highest quality wins. Ties go to the offer matched most
+// specifically, then to the one the client listed first, then to the first
+// offer. If the request has no Accept header, the first offer is chosen, and
+// if nothing is acceptable, the empty string is returned.
+func negotiate(req *http.Request, offers []string) string {
+	ranges := parseAccept(req.Header["Accept"])
+	if len(ranges) == 0 {
+		return offers[0]
+	}
+	var (
+		best                string
+		bestQ               float64
+		bestSpec, bestIndex int
+	)
+	for _, offer := range offers {
+		q, spec, index := 0.0, -1, 0
+		for _, r := range ranges {
+			if s := r.match(offer); s > spec {
+				q, spec, index = r.Q, s, r.Index
+			}
+		}
+		if spec < 0 || q == 0 {
+			continue
+		}
+		if best == "" || q > bestQ ||
+			(q == bestQ && (spec > bestSpec || (spec == bestSpec && index < bestIndex))) {
+			best, bestQ, bestSpec, bestIndex = offer, q, spec, index
+		}
+	}
+	return best
+}
+
+// acceptable reports whether a value with the given Content-Type may be sent
+// in response to req. Values without a Content-Type are always acceptable.
+func acceptable(req *http.Request, contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.Contains(mediaType, "/") {
+		return true
+	}
+	return negotiate(req, []string{mediaType}) != ""
+}
+
+// writeNotAcceptable writes a 406 response, listing the media types that are
+// available.
+func writeNotAcceptable(w http.ResponseWriter, offers []string) {
+	http.Error(w, "Not acceptable. Available types: "+strings.Join(offers, ", ")+".", http.StatusNotAcceptable)
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		Accept   []string
+		Expected string
+	}{
+		{Accept: nil, Expected: "text/plain"},
+		{Accept: []string{""}, Expected: "text/plain"},
+		{Accept: []string{"*/*"}, Expected: "text/plain"},
+		{Accept: []string{"text/*"}, Expected: "text/plain"},
+		{Accept: []string{"application/json"}, Expected: "application/json"},
+		{Accept: []string{"application/json;q=0.5, text/plain"}, Expected: "text/plain"},
+		{Accept: []string{"application/json, text/plain"}, Expected: "application/json"},
+		{Accept: []string{"text/*;q=0.5, application/*;q=0.7"}, Expected: "application/json"},
+		{Accept: []string{"text/*, text/plain;q=0"}, Expected: "text/html"},
+		{Accept: []string{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, Expected: "text/html"},
+		{Accept: []string{"application/json;q=0.1", "application/xml;q=0.2"}, Expected: "application/xml"},
+		{Accept: []string{"image/png"}, Expected: ""},
+		{Accept: []string{"*/*;q=0"}, Expected: ""},
+		{Accept: []string{"application/json;q=lots, text/html"}, Expected: "text/html"},
+	}
+	offers := []string{"text/plain", "application/json", "application/xml", "text/html"}
+	for i, test := range tests {
+		req := &http.Request{Header: http.Header{"Accept": test.Accept}}
+		if got, want := negotiate(req, offers), test.Expected; got != want {
+			t.Errorf("test %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestNotAcceptable(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	req, err := http.NewRequest("PUT", s.URL+"/foo", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Method, Path, Accept string
+		ExpectedCode         int
+	}{
+		{Method: "GET", Path: "/", Accept: "image/png", ExpectedCode: http.StatusNotAcceptable},
+		{Method: "GET", Path: "/?detail", Accept: "image/png", ExpectedCode: http.StatusNotAcceptable},
+		{Method: "GET", Path: "/?recursive", Accept: "text/html", ExpectedCode: http.StatusNotAcceptable},
+		{Method: "GET", Path: "/", Accept: "text/html;q=0.9, */*;q=0.1", ExpectedCode: http.StatusOK},
+		{Method: "GET", Path: "/foo", Accept: "application/json", ExpectedCode: http.StatusOK},
+		{Method: "GET", Path: "/foo", Accept: "application/*;q=0.5", ExpectedCode: http.StatusOK},
+		{Method: "GET", Path: "/foo", Accept: "text/plain", ExpectedCode: http.StatusNotAcceptable},
+		{Method: "HEAD", Path: "/foo", Accept: "text/plain", ExpectedCode: http.StatusNotAcceptable},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.Method, s.URL+test.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", test.Accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+		if got, want := resp.Header.Get("Vary"), "Accept"; test.Method == "GET" && got != want {
+			t.Errorf("test %d: bad Vary: got %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// errRangeNotSatisfiable is returned when a partial PUT would leave a gap in
+// a value, or disagrees with its length.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// isPartialPut reports whether req writes only part of a value, either with
+// a Content-Range, or at the end of the value with the "append" query
+// parameter.
+func isPartialPut(req *http.Request) bool {
+	_, ok := req.URL.Query()["append"]
+	return ok || req.Header.Get("Content-Range") != ""
+}
+
+// putPartial writes the request body into the value at the request path,
+// without replacing the rest of it. With a Content-Range, the body overwrites
+// the bytes in the range, which may extend the value but not leave a gap in
+// it. With the "append" query parameter, the body is added to the end of the
+// value, which is created if it doesn't exist.
+//
+// The value keeps its metadata and TTL, and gets a new ETag. Digests sent
+// with the request are checked against the body, not the whole value.
+func (s server) putPartial(w http.ResponseWriter, req *http.Request) {
+	if s.badPutOrDeleteHeaders(w, req) {
+		return
+	}
+	path := cleanPath(req.URL.EscapedPath())
+	if len(splitPath(path)) == 1 {
+		http.Error(w, "Cannot PUT a value in the root bucket.", http.StatusBadRequest)
+		return
+	}
+	_, appending := req.URL.Query()["append"]
+	first, last, length := int64(0), int64(-1), int64(-1)
+	if cr := req.Header.Get("Content-Range"); cr != "" {
+		if appending {
+			http.Error(w, "Can't append with a Content-Range.", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if first, last, length, err = parseContentRange(cr); err != nil {
+			http.Error(w, "Bad Content-Range.", http.StatusBadRequest)
+			return
+		}
+	}
+	hasher, err := s.newBodyHasher(req.Header)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	ttl, err := parseTTL(req.Header)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	body, err := readBody(req, s.maxValueSize())
+	if err == errTooLarge {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	if !appending && int64(len(body)) != last-first+1 {
+		http.Error(w, "Content-Range doesn't match the body.", http.StatusBadRequest)
+		return
+	}
+	hasher.Write(body)
+	if !hasher.verify() {
+		http.Error(w, "Digest mismatch.", http.StatusBadRequest)
+		return
+	}
+
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var (
+		header  http.Header
+		created bool
+	)
+	err = s.update(req, func(tx *bolt.Tx) error {
+		r, err := findResource(tx, path)
+		if err != nil {
+			return err
+		}
+		if r != nil && r.Collection {
+			msg, status = "Conflict.", http.StatusConflict
+			return errBadRequest
+		}
+		var (
+			oldHeader http.Header
+			content   io.ReaderAt
+			size      int64
+		)
+		metadata := s.extractHeader(req.Header)
+		if r != nil {
+			oldHeader, metadata = r.Header, s.extractHeader(r.Header)
+			parts := splitPath(path)
+			value := getBoltBucket(tx, parts[:len(parts)-1]).Get(parts[len(parts)-1])
+			if content, size, err = valueContent(tx, oldHeader, value); err != nil {
+				return err
+			}
+		}
+		if checkPreconditions(oldHeader, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		if appending {
+			first = size
+		}
+		end := first + int64(len(body))
+		if end < size {
+			end = size
+		}
+		if first > size || (length >= 0 && length != end) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			msg, status = "Range not satisfiable.", http.StatusRequestedRangeNotSatisfiable
+			return errRangeNotSatisfiable
+		}
+		if end > s.maxValueSize() {
+			msg, status = "Request too large.", http.StatusRequestEntityTooLarge
+			return errTooLarge
+		}
+		// Only now that the result is known to fit is the old content read.
+		buf := make([]byte, end)
+		if size > 0 {
+			if _, err := content.ReadAt(buf[:size], 0); err != nil {
+				return err
+			}
+		}
+		copy(buf[first:], body)
+
+		created = r == nil
+		header, err = s.rewriteValue(tx, path, buf, metadata, ttl, oldHeader)
+		if err == bolt.ErrIncompatibleValue {
+			msg, status = "Conflict.", http.StatusConflict
+		}
+		return err
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	writePutResponse(w, path, header, created)
+}
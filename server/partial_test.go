@@ -0,0 +1,179 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestPartialPut(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	s := httptest.NewServer(server{
+		db:  db,
+		cfg: config.Data{Storage: config.Storage{LargeObjectSize: 16, ChunkSize: 4}},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	resp, _ := do("PUT", "/logs/app?append", "one\n", map[string]string{"Content-Type": "text/plain", "TTL": "1h"})
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	eTag := resp.Header.Get("ETag")
+
+	tests := []struct {
+		Path         string
+		Body         string
+		Header       map[string]string
+		ExpectedCode int
+		Expected     string
+	}{
+		{Path: "/logs/app?append", Body: "two\n", Header: map[string]string{"If-Match": eTag}, ExpectedCode: http.StatusNoContent, Expected: "one\ntwo\n"},
+		{Path: "/logs/app?append", Body: "three\n", ExpectedCode: http.StatusNoContent, Expected: "one\ntwo\nthree\n"},
+		{Path: "/logs/app", Body: "ONE", Header: map[string]string{"Content-Range": "bytes 0-2/*"}, ExpectedCode: http.StatusNoContent, Expected: "ONE\ntwo\nthree\n"},
+		{Path: "/logs/app", Body: "THREE\nfour\n", Header: map[string]string{"Content-Range": "bytes 8-18/19"}, ExpectedCode: http.StatusNoContent, Expected: "ONE\ntwo\nTHREE\nfour\n"},
+		{Path: "/logs/app?append", Body: "x", Header: map[string]string{"If-Match": eTag}, ExpectedCode: http.StatusPreconditionFailed},
+		{Path: "/logs/app", Body: "x", Header: map[string]string{"Content-Range": "bytes 20-20/*"}, ExpectedCode: http.StatusRequestedRangeNotSatisfiable},
+		{Path: "/logs/app", Body: "x", Header: map[string]string{"Content-Range": "bytes 0-0/5"}, ExpectedCode: http.StatusRequestedRangeNotSatisfiable},
+		{Path: "/logs/app", Body: "xy", Header: map[string]string{"Content-Range": "bytes 0-0/*"}, ExpectedCode: http.StatusBadRequest},
+		{Path: "/logs/app?append", Body: "x", Header: map[string]string{"Content-Range": "bytes 0-0/*"}, ExpectedCode: http.StatusBadRequest},
+		{Path: "/logs/app?append", Body: "x", Header: map[string]string{"Content-MD5": "AAAAAAAAAAAAAAAAAAAAAA=="}, ExpectedCode: http.StatusBadRequest},
+		{Path: "/logs?append", Body: "x", ExpectedCode: http.StatusConflict},
+		{Path: "/logs/new", Body: "x", Header: map[string]string{"Content-Range": "bytes 1-1/*"}, ExpectedCode: http.StatusRequestedRangeNotSatisfiable},
+	}
+	for i, test := range tests {
+		resp, _ := do("PUT", test.Path, test.Body, test.Header)
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+			continue
+		}
+		if test.Expected == "" {
+			continue
+		}
+		resp, body := do("GET", "/logs/app", "", nil)
+		if body != test.Expected {
+			t.Errorf("test %d: bad body: got %q, want %q", i, body, test.Expected)
+		}
+		if got, want := resp.Header.Get("ETag"), etag([]byte(test.Expected)); got != want {
+			t.Errorf("test %d: bad ETag: got %q, want %q", i, got, want)
+		}
+		if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len(test.Expected)); got != want {
+			t.Errorf("test %d: bad Content-Length: got %q, want %q", i, got, want)
+		}
+	}
+
+	resp, _ = do("GET", "/logs/app", "", nil)
+	if got, want := resp.Header.Get("Content-Type"), "text/plain"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+	if resp.Header.Get("Expires-At") == "" {
+		t.Error("appended value lost its expiry")
+	}
+
+	// The value grew into a large object; shrinking it back frees its chunks.
+	do("PUT", "/logs/app", "small", nil)
+	if got, want := countChunks(t, db), 0; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+}
+
+func TestPartialPutLimit(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	s := httptest.NewServer(server{
+		db: db,
+		cfg: config.Data{
+			Limits:  config.Limits{MaxValueSize: 8, MaxObjectSize: 100},
+			Storage: config.Storage{LargeObjectSize: 4, ChunkSize: 4},
+		},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	put := func(path, body string, header map[string]string) int {
+		req, err := http.NewRequest("PUT", s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Large objects that fit in a value can be written in part.
+	put("/f/mid", "abcdef", nil)
+	if got, want := put("/f/mid?append", "g", nil), http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp, err := client.Get(s.URL + "/f/mid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), "abcdefg"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+
+	// Larger ones are refused before their content is read: with its chunks
+	// gone, the object can't be read, but the append is still too large.
+	put("/f/big", strings.Repeat("x", 20), nil)
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(chunkBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(chunkBucket)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []map[string]string{nil, {"Content-Range": "bytes 0-0/*"}}
+	for _, header := range tests {
+		path := "/f/big"
+		if header == nil {
+			path += "?append"
+		}
+		if got, want := put(path, "y", header), http.StatusRequestEntityTooLarge; got != want {
+			t.Errorf("%v: bad status: got %d, want %d", header, got, want)
+		}
+	}
+}
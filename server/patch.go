@@ -0,0 +1,463 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	jsonPatchType  = "application/json-patch+json"
+	mergePatchType = "application/merge-patch+json"
+
+	// acceptPatch lists the patch formats the server applies, for the
+	// Accept-Patch header.
+	acceptPatch = jsonPatchType + ", " + mergePatchType
+)
+
+var (
+	// errBadPatch is returned for patch documents that are malformed.
+	errBadPatch = errors.New("malformed patch")
+
+	// errPatchTarget is returned when a patch refers to a location that
+	// doesn't exist in the document.
+	errPatchTarget = errors.New("patch target not found")
+
+	// errPatchTest is returned when a JSON Patch "test" operation fails.
+	errPatchTest = errors.New("patch test failed")
+
+	// errNotJSON is returned when the value to be patched isn't a JSON
+	// document.
+	errNotJSON = errors.New("value is not JSON")
+)
+
+// patchOp is an operation of a JSON Patch. Value is nil if the operation has
+// no value, and "null" if its value is null.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// isJSONType reports whether contentType is JSON, including the structured
+// syntax suffix "+json".
+func isJSONType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// decodeJSON decodes a single JSON document. Numbers are kept as written.
+func decodeJSON(b []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON document")
+	}
+	return v, nil
+}
+
+// marshalJSON encodes v compactly, without escaping HTML.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, errBadPatch
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the reference token of an array element. "-" refers to
+// the element after the last one, and is only allowed if end is set.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, errPatchTarget
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !end) {
+		return 0, errPatchTarget
+	}
+	return i, nil
+}
+
+// jsonGet returns the value at tokens within doc.
+func jsonGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, t := range tokens {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, errPatchTarget
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, errPatchTarget
+		}
+	}
+	return doc, nil
+}
+
+// jsonAdd adds v at tokens within doc, and returns the new document. Array
+// elements are inserted, and object members are replaced.
+func jsonAdd(doc interface{}, tokens []string, v interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	last := len(tokens) == 1
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		if last {
+			c[tokens[0]] = v
+			return c, nil
+		}
+		child, ok := c[tokens[0]]
+		if !ok {
+			return nil, errPatchTarget
+		}
+		child, err := jsonAdd(child, tokens[1:], v)
+		c[tokens[0]] = child
+		return c, err
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(c), last)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		}
+		c[i], err = jsonAdd(c[i], tokens[1:], v)
+		return c, err
+	}
+	return nil, errPatchTarget
+}
+
+// jsonRemove removes the value at tokens within doc, and returns the new
+// document along with the value removed.
+func jsonRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errPatchTarget
+	}
+	last := len(tokens) == 1
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[tokens[0]]
+		if !ok {
+			return nil, nil, errPatchTarget
+		}
+		if last {
+			delete(c, tokens[0])
+			return c, child, nil
+		}
+		child, removed, err := jsonRemove(child, tokens[1:])
+		c[tokens[0]] = child
+		return c, removed, err
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(c), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := c[i]
+			return append(c[:i], c[i+1:]...), removed, nil
+		}
+		var removed interface{}
+		c[i], removed, err = jsonRemove(c[i], tokens[1:])
+		return c, removed, err
+	}
+	return nil, nil, errPatchTarget
+}
+
+// jsonEqual compares two JSON values, where numbers are equal if their
+// values are.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// applyJSONPatch applies a JSON Patch (RFC 6902) to doc. The operations are
+// applied in order, and if any of them fails, an error is returned.
+func applyJSONPatch(doc interface{}, patch []byte) (interface{}, error) {
+	var ops []patchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errBadPatch
+	}
+	for _, op := range ops {
+		if op.Path == nil {
+			return nil, errBadPatch
+		}
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, errBadPatch
+			}
+			if value, err = decodeJSON(op.Value); err != nil {
+				return nil, errBadPatch
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, errBadPatch
+			}
+			from, err := parsePointer(*op.From)
+			if err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				if strings.HasPrefix(*op.Path, *op.From+"/") {
+					return nil, errPatchTarget
+				}
+				if doc, value, err = jsonRemove(doc, from); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if value, err = jsonGet(doc, from); err != nil {
+				return nil, err
+			}
+			// The copy mustn't share any objects or arrays with the original.
+			b, _ := marshalJSON(value)
+			value, _ = decodeJSON(b)
+		case "remove":
+		default:
+			return nil, errBadPatch
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = jsonAdd(doc, path, value)
+		case "remove":
+			doc, _, err = jsonRemove(doc, path)
+		case "replace":
+			if _, err = jsonGet(doc, path); err == nil {
+				if len(path) == 0 {
+					doc = value
+				} else if doc, _, err = jsonRemove(doc, path); err == nil {
+					doc, err = jsonAdd(doc, path, value)
+				}
+			}
+		case "test":
+			var v interface{}
+			if v, err = jsonGet(doc, path); err == nil && !jsonEqual(v, value) {
+				err = errPatchTest
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to doc.
+func applyMergePatch(doc interface{}, patch []byte) (interface{}, error) {
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return nil, errBadPatch
+	}
+	return mergePatch(doc, p), nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// patch applies a JSON Patch or JSON Merge Patch to a value stored as JSON,
+// in a single transaction. The patched document is stored compactly, with a
+// new ETag and Last-Modified time. Unless the request gives a new TTL, the
+// value keeps the one it had.
+func (s server) patch(w http.ResponseWriter, req *http.Request) {
+	path := cleanPath(req.URL.EscapedPath())
+	if path == "/" {
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	var apply func(doc interface{}, patch []byte) (interface{}, error)
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case jsonPatchType:
+		apply = applyJSONPatch
+	case mergePatchType:
+		apply = applyMergePatch
+	default:
+		w.Header().Set("Accept-Patch", acceptPatch)
+		http.Error(w, "Unsupported media type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	ttl, err := parseTTL(req.Header)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	body, err := readBody(req, s.maxValueSize())
+	if err == errTooLarge {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var header http.Header
+	err = s.update(req, func(tx *bolt.Tx) error {
+		r, err := findResource(tx, path)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		if r.Collection {
+			w.Header().Set("Allow", allowedMethods)
+			msg, status = "Method not allowed.", http.StatusMethodNotAllowed
+			return errBadRequest
+		}
+		if checkPreconditions(r.Header, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		parts := splitPath(path)
+		content, err := readValue(tx, r.Header, getBoltBucket(tx, parts[:len(parts)-1]).Get(parts[len(parts)-1]))
+		if err != nil {
+			return err
+		}
+		doc, err := decodeJSON(content)
+		if err != nil || !isJSONType(r.Header.Get("Content-Type")) {
+			msg, status = "Value is not JSON.", http.StatusConflict
+			return errNotJSON
+		}
+
+		doc, err = apply(doc, body)
+		switch err {
+		case nil:
+		case errBadPatch:
+			msg, status = "Bad request.", http.StatusBadRequest
+			return err
+		case errPatchTarget:
+			msg, status = "Unprocessable entity.", http.StatusUnprocessableEntity
+			return err
+		case errPatchTest:
+			msg, status = "Conflict.", http.StatusConflict
+			return err
+		default:
+			return err
+		}
+		value, err := marshalJSON(doc)
+		if err != nil {
+			return err
+		}
+
+		header, err = s.rewriteValue(tx, path, value, s.extractHeader(r.Header), ttl, r.Header)
+		return err
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	writePutResponse(w, path, header, false)
+}
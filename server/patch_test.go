@@ -0,0 +1,244 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestApplyJSONPatch(t *testing.T) {
+	// Mostly the examples from RFC 6902, appendix A.
+	tests := []struct {
+		Doc      string
+		Patch    string
+		Expected string
+		Err      error
+	}{
+		{
+			Doc:      `{"foo": "bar"}`,
+			Patch:    `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			Expected: `{"baz":"qux","foo":"bar"}`,
+		},
+		{
+			Doc:      `{"foo": ["bar", "baz"]}`,
+			Patch:    `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			Expected: `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			Doc:      `{"foo": ["bar"]}`,
+			Patch:    `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			Expected: `{"foo":["bar",["abc","def"]]}`,
+		},
+		{
+			Doc:      `{"baz": "qux", "foo": "bar"}`,
+			Patch:    `[{"op": "remove", "path": "/baz"}]`,
+			Expected: `{"foo":"bar"}`,
+		},
+		{
+			Doc:      `{"foo": ["bar", "qux", "baz"]}`,
+			Patch:    `[{"op": "remove", "path": "/foo/1"}]`,
+			Expected: `{"foo":["bar","baz"]}`,
+		},
+		{
+			Doc:      `{"baz": "qux", "foo": "bar"}`,
+			Patch:    `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			Expected: `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			Doc:      `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			Patch:    `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			Expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			Doc:      `{"foo": ["all", "grass", "cows", "eat"]}`,
+			Patch:    `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			Expected: `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			Doc:      `{"foo": {"bar": [1]}}`,
+			Patch:    `[{"op": "copy", "from": "/foo/bar", "path": "/baz"}, {"op": "add", "path": "/baz/-", "value": 2}]`,
+			Expected: `{"baz":[1,2],"foo":{"bar":[1]}}`,
+		},
+		{
+			Doc:      `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			Patch:    `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2.0}]`,
+			Expected: `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{
+			Doc:   `{"baz": "qux"}`,
+			Patch: `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			Err:   errPatchTest,
+		},
+		{
+			Doc:      `{"/": 0, "m~n": 8}`,
+			Patch:    `[{"op": "replace", "path": "/m~0n", "value": null}, {"op": "remove", "path": "/~1"}]`,
+			Expected: `{"m~n":null}`,
+		},
+		{
+			Doc:   `{"foo": "bar"}`,
+			Patch: `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+			Err:   errPatchTarget,
+		},
+		{
+			Doc:   `{"foo": ["bar"]}`,
+			Patch: `[{"op": "add", "path": "/foo/01", "value": "qux"}]`,
+			Err:   errPatchTarget,
+		},
+		{
+			Doc:   `{"foo": {"bar": 1}}`,
+			Patch: `[{"op": "move", "from": "/foo", "path": "/foo/bar"}]`,
+			Err:   errPatchTarget,
+		},
+		{
+			Doc:   `{"foo": "bar"}`,
+			Patch: `[{"op": "add", "path": "/baz"}]`,
+			Err:   errBadPatch,
+		},
+		{
+			Doc:   `{"foo": "bar"}`,
+			Patch: `[{"op": "frob", "path": "/foo"}]`,
+			Err:   errBadPatch,
+		},
+		{
+			Doc:   `{"foo": "bar"}`,
+			Patch: `[{"op": "remove", "path": "foo"}]`,
+			Err:   errBadPatch,
+		},
+	}
+	for i, test := range tests {
+		doc, err := decodeJSON([]byte(test.Doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err = applyJSONPatch(doc, []byte(test.Patch))
+		if err != test.Err {
+			t.Errorf("test %d: bad error: got %v, want %v", i, err, test.Err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		b, err := marshalJSON(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), test.Expected; got != want {
+			t.Errorf("test %d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	// From RFC 7396, appendix A.
+	tests := []struct {
+		Doc      string
+		Patch    string
+		Expected string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a":"c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a":"b","b":"c"}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b":"c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a":"c"}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a":{"b":"d"}}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c","d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"e": null}`, `{"a": 1}`, `{"a":1,"e":null}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a":"b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for i, test := range tests {
+		doc, err := decodeJSON([]byte(test.Doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err = applyMergePatch(doc, []byte(test.Patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := marshalJSON(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), test.Expected; got != want {
+			t.Errorf("test %d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	resp, _ := do("PUT", "/state/svc", `{"replicas": 2, "tags": ["a"]}`, map[string]string{"Content-Type": "application/json", "TTL": "1h"})
+	eTag := resp.Header.Get("ETag")
+	do("PUT", "/state/text", `{"not": "json"}`, map[string]string{"Content-Type": "text/plain"})
+
+	jsonPatch := map[string]string{"Content-Type": jsonPatchType}
+	mergePatch := map[string]string{"Content-Type": mergePatchType}
+
+	tests := []struct {
+		Path         string
+		Body         string
+		Header       map[string]string
+		ExpectedCode int
+	}{
+		{Path: "/state/svc", Body: `{"replicas": 3}`, Header: map[string]string{"Content-Type": "application/json"}, ExpectedCode: http.StatusUnsupportedMediaType},
+		{Path: "/state/svc", Body: `{"replicas": 3}`, Header: map[string]string{"Content-Type": mergePatchType, "If-Match": "nope"}, ExpectedCode: http.StatusPreconditionFailed},
+		{Path: "/state/svc", Body: `[{"op": "test", "path": "/replicas", "value": 1}]`, Header: jsonPatch, ExpectedCode: http.StatusConflict},
+		{Path: "/state/svc", Body: `[{"op": "remove", "path": "/nope"}]`, Header: jsonPatch, ExpectedCode: http.StatusUnprocessableEntity},
+		{Path: "/state/svc", Body: `{"op": "remove"}`, Header: jsonPatch, ExpectedCode: http.StatusBadRequest},
+		{Path: "/state/text", Body: `{"not": "patched"}`, Header: mergePatch, ExpectedCode: http.StatusConflict},
+		{Path: "/state/nope", Body: `{}`, Header: mergePatch, ExpectedCode: http.StatusNotFound},
+		{Path: "/state", Body: `{}`, Header: mergePatch, ExpectedCode: http.StatusMethodNotAllowed},
+		{Path: "/state/svc", Body: `{"replicas": 3}`, Header: map[string]string{"Content-Type": mergePatchType, "If-Match": eTag}, ExpectedCode: http.StatusNoContent},
+		{Path: "/state/svc", Body: `[{"op": "test", "path": "/replicas", "value": 3}, {"op": "add", "path": "/tags/-", "value": "b"}]`, Header: jsonPatch, ExpectedCode: http.StatusNoContent},
+	}
+	for i, test := range tests {
+		resp, _ := do("PATCH", test.Path, test.Body, test.Header)
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+		if resp.StatusCode == http.StatusUnsupportedMediaType && resp.Header.Get("Accept-Patch") != acceptPatch {
+			t.Errorf("test %d: bad Accept-Patch: %q", i, resp.Header.Get("Accept-Patch"))
+		}
+	}
+
+	resp, body := do("GET", "/state/svc", "", nil)
+	if got, want := body, `{"replicas":3,"tags":["a","b"]}`; got != want {
+		t.Errorf("bad body: got %s, want %s", got, want)
+	}
+	if got, want := resp.Header.Get("ETag"), etag([]byte(body)); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+	if resp.Header.Get("Expires-At") == "" {
+		t.Error("patched value lost its expiry")
+	}
+}
@@ -0,0 +1,712 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
+)
+
+const (
+	// replicationSeqHeader is the response header field holding the change
+	// log sequence number that a snapshot is consistent with.
+	replicationSeqHeader = "Replication-Seq"
+
+	// replicationLagHeader is the response header field in which a follower
+	// reports its replication lag, in seconds.
+	replicationLagHeader = "Replication-Lag"
+
+	// readOnlyMethods are the methods a follower supports, as listed in the
+	// Allow header.
+	readOnlyMethods = "GET,HEAD,OPTIONS,PROPFIND"
+
+	// followWait is how long a follower asks the primary to wait for new
+	// changes before answering.
+	followWait = 30 * time.Second
+
+	// followRetry is how long a follower waits before trying again after
+	// failing to reach the primary.
+	followRetry = 5 * time.Second
+)
+
+// replicationBucket holds a follower's replication state: the sequence number
+// of the last change it applied from the primary's change log.
+var replicationBucket = append([]byte{0}, []byte("replication")...)
+
+var appliedKey = []byte("applied")
+
+// replicationEntry is a change log entry as sent to followers. For puts, it
+// carries the value's header and content as they were when the entry was
+// read, which may be newer than the change itself; a follower that applies
+// the entries in order ends up with the primary's data. A put without a
+// header is of a value that has since been deleted.
+//
+// Entries for the other kinds of change carry the state they left behind in
+// the same way: a bucket's versioning as "on" or "off", a resource's dead
+// properties, or a webhook, which is nil if it has been deleted.
+//
+// The content of a large object isn't sent in the entry. Object is its ID
+// instead, and the follower streams it into chunks of its own with a
+// "replication=object" request before applying the entry.
+type replicationEntry struct {
+	changeEvent
+	Header http.Header `json:"header,omitempty"`
+	Value  []byte      `json:"value,omitempty"`
+	Object string      `json:"object,omitempty"`
+
+	Versioning string          `json:"versioning,omitempty"`
+	Properties json.RawMessage `json:"properties,omitempty"`
+	Webhook    *webhook        `json:"webhook,omitempty"`
+
+	// object is the follower's copy of the large object.
+	object *manifest
+}
+
+// replicationLog is a page of the change log, as sent to followers. Next is
+// the sequence number to ask for next, and Last is the primary's latest.
+type replicationLog struct {
+	Entries []replicationEntry `json:"entries"`
+	Next    uint64             `json:"next"`
+	Last    uint64             `json:"last"`
+}
+
+// replicationStatus reports how far behind its primary a follower is.
+type replicationStatus struct {
+	Primary     string  `json:"primary,omitempty"`
+	Applied     uint64  `json:"applied"`
+	PrimarySeq  uint64  `json:"primary_seq"`
+	Behind      uint64  `json:"behind"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	LastContact string  `json:"last_contact,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// follower is the replication state of a server that follows a primary.
+type follower struct {
+	primary string
+	token   string
+	client  *http.Client
+
+	mu         sync.Mutex
+	applied    uint64
+	primarySeq uint64
+	caughtUp   bool
+	syncedAt   time.Time
+	contactAt  time.Time
+	err        error
+}
+
+// lag returns how long it has been since the follower was last known to have
+// every change from the primary. It is zero while the follower is caught up
+// and waiting for more.
+func (f *follower) lag(now time.Time) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.caughtUp {
+		return 0
+	}
+	return now.Sub(f.syncedAt)
+}
+
+func (f *follower) status(now time.Time) replicationStatus {
+	lag := f.lag(now)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := replicationStatus{
+		Primary:    f.primary,
+		Applied:    f.applied,
+		PrimarySeq: f.primarySeq,
+		LagSeconds: lag.Seconds(),
+	}
+	if f.primarySeq > f.applied {
+		st.Behind = f.primarySeq - f.applied
+	}
+	if !f.contactAt.IsZero() {
+		st.LastContact = f.contactAt.UTC().Format(time.RFC3339)
+	}
+	if f.err != nil {
+		st.Error = f.err.Error()
+	}
+	return st
+}
+
+// serveReplication serves the "replication" query parameter: "snapshot" for
+// a copy of the database, "log" for the change log with the content of the
+// values that changed, "object" for the content of a large object in the
+// log, and "status" for the server's replication status. All but the status
+// hold data, including webhook secrets and lock tokens, so they are only
+// served to followers that send the replication token.
+func (s server) serveReplication(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Query().Get("replication") {
+	case "snapshot":
+		if checkToken(w, req, s.cfg.Admin.ReplicationToken) {
+			s.writeSnapshot(w)
+		}
+	case "log":
+		if checkToken(w, req, s.cfg.Admin.ReplicationToken) {
+			s.writeReplicationLog(w, req)
+		}
+	case "object":
+		if checkToken(w, req, s.cfg.Admin.ReplicationToken) {
+			s.writeReplicationObject(w, req)
+		}
+	case "status":
+		s.writeReplicationStatus(w)
+	default:
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+	}
+}
+
+// writeSnapshot writes a consistent copy of the database, along with the
+// change log sequence number that it's consistent with. A follower that
+// bootstraps from it carries on from the next sequence number.
+func (s server) writeSnapshot(w http.ResponseWriter) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		w.Header().Set(replicationSeqHeader, strconv.FormatUint(tx.Bucket(changeBucket).Sequence(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		// The response has already started, so all that can be done is to
+		// cut it short.
+		log.Printf("couldn't write snapshot: %s", err)
+	}
+}
+
+// writeReplicationLog writes the change log from the sequence number in the
+// "since" query parameter, with the header and content of each value that
+// was put. If there are no changes yet, and the "wait" query parameter is
+// given, it waits for some.
+func (s server) writeReplicationLog(w http.ResponseWriter, req *http.Request) {
+	since, err := strconv.ParseUint(req.URL.Query().Get("since"), 10, 64)
+	var wait time.Duration
+	if _, ok := req.URL.Query()["wait"]; ok && err == nil {
+		wait, err = parseWait(req.URL.Query().Get("wait"))
+	}
+	if err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	watcher := watch(s.db, "/", false)
+	defer watcher.stop(s.db)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var page replicationLog
+	for {
+		err = s.db.View(func(tx *bolt.Tx) (err error) {
+			page, err = s.readReplicationLog(tx, since)
+			return err
+		})
+		if err != nil || len(page.Entries) > 0 || wait == 0 {
+			break
+		}
+		select {
+		case _, ok := <-watcher.events:
+			if ok {
+				continue
+			}
+		case <-timer.C:
+		case <-req.Context().Done():
+			return
+		}
+		break
+	}
+	if err == errCompacted {
+		http.Error(w, "Changes no longer available.", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(page)
+}
+
+// readReplicationLog returns the page of the replication log starting at
+// since. Pages hold at most as many entries as a listing, and stop early
+// rather than let their content exceed the largest value size.
+func (s server) readReplicationLog(tx *bolt.Tx, since uint64) (replicationLog, error) {
+	changes, next, err := readChanges(tx, "/", since, s.maxListKeys())
+	if err != nil {
+		return replicationLog{}, err
+	}
+	page := replicationLog{
+		Entries: make([]replicationEntry, 0, len(changes)),
+		Next:    next,
+		Last:    tx.Bucket(changeBucket).Sequence(),
+	}
+	var size int64
+	for _, e := range changes {
+		entry := replicationEntry{changeEvent: e}
+		switch e.Op {
+		case "versioning":
+			entry.Versioning = "off"
+			if tx.Bucket(versioningBucket).Get(bucketKey(splitPath(e.Path))) != nil {
+				entry.Versioning = "on"
+			}
+		case "properties":
+			if b := tx.Bucket(propertyBucket).Get([]byte(e.Path)); b != nil {
+				entry.Properties = append(json.RawMessage{}, b...)
+			}
+		case "create_webhook", "delete_webhook":
+			if entry.Webhook, err = getWebhook(tx, e.Hook); err != nil {
+				return replicationLog{}, err
+			}
+		}
+		if e.Op == "put" {
+			header, err := getHeaderValue(tx, e.Path)
+			if err != nil {
+				return replicationLog{}, err
+			}
+			if header != nil {
+				m, err := getManifest(header)
+				if err != nil {
+					return replicationLog{}, err
+				}
+				parts := splitPath(e.Path)
+				value := getBoltBucket(tx, parts[:len(parts)-1]).Get(parts[len(parts)-1])
+				if m != nil {
+					entry.Object = m.ID
+				} else if len(page.Entries) > 0 && size+int64(len(value)) > s.maxValueSize() {
+					page.Next = e.Seq
+					break
+				} else {
+					entry.Value = append([]byte{}, value...)
+					size += int64(len(value))
+				}
+				// Followers store large objects in chunks of their own.
+				header.Del(manifestHeader)
+				entry.Header = header
+			}
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	return page, nil
+}
+
+// writeReplicationObject writes the content of the large object at the
+// request path, if its ID is still the one in the "id" query parameter. If
+// the object has been replaced or deleted since, it is 404 Not Found; a
+// later entry in the log carries the change.
+func (s server) writeReplicationObject(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		path := cleanPath(req.URL.EscapedPath())
+		header, err := getHeaderValue(tx, path)
+		if err != nil {
+			return err
+		}
+		m, err := getManifest(header)
+		if err != nil {
+			return err
+		}
+		if m == nil || m.ID != id {
+			http.Error(w, "Not found.", http.StatusNotFound)
+			return nil
+		}
+		parts := splitPath(path)
+		content, size, err := valueContent(tx, header, getBoltBucket(tx, parts[:len(parts)-1]).Get(parts[len(parts)-1]))
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, err = io.Copy(w, io.NewSectionReader(content, 0, size))
+		return err
+	})
+	if err != nil {
+		// The response may have started, so all that can be done is to cut
+		// it short.
+		log.Printf("couldn't write object: %s", err)
+	}
+}
+
+func (s server) writeReplicationStatus(w http.ResponseWriter) {
+	var st replicationStatus
+	if s.follower != nil {
+		st = s.follower.status(time.Now())
+	} else {
+		err := s.db.View(func(tx *bolt.Tx) error {
+			st.Applied = tx.Bucket(changeBucket).Sequence()
+			st.PrimarySeq = st.Applied
+			return nil
+		})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(st)
+}
+
+// NewFollower returns a read-only server that replicates the database of the
+// bolt-server at primary, a URL such as "http://primary:8080". If dbName
+// doesn't exist, it is first bootstrapped from a snapshot of the primary's
+// database. The follower then tails the primary's change log, applying each
+// change to its own database in order.
+func NewFollower(dbName, primary string, cfg config.Data) (http.Handler, error) {
+	if alg := cfg.Storage.ETagAlgorithm; alg != "" && etagHashes[alg] == nil {
+		return nil, fmt.Errorf("unknown etag algorithm: %q", alg)
+	}
+	f := &follower{
+		primary: primary,
+		token:   cfg.Admin.ReplicationToken,
+		client:  &http.Client{Timeout: 2 * followWait},
+	}
+	var snapshotSeq uint64
+	bootstrapped := false
+	if _, err := os.Stat(dbName); os.IsNotExist(err) {
+		if snapshotSeq, err = f.bootstrap(dbName); err != nil {
+			return nil, fmt.Errorf("couldn't bootstrap from primary: %s", err)
+		}
+		bootstrapped = true
+	}
+	db, err := openDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(replicationBucket)
+		if err != nil {
+			return err
+		}
+		if bootstrapped {
+			f.applied = snapshotSeq
+			return bucket.Put(appliedKey, changeKey(snapshotSeq))
+		}
+		v := bucket.Get(appliedKey)
+		if v == nil {
+			return errors.New("database wasn't bootstrapped from a primary")
+		}
+		f.applied = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't read replication state: %s", err)
+	}
+	f.primarySeq = f.applied
+
+	s := server{db: db, csrf: len(cfg.CSRF.Key) == 32, cfg: cfg, follower: f}
+	go s.follow()
+	go s.collectOrphansEvery(time.Minute)
+	go s.compactChangesEvery(time.Minute)
+
+	return s.handler(), nil
+}
+
+// get sends a GET for the replication endpoint at url to the primary, with
+// the replication token.
+func (f *follower) get(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.token)
+	return client.Do(req)
+}
+
+// bootstrap downloads a snapshot of the primary's database to dbName, and
+// returns the change log sequence number that it's consistent with.
+func (f *follower) bootstrap(dbName string) (uint64, error) {
+	// Snapshots can take a while, so there is no timeout.
+	resp, err := f.get(http.DefaultClient, f.primary+"/?replication=snapshot")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("primary sent %s", resp.Status)
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get(replicationSeqHeader), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s: %q", replicationSeqHeader, resp.Header.Get(replicationSeqHeader))
+	}
+	tmp := dbName + ".bootstrap"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dbName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return seq, nil
+}
+
+// follow tails the primary's change log, forever. If the follower falls so
+// far behind that the changes it needs have been compacted away, it stops,
+// and has to be bootstrapped again.
+func (s server) follow() {
+	f := s.follower
+	for {
+		err := s.pull()
+		f.mu.Lock()
+		f.err = err
+		if err != nil {
+			f.caughtUp = false
+		}
+		f.mu.Unlock()
+		if err == errCompacted {
+			log.Printf("follower is too far behind %s to catch up; remove its database to bootstrap it again", f.primary)
+			return
+		}
+		if err != nil {
+			log.Printf("couldn't replicate from %s: %s", f.primary, err)
+			time.Sleep(followRetry)
+		}
+	}
+}
+
+// pull fetches a page of the primary's change log, and applies it in a single
+// transaction.
+func (s server) pull() error {
+	f := s.follower
+	f.mu.Lock()
+	since := f.applied + 1
+	f.mu.Unlock()
+
+	url := fmt.Sprintf("%s/?replication=log&since=%d&wait=%s", f.primary, since, followWait)
+	resp, err := f.get(f.client, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errCompacted
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary sent %s", resp.Status)
+	}
+	var page replicationLog
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return err
+	}
+	applied := since - 1
+	if page.Next > since {
+		applied = page.Next - 1
+	}
+	defer func() {
+		// Objects that were fetched but not applied are freed. Applied
+		// ones belong to their values.
+		for _, e := range page.Entries {
+			if e.object != nil {
+				s.freeChunks(e.object)
+			}
+		}
+	}()
+	for i := range page.Entries {
+		if err := s.fetchObject(&page.Entries[i]); err != nil {
+			return fmt.Errorf("couldn't fetch change %d: %s", page.Entries[i].Seq, err)
+		}
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range page.Entries {
+			if err := s.applyEntry(tx, e); err != nil {
+				return fmt.Errorf("couldn't apply change %d: %s", e.Seq, err)
+			}
+		}
+		return tx.Bucket(replicationBucket).Put(appliedKey, changeKey(applied))
+	})
+	if err != nil {
+		return err
+	}
+	for i := range page.Entries {
+		page.Entries[i].object = nil
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied, f.primarySeq, f.contactAt = applied, page.Last, now
+	f.caughtUp = applied >= page.Last
+	if f.caughtUp {
+		f.syncedAt = now
+	}
+	return nil
+}
+
+// fetchObject streams the content of the large object that e puts into chunks
+// of the follower's own, in a transaction per chunk as for any large object,
+// and sets e.object to their manifest. It does nothing if only the object's
+// metadata changed, or if the object has been replaced since the entry was
+// read.
+func (s server) fetchObject(e *replicationEntry) error {
+	if e.Object == "" {
+		return nil
+	}
+	if e.Metadata {
+		var same bool
+		err := s.db.View(func(tx *bolt.Tx) error {
+			header, err := getHeaderValue(tx, e.Path)
+			same = header != nil && header.Get("ETag") == e.Header.Get("ETag")
+			return err
+		})
+		if err != nil || same {
+			return err
+		}
+	}
+	f := s.follower
+	u := fmt.Sprintf("%s%s?replication=object&id=%s", f.primary, e.Path, url.QueryEscape(e.Object))
+	// Objects can take a while, so there is no timeout.
+	resp, err := f.get(http.DefaultClient, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary sent %s", resp.Status)
+	}
+	m, err := s.writeChunks(resp.Body, s.maxObjectSize())
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength >= 0 && m.Size != resp.ContentLength {
+		s.freeChunks(m)
+		return io.ErrUnexpectedEOF
+	}
+	e.object = m
+	return nil
+}
+
+// applyEntry applies a change from the primary's change log within tx.
+func (s server) applyEntry(tx *bolt.Tx, e replicationEntry) error {
+	r, err := findResource(tx, e.Path)
+	if err != nil {
+		return err
+	}
+	if e.Op == "put" && e.Header == nil {
+		// The value has since been deleted on the primary.
+		e.Op = "delete"
+	}
+	switch e.Op {
+	case "put":
+		if e.Metadata && r != nil && !r.Collection && r.Header.Get("ETag") == e.Header.Get("ETag") {
+			// Only the metadata changed, so the value, its chunks and its
+			// version history stay as they are.
+			header := e.Header
+			if m := r.Header.Get(manifestHeader); m != "" {
+				header.Set(manifestHeader, m)
+			}
+			if err := writeHeaderValue(tx, e.Path, header); err != nil {
+				return err
+			}
+			return recordChange(tx, e.changeEvent)
+		}
+		if r != nil && r.Collection {
+			if err := deleteTree(tx, e.Path); err != nil {
+				return err
+			}
+			r = nil
+		}
+		if e.Object != "" && e.object == nil {
+			// The object has been replaced or deleted on the primary since
+			// the entry was read, and a later entry carries the change.
+			return nil
+		}
+		var oldHeader http.Header
+		if r != nil {
+			oldHeader = r.Header
+		}
+		value := e.Value
+		if e.object != nil {
+			manifestJSON, _ := json.Marshal(e.object)
+			e.Header.Set(manifestHeader, string(manifestJSON))
+			value = []byte(e.object.ID)
+		} else if int64(len(value)) > s.largeObjectSize() {
+			m, err := s.putChunks(tx, value)
+			if err != nil {
+				return err
+			}
+			manifestJSON, _ := json.Marshal(m)
+			e.Header.Set(manifestHeader, string(manifestJSON))
+			value = []byte(m.ID)
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		return putValue(tx, e.Path, value, e.Header, oldHeader)
+	case "delete":
+		if r != nil && !r.Collection {
+			return deleteValue(tx, e.Path, r.Header)
+		}
+	case "create_bucket":
+		_, err := getOrCreateBoltBucket(tx, splitPath(e.Path))
+		return err
+	case "delete_bucket":
+		if r != nil && r.Collection {
+			return deleteTree(tx, e.Path)
+		}
+	case "versioning":
+		key := bucketKey(splitPath(e.Path))
+		if e.Versioning == "on" {
+			err = tx.Bucket(versioningBucket).Put(key, []byte("on"))
+		} else {
+			err = tx.Bucket(versioningBucket).Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+		return recordChange(tx, e.changeEvent)
+	case "properties":
+		if e.Properties != nil {
+			err = tx.Bucket(propertyBucket).Put([]byte(e.Path), e.Properties)
+		} else {
+			err = tx.Bucket(propertyBucket).Delete([]byte(e.Path))
+		}
+		if err != nil {
+			return err
+		}
+		return recordChange(tx, e.changeEvent)
+	case "create_webhook", "delete_webhook":
+		if e.Webhook != nil {
+			b, err := json.Marshal(e.Webhook)
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket(webhookBucket).Put([]byte(e.Hook), b)
+		} else {
+			err = tx.Bucket(webhookBucket).Delete([]byte(e.Hook))
+		}
+		if err != nil {
+			return err
+		}
+		return recordChange(tx, e.changeEvent)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestReplication(t *testing.T) {
+	t.Parallel()
+	cfg := config.Data{
+		Storage: config.Storage{LargeObjectSize: 8, ChunkSize: 4},
+		Admin:   config.Admin{ReplicationToken: "t0ken"},
+	}
+	primary := httptest.NewServer(server{db: getBoltDB(t), cfg: cfg})
+	defer func() {
+		// Cut off the follower's long poll, rather than waiting for it.
+		primary.CloseClientConnections()
+		primary.Close()
+	}()
+	client := &http.Client{}
+
+	do := func(method, url, body string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+	status := func(url string) replicationStatus {
+		_, body := do("GET", url+"/?replication=status", "", nil)
+		var st replicationStatus
+		if err := json.Unmarshal([]byte(body), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do("PUT", primary.URL+"/a/x", "before", nil)
+	do("PUT", primary.URL+"/empty", "", nil)
+
+	// The snapshot and the log hold secrets, so they need the token, and
+	// can't be had at all without one.
+	for _, path := range []string{"/?replication=snapshot", "/?replication=log&since=1"} {
+		for _, auth := range []string{"", "Bearer nope"} {
+			resp, _ := do("GET", primary.URL+path, "", map[string]string{"Authorization": auth})
+			if got, want := resp.StatusCode, http.StatusUnauthorized; got != want {
+				t.Errorf("%s %q: bad status: got %d, want %d", path, auth, got, want)
+			}
+		}
+	}
+	closed := httptest.NewServer(server{db: getBoltDB(t)})
+	defer closed.Close()
+	if resp, _ := do("GET", closed.URL+"/?replication=snapshot", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bad status: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if _, err := NewFollower(filepath.Join(td, "stranger.db"), primary.URL, config.Data{}); err == nil {
+		t.Error("follower without the token bootstrapped")
+	}
+
+	handler, err := NewFollower(filepath.Join(td, "follower.db"), primary.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := httptest.NewServer(handler)
+	defer follower.Close()
+
+	// The snapshot is there straight away.
+	resp, body := do("GET", follower.URL+"/a/x", "", nil)
+	if got, want := body, "before"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("ETag"), etag([]byte("before")); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+
+	do("PUT", primary.URL+"/a/x", "after", map[string]string{"Content-Type": "text/plain", "TTL": "1h"})
+	do("PUT", primary.URL+"/a/y", "a large value", nil)
+	do("PUT", primary.URL+"/a/gone", "soon", nil)
+	do("DELETE", primary.URL+"/a/gone", "", nil)
+	do("DELETE", primary.URL+"/empty", "", nil)
+	do("PUT", primary.URL+"/b", "", nil)
+
+	catchUp := func() {
+		last := status(primary.URL).Applied
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			st := status(follower.URL)
+			if st.Applied >= last && st.Behind == 0 {
+				if st.LagSeconds != 0 || st.Primary != primary.URL || st.Error != "" {
+					t.Errorf("bad status: %+v", st)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("follower didn't catch up: %+v", st)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	catchUp()
+
+	tests := []struct {
+		Path         string
+		ExpectedCode int
+		Expected     string
+	}{
+		{Path: "/a/x", ExpectedCode: http.StatusOK, Expected: "after"},
+		{Path: "/a/y", ExpectedCode: http.StatusOK, Expected: "a large value"},
+		{Path: "/a/gone", ExpectedCode: http.StatusNotFound},
+		{Path: "/empty", ExpectedCode: http.StatusNotFound},
+		{Path: "/b", ExpectedCode: http.StatusOK},
+	}
+	for i, test := range tests {
+		resp, body := do("GET", follower.URL+test.Path, "", nil)
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+			continue
+		}
+		if test.Expected != "" && body != test.Expected {
+			t.Errorf("test %d: bad body: got %q, want %q", i, body, test.Expected)
+		}
+	}
+
+	// Headers are replicated along with values.
+	primaryResp, _ := do("GET", primary.URL+"/a/x", "", nil)
+	resp, _ = do("GET", follower.URL+"/a/x", "", nil)
+	for _, k := range []string{"ETag", "Last-Modified", "Content-Type", "Expires-At"} {
+		if got, want := resp.Header.Get(k), primaryResp.Header.Get(k); got != want || want == "" {
+			t.Errorf("bad %s: got %q, want %q", k, got, want)
+		}
+	}
+	if resp.Header.Get(replicationLagHeader) == "" {
+		t.Errorf("missing %s", replicationLagHeader)
+	}
+
+	// So are changes to just the metadata, of small values and large ones.
+	for _, path := range []string{"/a/x", "/a/y"} {
+		resp, _ = do("PUT", primary.URL+path+"?metadata", "", map[string]string{"Content-Type": "application/json"})
+		if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+			t.Fatalf("bad status: got %d, want %d", got, want)
+		}
+	}
+	catchUp()
+	for _, path := range []string{"/a/x", "/a/y"} {
+		primaryResp, _ = do("GET", primary.URL+path, "", nil)
+		resp, body = do("GET", follower.URL+path, "", nil)
+		for _, k := range []string{"Content-Type", "Last-Modified", "ETag"} {
+			if got, want := resp.Header.Get(k), primaryResp.Header.Get(k); got != want {
+				t.Errorf("%s: bad %s: got %q, want %q", path, k, got, want)
+			}
+		}
+		if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+			t.Errorf("%s: bad Content-Type: got %q, want %q", path, got, want)
+		}
+		if path == "/a/y" && body != "a large value" {
+			t.Errorf("%s: bad body: got %q", path, body)
+		}
+	}
+	_, body = do("GET", primary.URL+"/a/x?changes&since="+strconv.FormatUint(status(primary.URL).Applied-1, 10), "", nil)
+	if !strings.Contains(body, `"metadata":true`) {
+		t.Errorf("metadata change not logged: %s", body)
+	}
+
+	// So are versioning, dead properties and webhooks.
+	props := func(update string) string {
+		return `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="http://example.com/ns">
+  <D:` + update + `><D:prop><Z:color>red</Z:color></D:prop></D:` + update + `>
+</D:propertyupdate>`
+	}
+	propfind := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:Z="http://example.com/ns"><D:prop><Z:color/></D:prop></D:propfind>`
+	do("PUT", primary.URL+"/a?versioning=on", "", nil)
+	do("PROPPATCH", primary.URL+"/a/x", props("set"), nil)
+	_, body = do("POST", primary.URL+"/a?webhooks", `{"url": "http://example.com/hook"}`, nil)
+	var hook webhook
+	if err := json.Unmarshal([]byte(body), &hook); err != nil {
+		t.Fatal(err)
+	}
+	catchUp()
+	if _, body := do("GET", follower.URL+"/a?versioning", "", nil); body != "on\n" {
+		t.Errorf("bad versioning: got %q", body)
+	}
+	if _, body := do("PROPFIND", follower.URL+"/a/x", propfind, map[string]string{"Depth": "0"}); !strings.Contains(body, "red") {
+		t.Errorf("property not replicated: %s", body)
+	}
+	if _, body := do("GET", follower.URL+"/a?webhooks", "", nil); !strings.Contains(body, hook.ID) {
+		t.Errorf("webhook not replicated: %s", body)
+	}
+	do("PUT", primary.URL+"/a?versioning=off", "", nil)
+	do("PROPPATCH", primary.URL+"/a/x", props("remove"), nil)
+	do("DELETE", primary.URL+"/a?webhooks="+hook.ID, "", nil)
+	catchUp()
+	if _, body := do("GET", follower.URL+"/a?versioning", "", nil); body != "off\n" {
+		t.Errorf("bad versioning: got %q", body)
+	}
+	if _, body := do("PROPFIND", follower.URL+"/a/x", propfind, map[string]string{"Depth": "0"}); strings.Contains(body, "red") {
+		t.Errorf("property removal not replicated: %s", body)
+	}
+	if _, body := do("GET", follower.URL+"/a?webhooks", "", nil); strings.Contains(body, hook.ID) {
+		t.Errorf("webhook removal not replicated: %s", body)
+	}
+
+	// Followers are read-only.
+	resp, _ = do("PUT", follower.URL+"/a/x", "nope", nil)
+	if got, want := resp.StatusCode, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Allow"), readOnlyMethods; got != want {
+		t.Errorf("bad Allow: got %q, want %q", got, want)
+	}
+
+	auth := map[string]string{"Authorization": "Bearer t0ken"}
+	resp, _ = do("GET", primary.URL+"/?replication=log&since=1", "", auth)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp, _ = do("GET", primary.URL+"/?replication=log", "", auth)
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	// Large objects are sent apart from the log, and only while they last.
+	_, body = do("GET", primary.URL+"/?replication=log&since=1", "", auth)
+	var page replicationLog
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatal(err)
+	}
+	var object string
+	for _, e := range page.Entries {
+		if e.Path == "/a/y" && e.Object != "" {
+			if e.Value != nil {
+				t.Errorf("large object sent in the log: %+v", e)
+			}
+			object = e.Object
+		}
+	}
+	if object == "" {
+		t.Fatalf("no large object in the log: %s", body)
+	}
+	resp, body = do("GET", primary.URL+"/a/y?replication=object&id="+object, "", auth)
+	if got, want := body, "a large value"; got != want {
+		t.Errorf("bad object: got %q, want %q", got, want)
+	}
+	tests = []struct {
+		Path         string
+		ExpectedCode int
+		Expected     string
+	}{
+		{Path: "/a/y?replication=object&id=nope", ExpectedCode: http.StatusNotFound},
+		{Path: "/a/x?replication=object&id=" + object, ExpectedCode: http.StatusNotFound},
+	}
+	for i, test := range tests {
+		if resp, _ := do("GET", primary.URL+test.Path, "", auth); resp.StatusCode != test.ExpectedCode {
+			t.Errorf("test %d: bad status: got %d, want %d", i, resp.StatusCode, test.ExpectedCode)
+		}
+	}
+	if resp, _ := do("GET", primary.URL+"/a/y?replication=object&id="+object, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad status: got %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestReplicationLogPages(t *testing.T) {
+	t.Parallel()
+	srv := server{db: getBoltDB(t), cfg: config.Data{Limits: config.Limits{MaxValueSize: 10}}}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	for _, path := range []string{"/p/a", "/p/b", "/p/c"} {
+		req, err := http.NewRequest("PUT", s.URL+path, strings.NewReader("123456"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// A page stops before the value that would take it over the limit, but
+	// always holds at least one entry.
+	tests := []struct {
+		Since   uint64
+		Entries int
+		Next    uint64
+	}{
+		{1, 2, 3},
+		{3, 1, 4},
+		{4, 1, 5},
+	}
+	for _, test := range tests {
+		err := srv.db.View(func(tx *bolt.Tx) error {
+			page, err := srv.readReplicationLog(tx, test.Since)
+			if err != nil {
+				return err
+			}
+			if len(page.Entries) != test.Entries || page.Next != test.Next {
+				t.Errorf("since %d: got %d entries and next %d, want %d and %d", test.Since, len(page.Entries), page.Next, test.Entries, test.Next)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFollowerNeedsBootstrap(t *testing.T) {
+	t.Parallel()
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(td, "bolt.db")
+	db, err := openDB(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := NewFollower(fp, "http://127.0.0.1:1", config.Data{}); err == nil {
+		t.Error("expected an error following with a database that wasn't bootstrapped")
+	}
+}
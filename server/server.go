@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/echlebek/bolt-server/config"
@@ -20,20 +22,89 @@ var (
 	headerFieldsToExtract = []string{
 		"Content-Type",
 		"Content-Length",
+		"Cache-Control",
+		"Content-Disposition",
+		"Content-Language",
+		"Content-Encoding",
+		"Expires",
+		"X-Meta-*",
 	}
-	errBadRequest = errors.New("bad request")
+	errBadRequest         = errors.New("bad request")
+	errPreconditionFailed = errors.New("precondition failed")
+	errTooLarge           = errors.New("request too large")
+	errNotFound           = errors.New("not found")
+	errNotAcceptable      = errors.New("not acceptable")
 )
 
+// internalHeaderPrefix starts the names of stored header fields that are only
+// for the server's own use. They are never sent to clients, except as listed
+// in publicHeaders.
+const internalHeaderPrefix = "Bolt-"
+
+// publicHeaders maps the internal header fields that are sent to clients to
+// the names they are sent under.
+var publicHeaders = map[string]string{
+	versionHeader: "Version-Id",
+	expiresHeader: "Expires-At",
+}
+
+// allowedMethods are the methods the server supports, as listed in the Allow
+// header.
+const allowedMethods = "GET,PUT,POST,PATCH,DELETE,HEAD,OPTIONS,PROPFIND,PROPPATCH,MKCOL,COPY,MOVE,LOCK,UNLOCK"
+
+// defaultMaxValueSize is the largest value that can be stored when the config
+// doesn't specify a limit.
+const defaultMaxValueSize = 1 << 24
+
+// defaultMaxObjectSize is the largest large object that can be stored when
+// the config doesn't specify a limit.
+const defaultMaxObjectSize = 1 << 30
+
 type server struct {
 	db   *bolt.DB
 	csrf bool
+	cfg  config.Data
+
+	// follower is set when the server is a read-only replica of a primary.
+	follower *follower
 }
 
 func logRequest(req *http.Request) {
 	log.Println(req.Method, req.URL.Path)
 }
 
-func New(dbName string, cfg config.Data) (http.Handler, error) {
+func (s server) maxValueSize() int64 {
+	if s.cfg.Limits.MaxValueSize > 0 {
+		return s.cfg.Limits.MaxValueSize
+	}
+	return defaultMaxValueSize
+}
+
+// maxObjectSize is the size of the largest large object. It is never less
+// than maxValueSize.
+func (s server) maxObjectSize() int64 {
+	size := int64(defaultMaxObjectSize)
+	if s.cfg.Limits.MaxObjectSize > 0 {
+		size = s.cfg.Limits.MaxObjectSize
+	}
+	if size < s.maxValueSize() {
+		return s.maxValueSize()
+	}
+	return size
+}
+
+// maxPutSize is the size of the largest body a PUT can store: that of a large
+// object, if values can be large enough to be stored as large objects.
+func (s server) maxPutSize() int64 {
+	if s.largeObjectSize() < s.maxValueSize() {
+		return s.maxObjectSize()
+	}
+	return s.maxValueSize()
+}
+
+// openDB opens the database at dbName, creating the buckets that the server
+// needs if they don't exist yet.
+func openDB(dbName string) (*bolt.DB, error) {
 	db, err := bolt.Open(dbName, 0600, nil)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open bolt db: %s", err)
@@ -44,14 +115,61 @@ func New(dbName string, cfg config.Data) (http.Handler, error) {
 	if err := createRootBucketIfNotExists(db); err != nil {
 		return nil, fmt.Errorf("couldn't create root bucket: %s", err)
 	}
+	if err := createChunkBucketIfNotExists(db); err != nil {
+		return nil, fmt.Errorf("couldn't create chunk bucket: %s", err)
+	}
+	if err := createUploadBucketIfNotExists(db); err != nil {
+		return nil, fmt.Errorf("couldn't create upload bucket: %s", err)
+	}
+	if err := createVersionBucketsIfNotExist(db); err != nil {
+		return nil, fmt.Errorf("couldn't create version buckets: %s", err)
+	}
+	if err := createExpiryBucketIfNotExists(db); err != nil {
+		return nil, fmt.Errorf("couldn't create expiry bucket: %s", err)
+	}
+	if err := createPropertyBucketIfNotExists(db); err != nil {
+		return nil, fmt.Errorf("couldn't create property bucket: %s", err)
+	}
+	if err := createLockBucketIfNotExists(db); err != nil {
+		return nil, fmt.Errorf("couldn't create lock bucket: %s", err)
+	}
+	if err := createChangeBucketIfNotExists(db); err != nil {
+		return nil, fmt.Errorf("couldn't create change bucket: %s", err)
+	}
+	if err := createWebhookBucketsIfNotExist(db); err != nil {
+		return nil, fmt.Errorf("couldn't create webhook buckets: %s", err)
+	}
+	return db, nil
+}
 
-	var handler http.Handler = server{db: db, csrf: len(cfg.CSRF.Key) == 32}
+func New(dbName string, cfg config.Data) (http.Handler, error) {
+	if alg := cfg.Storage.ETagAlgorithm; alg != "" && etagHashes[alg] == nil {
+		return nil, fmt.Errorf("unknown etag algorithm: %q", alg)
+	}
+	db, err := openDB(dbName)
+	if err != nil {
+		return nil, err
+	}
 
-	if len(cfg.CSRF.Key) == 32 {
-		handler = csrf.Protect([]byte(cfg.CSRF.Key))(handler)
+	s := server{db: db, csrf: len(cfg.CSRF.Key) == 32, cfg: cfg}
+	go s.expireUploadsEvery(time.Minute)
+	go s.collectOrphansEvery(time.Minute)
+	go s.sweepExpiredEvery(time.Minute)
+	go s.compactChangesEvery(time.Minute)
+	go s.deliverWebhooksEvery(time.Second)
+
+	return s.handler(), nil
+}
+
+// handler returns s, wrapped in CSRF protection if it's configured.
+func (s server) handler() http.Handler {
+	var handler http.Handler = s
+
+	if len(s.cfg.CSRF.Key) == 32 {
+		handler = csrf.Protect([]byte(s.cfg.CSRF.Key))(handler)
 	}
 
-	return handler, nil
+	return handler
 }
 
 func (s server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -64,19 +182,118 @@ func (s server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if s.follower != nil {
+		lag := s.follower.lag(time.Now())
+		w.Header().Set(replicationLagHeader, strconv.FormatFloat(lag.Seconds(), 'f', 3, 64))
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		default:
+			w.Header().Set("Allow", readOnlyMethods)
+			http.Error(w, "Method not allowed on a follower.", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	if !s.checkLocks(w, req) {
+		return
+	}
+
+	if _, ok := req.URL.Query()["upload"]; ok {
+		s.serveUpload(w, req)
+		return
+	}
+	if isVersionRequest(req) {
+		s.serveVersions(w, req)
+		return
+	}
+	if _, ok := req.URL.Query()["webhooks"]; ok {
+		s.serveWebhooks(w, req)
+		return
+	}
+
 	switch req.Method {
 	case "HEAD":
 		s.getHeader(w, req)
 	case "OPTIONS":
-		w.Header().Set("Allow", "GET,PUT,DELETE,HEAD")
+		if s.follower != nil {
+			w.Header().Set("Allow", readOnlyMethods)
+			w.Header().Set("DAV", "1")
+			break
+		}
+		w.Header().Set("Allow", allowedMethods)
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("Accept-Patch", acceptPatch)
 	case "GET":
+		if _, ok := req.URL.Query()["replication"]; ok {
+			s.serveReplication(w, req)
+			return
+		}
+		if _, ok := req.URL.Query()["backup"]; ok {
+			s.backup(w, req)
+			return
+		}
+		if _, ok := req.URL.Query()["changes"]; ok {
+			s.getChanges(w, req)
+			return
+		}
+		if _, ok := req.URL.Query()["watch"]; ok {
+			s.streamChanges(w, req)
+			return
+		}
+		if _, ok := req.URL.Query()["wait"]; ok {
+			s.waitForChange(w, req)
+			return
+		}
 		s.getBucketOrValue(w, req)
 	case "PUT":
+		if _, ok := req.URL.Query()["metadata"]; ok {
+			s.putMetadata(w, req)
+			return
+		}
+		if isPartialPut(req) {
+			s.putPartial(w, req)
+			return
+		}
 		s.putBucketOrValue(w, req)
 	case "DELETE":
 		s.deleteBucketOrKey(w, req)
-	case "POST", "PATCH", "TRACE", "CONNECT":
-		w.Header().Set("Allow", "GET,PUT,DELETE,HEAD")
+	case "POST":
+		if _, ok := req.URL.Query()["uploads"]; ok {
+			s.createUpload(w, req)
+			return
+		}
+		if _, ok := req.URL.Query()["batch"]; ok {
+			s.batch(w, req)
+			return
+		}
+		if _, ok := isCopyRequest(req); ok {
+			s.copyOrMove(w, req)
+			return
+		}
+		if step, ok, err := counterStep(req.URL.Query()); err != nil {
+			http.Error(w, "Bad request.", http.StatusBadRequest)
+			return
+		} else if ok {
+			s.count(w, req, step)
+			return
+		}
+		s.postSequence(w, req)
+	case "PROPFIND":
+		s.propfind(w, req)
+	case "PROPPATCH":
+		s.proppatch(w, req)
+	case "MKCOL":
+		s.mkcol(w, req)
+	case "COPY", "MOVE":
+		s.copyOrMove(w, req)
+	case "LOCK":
+		s.lock(w, req)
+	case "UNLOCK":
+		s.unlock(w, req)
+	case "PATCH":
+		s.patch(w, req)
+	case "TRACE", "CONNECT":
+		w.Header().Set("Allow", allowedMethods)
 		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
 	default:
 		http.Error(w, "Bad request.", http.StatusBadRequest)
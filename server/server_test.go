@@ -5,10 +5,16 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
@@ -18,6 +24,7 @@ import (
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
 	"github.com/gorilla/csrf"
 )
 
@@ -41,6 +48,30 @@ func getBoltDB(t *testing.T) *bolt.DB {
 	if err := createRootBucketIfNotExists(db); err != nil {
 		t.Fatal(err)
 	}
+	if err := createChunkBucketIfNotExists(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := createUploadBucketIfNotExists(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := createVersionBucketsIfNotExist(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := createExpiryBucketIfNotExists(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := createPropertyBucketIfNotExists(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := createLockBucketIfNotExists(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := createChangeBucketIfNotExists(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := createWebhookBucketsIfNotExist(db); err != nil {
+		t.Fatal(err)
+	}
 	return db
 }
 
@@ -243,25 +274,29 @@ func TestRange(t *testing.T) {
 	}
 
 	tests := []struct {
-		Range         string
-		Expected      string
-		ExpectedError string
-		ExpectedCode  int
+		Range                string
+		Expected             string
+		ExpectedError        string
+		ExpectedCode         int
+		ExpectedContentRange string
 	}{
 		{
-			Range:        "bytes=0-2",
-			Expected:     "foo",
-			ExpectedCode: http.StatusPartialContent,
+			Range:                "bytes=0-2",
+			Expected:             "foo",
+			ExpectedCode:         http.StatusPartialContent,
+			ExpectedContentRange: "bytes 0-2/9",
 		},
 		{
-			Range:        "bytes=1-2,4-5",
-			Expected:     "ooar",
-			ExpectedCode: http.StatusPartialContent,
+			Range:                "bytes=1-2,2-5",
+			Expected:             "oobar",
+			ExpectedCode:         http.StatusPartialContent,
+			ExpectedContentRange: "bytes 1-5/9",
 		},
 		{
-			Range:        "bytes=2-1000",
-			Expected:     "Requested range not satisfiable.\n",
-			ExpectedCode: http.StatusRequestedRangeNotSatisfiable,
+			Range:                "bytes=2-1000",
+			Expected:             "Requested range not satisfiable.\n",
+			ExpectedCode:         http.StatusRequestedRangeNotSatisfiable,
+			ExpectedContentRange: "bytes */9",
 		},
 		{
 			Range:        "runes=2-3",
@@ -279,6 +314,9 @@ func TestRange(t *testing.T) {
 		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
 			t.Errorf("range test %d: bad status: got %d, want %d", i, got, want)
 		}
+		if got, want := resp.Header.Get("Content-Range"), test.ExpectedContentRange; got != want {
+			t.Errorf("range test %d: bad Content-Range: got %q, want %q", i, got, want)
+		}
 		b, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			t.Fatal(err)
@@ -289,6 +327,84 @@ func TestRange(t *testing.T) {
 	}
 }
 
+func TestMultipleRanges(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	req, err := http.NewRequest("PUT", s.URL+"/foo", strings.NewReader("foobarbaz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest("GET", s.URL+"/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=1-2,4-5,-1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := resp.StatusCode, http.StatusPartialContent; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mediaType, "multipart/byteranges"; got != want {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, want)
+	}
+
+	want := []struct {
+		ContentRange string
+		Body         string
+	}{
+		{"bytes 1-2/9", "oo"},
+		{"bytes 4-5/9", "ar"},
+		{"bytes 8-8/9", "z"},
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("bad number of parts: got %d, want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			t.Fatalf("too many parts")
+		}
+		if got, want := part.Header.Get("Content-Type"), "text/plain"; got != want {
+			t.Errorf("part %d: bad Content-Type: got %q, want %q", i, got, want)
+		}
+		if got, want := part.Header.Get("Content-Range"), want[i].ContentRange; got != want {
+			t.Errorf("part %d: bad Content-Range: got %q, want %q", i, got, want)
+		}
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), want[i].Body; got != want {
+			t.Errorf("part %d: bad body: got %q, want %q", i, got, want)
+		}
+	}
+}
+
 func TestIfMatch(t *testing.T) {
 	s := newServer(t)
 	defer s.Close()
@@ -416,6 +532,218 @@ func TestIfNoneMatch(t *testing.T) {
 	}
 }
 
+func TestChunkedPut(t *testing.T) {
+	t.Parallel()
+	s := httptest.NewServer(server{
+		db:  getBoltDB(t),
+		cfg: config.Data{Limits: config.Limits{MaxValueSize: 16}},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	tests := []struct {
+		Body         string
+		ExpectedCode int
+	}{
+		{
+			Body:         "foobarbaz",
+			ExpectedCode: http.StatusCreated,
+		},
+		{
+			Body:         "foobarbazfoobarbaz",
+			ExpectedCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for i, test := range tests {
+		// Hiding the strings.Reader stops the client from setting Content-Length.
+		body := struct{ io.Reader }{strings.NewReader(test.Body)}
+		req, err := http.NewRequest("PUT", s.URL+"/foo", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+	}
+
+	resp, err := client.Get(s.URL + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "foobarbaz"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Length"), "9"; got != want {
+		t.Errorf("bad Content-Length: got %q, want %q", got, want)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	put := func(ifMatch string) (*bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "PUT /foo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\nExpect: 100-continue\r\n")
+		if ifMatch != "" {
+			fmt.Fprintf(conn, "If-Match: %s\r\n", ifMatch)
+		}
+		fmt.Fprintf(conn, "\r\n")
+		return bufio.NewReader(conn), conn
+	}
+
+	r, conn := put("")
+	defer conn.Close()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := line, "HTTP/1.1 100 Continue\r\n"; got != want {
+		t.Fatalf("bad status line: got %q, want %q", got, want)
+	}
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "foobar")
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	// A failing precondition is reported without asking for the body.
+	r, conn = put("foo")
+	defer conn.Close()
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusPreconditionFailed; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	req, err := http.NewRequest("PUT", s.URL+"/foo", strings.NewReader("foobar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Cache-Control", "max-age=60")
+	req.Header.Set("X-Meta-Owner", "alice")
+	req.Header.Set("X-Other", "dropped")
+	req.Header.Set(manifestHeader, "dropped")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eTag := resp.Header.Get("ETag")
+
+	resp, err = client.Head(s.URL + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":  "text/plain",
+		"Cache-Control": "max-age=60",
+		"X-Meta-Owner":  "alice",
+		"X-Other":       "",
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Errorf("bad %s: got %q, want %q", k, got, want)
+		}
+	}
+
+	// Replace the metadata without touching the content.
+	req, err = http.NewRequest("PUT", s.URL+"/foo?metadata", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Meta-Owner", "bob")
+	req.Header.Set("If-Match", eTag)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	resp, err = client.Get(s.URL + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "foobar"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":   "application/octet-stream",
+		"Content-Length": "6",
+		"Cache-Control":  "",
+		"X-Meta-Owner":   "bob",
+		"ETag":           eTag,
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Errorf("bad %s: got %q, want %q", k, got, want)
+		}
+	}
+
+	req, err = http.NewRequest("PUT", s.URL+"/bar?metadata", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+}
+
+func TestMetadataAllowlist(t *testing.T) {
+	t.Parallel()
+	s := server{cfg: config.Data{Metadata: config.Metadata{
+		Headers: []string{"content-type", "x-custom-*"},
+	}}}
+	h := make(http.Header)
+	h.Set("Content-Type", "text/plain")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Custom-Foo", "foo")
+	h.Set("X-Meta-Foo", "foo")
+	got := s.extractHeader(h)
+	want := http.Header{
+		"Content-Type": {"text/plain"},
+		"X-Custom-Foo": {"foo"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad header: got %v, want %v", got, want)
+	}
+}
+
 func TestDisallowedMethods(t *testing.T) {
 	s := newServer(t)
 	defer s.Close()
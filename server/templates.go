@@ -18,6 +18,7 @@ var keysTmpl = template.Must(template.New("keys").Funcs(funcs).Parse(keysTemplat
 type KeyPkg struct {
 	Path string
 	Keys []string
+	Next string
 }
 
 const keysTemplate = `<html>
@@ -51,7 +52,54 @@ const keysTemplate = `<html>
 			</ul>
 			{{ else }}
 				<div class="info"><h3>Empty bucket.</h3></div>
-			{{ end }}
+			{{ end }}{{ if .Next }}<div class="next"><a href="{{ .Next }}">More</a></div>{{ end }}
+		</div>
+	</body>
+</html>`
+
+var entriesTmpl = template.Must(template.New("entries").Funcs(funcs).Parse(entriesTemplate))
+
+type EntryPkg struct {
+	Path    string
+	Entries []Entry
+	Next    string
+}
+
+const entriesTemplate = `<html>
+	<head>
+		<meta charset="UTF-8">
+		<style>
+		.body {
+			padding: 10px;
+			font-family: sans-serif;
+		}
+		h3 {
+			font-weight: normal;
+		}
+		td, th {
+			padding: 2px 10px 2px 0;
+			text-align: left;
+		}
+		</style>
+		<title>{{ .Path }}</title>
+	</head>
+	<body>
+		<div class="body">
+			<div class="title"><h3>{{ .Path }}</h3></div>
+			{{ if .Entries }}
+			<table>
+				<tr><th>Name</th><th>Size</th><th>Type</th><th>ETag</th><th>Last Modified</th></tr>
+				{{ range .Entries }}
+				{{ if eq .Kind "bucket" }}
+				<tr><td><a href="{{ Join $.Path .Name }}/">{{ .Name }}/</a></td><td></td><td></td><td></td><td></td></tr>
+				{{ else }}
+				<tr><td><a href="{{ Join $.Path .Name }}">{{ .Name }}</a></td><td>{{ .Size }}</td><td>{{ .ContentType }}</td><td>{{ .ETag }}</td><td>{{ .LastModified }}</td></tr>
+				{{ end }}
+				{{ end }}
+			</table>
+			{{ else }}
+				<div class="info"><h3>Empty bucket.</h3></div>
+			{{ end }}{{ if .Next }}<div class="next"><a href="{{ .Next }}">More</a></div>{{ end }}
 		</div>
 	</body>
 </html>`
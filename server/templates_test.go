@@ -19,3 +19,18 @@ func TestKeysTemplate(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestEntriesTemplate(t *testing.T) {
+	t.Parallel()
+	data := &EntryPkg{
+		Path: "foo",
+		Entries: []Entry{
+			{Name: "foo", Kind: "bucket"},
+			{Name: "bar", Kind: "value", Size: 3, ContentType: "text/plain"},
+		},
+		Next: "/foo?after=bar",
+	}
+	if err := entriesTmpl.Execute(ioutil.Discard, data); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// parseTreeOptions reads the recursive and depth query parameters. A depth of
+// zero means that the whole tree is walked.
+func parseTreeOptions(query url.Values) (recursive bool, depth int, err error) {
+	if _, ok := query["recursive"]; !ok {
+		return false, 0, nil
+	}
+	if v := query.Get("depth"); v != "" {
+		depth, err = strconv.Atoi(v)
+		if err != nil || depth <= 0 {
+			return false, 0, errBadRequest
+		}
+	}
+	return true, depth, nil
+}
+
+// walkTree calls fn with the full path of every key in bucket and its
+// sub-buckets, depth first and in byte order. Buckets are visited before their
+// contents, and sub is nil for values. Only depth levels of buckets are
+// walked, unless depth is zero.
+func walkTree(bucket *bolt.Bucket, path string, depth int, fn func(path string, sub *bolt.Bucket) error) error {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	return bucket.ForEach(func(k, v []byte) error {
+		sub := bucket.Bucket(k)
+		if err := fn(prefix+string(k), sub); err != nil {
+			return err
+		}
+		if sub != nil && depth != 1 {
+			return walkTree(sub, prefix+string(k), depth-1, fn)
+		}
+		return nil
+	})
+}
+
+// buildTree returns the entries of bucket, which is at path, with the entries
+// of its sub-buckets nested inside them, down to the given depth. Details of
+// values are only included if detail is set. Expired values are left out.
+func buildTree(tx *bolt.Tx, bucket *bolt.Bucket, path string, depth int, detail bool) ([]Entry, error) {
+	var entries []Entry
+	hide := hideExpired(tx, bucket, path, time.Now())
+	err := bucket.ForEach(func(k, v []byte) error {
+		if hidden, err := hide(k); err != nil || hidden {
+			return err
+		}
+		e := Entry{Name: string(k), Kind: "value"}
+		if v == nil {
+			e.Kind = "bucket"
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if detail {
+		keys := make([]string, len(entries))
+		for i := range entries {
+			keys[i] = entries[i].Name
+		}
+		if entries, err = describeKeys(tx, bucket, path, keys); err != nil {
+			return nil, err
+		}
+	}
+	if depth == 1 {
+		return entries, nil
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for i := range entries {
+		if entries[i].Kind != "bucket" {
+			continue
+		}
+		sub := bucket.Bucket([]byte(entries[i].Name))
+		children, err := buildTree(tx, sub, prefix+entries[i].Name, depth-1, detail)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Children = children
+	}
+	return entries, nil
+}
+
+// treeTypes are the media types that recursive listings are available in, in
+// the order the server prefers them.
+var treeTypes = []string{"text/plain", "application/json", "application/xml"}
+
+// writeTree writes a recursive listing of bucket, which is at path. JSON and
+// XML listings are nested, and plain text listings are a flat list of full
+// paths, where the paths of buckets end with a slash. Flat listings are
+// written as the tree is walked, so they can be arbitrarily large.
+func writeTree(w http.ResponseWriter, req *http.Request, tx *bolt.Tx, bucket *bolt.Bucket, path string, depth int) error {
+	_, detail := req.URL.Query()["detail"]
+	w.Header().Add("Vary", "Accept")
+	mediaType := negotiate(req, treeTypes)
+	if mediaType == "" {
+		writeNotAcceptable(w, treeTypes)
+		return nil
+	}
+	if mediaType != "text/plain" {
+		entries, err := buildTree(tx, bucket, path, depth, detail)
+		if err != nil {
+			return err
+		}
+		if entries == nil {
+			entries = []Entry{}
+		}
+		if mediaType == "application/json" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			return json.NewEncoder(w).Encode(entries)
+		}
+		type tree struct {
+			XMLName xml.Name `xml:"bucket"`
+			Entries []Entry
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		if _, err := w.Write([]byte(xml.Header)); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		return enc.Encode(tree{Entries: entries})
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	now := time.Now()
+	return walkTree(bucket, path, depth, func(path string, sub *bolt.Bucket) error {
+		if sub != nil {
+			path += "/"
+		} else if header, err := getHeaderValue(tx, path); err != nil || expired(header, now) {
+			return err
+		}
+		_, err := fmt.Fprintln(w, path)
+		return err
+	})
+}
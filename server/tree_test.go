@@ -0,0 +1,93 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecursiveListing(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url, body, accept string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, path := range []string{"/ns/a", "/ns/b/c", "/ns/b/d/e", "/other/f"} {
+		do("PUT", s.URL+path, "foo", "")
+	}
+	do("PUT", s.URL+"/ns/empty", "", "")
+
+	flat := func(url string) string {
+		resp := do("GET", url, "", "text/plain")
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("%s: bad status: got %d, want %d", url, got, want)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if got, want := flat(s.URL+"/ns?recursive"), "/ns/a\n/ns/b/\n/ns/b/c\n/ns/b/d/\n/ns/b/d/e\n/ns/empty/\n"; got != want {
+		t.Errorf("bad listing: got %q, want %q", got, want)
+	}
+	if got, want := flat(s.URL+"/ns/?recursive&depth=2"), "/ns/a\n/ns/b/\n/ns/b/c\n/ns/b/d/\n/ns/empty/\n"; got != want {
+		t.Errorf("bad listing: got %q, want %q", got, want)
+	}
+	if got, want := do("GET", s.URL+"/ns?recursive&depth=0", "", "").StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	resp := do("GET", s.URL+"/ns?recursive&depth=2", "", "application/json")
+	var tree []Entry
+	if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{
+		{Name: "a", Kind: "value"},
+		{Name: "b", Kind: "bucket", Children: []Entry{
+			{Name: "c", Kind: "value"},
+			{Name: "d", Kind: "bucket"},
+		}},
+		{Name: "empty", Kind: "bucket"},
+	}
+	if !reflect.DeepEqual(tree, want) {
+		t.Errorf("bad tree: got %+v, want %+v", tree, want)
+	}
+
+	resp = do("GET", s.URL+"/ns?recursive", "", "application/xml")
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `<entry name="d" kind="bucket">`+"\n      "+`<entry name="e" kind="value"></entry>`) {
+		t.Errorf("bad XML tree:\n%s", b)
+	}
+
+	resp = do("GET", s.URL+"/ns/b?recursive&detail", "", "application/json")
+	tree = nil
+	if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 2 || len(tree[1].Children) != 1 || tree[1].Children[0].ETag != etag([]byte("foo")) {
+		t.Errorf("bad tree: %+v", tree)
+	}
+}
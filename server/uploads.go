@@ -0,0 +1,588 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// defaultUploadExpiry is how long an upload session lasts when the config
+// doesn't say otherwise.
+const defaultUploadExpiry = 24 * time.Hour
+
+// maxUploadParts is the most parts an upload session can have.
+const maxUploadParts = 10000
+
+var uploadBucket = append([]byte{0}, []byte("uploads")...)
+
+// upload is an upload session. Parts are uploaded over several requests, and
+// are then committed to Path as a single large object.
+type upload struct {
+	ID      string       `json:"id"`
+	Path    string       `json:"path"`
+	Header  http.Header  `json:"header"`
+	Expires time.Time    `json:"expires"`
+	Size    int64        `json:"size,omitempty"`
+	Parts   []uploadPart `json:"parts"`
+}
+
+// uploadPart is a part of an upload session. Parts are either numbered, or
+// placed at an offset with a Content-Range header.
+type uploadPart struct {
+	Number   int64    `json:"part,omitempty"`
+	Ranged   bool     `json:"ranged,omitempty"`
+	Offset   int64    `json:"offset,omitempty"`
+	ETag     string   `json:"etag"`
+	Manifest manifest `json:"manifest"`
+}
+
+// uploadStatus is the representation of an upload session sent to clients.
+type uploadStatus struct {
+	ID      string       `json:"upload"`
+	Path    string       `json:"path"`
+	Expires time.Time    `json:"expires"`
+	Parts   []partStatus `json:"parts"`
+}
+
+type partStatus struct {
+	Number int64  `json:"part,omitempty"`
+	Offset *int64 `json:"offset,omitempty"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+}
+
+func createUploadBucketIfNotExists(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(uploadBucket)
+		return err
+	})
+}
+
+func (s server) uploadExpiry() time.Duration {
+	if s.cfg.Storage.UploadExpiry > 0 {
+		return s.cfg.Storage.UploadExpiry
+	}
+	return defaultUploadExpiry
+}
+
+// getUpload returns the upload session with the given ID, or nil if it
+// doesn't exist or has expired.
+func getUpload(tx *bolt.Tx, id string, now time.Time) (*upload, error) {
+	b := tx.Bucket(uploadBucket).Get([]byte(id))
+	if b == nil {
+		return nil, nil
+	}
+	var u upload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	if now.After(u.Expires) {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+func putUpload(tx *bolt.Tx, u *upload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(uploadBucket).Put([]byte(u.ID), b)
+}
+
+// deleteUpload deletes an upload session along with the chunks of its parts.
+func deleteUpload(tx *bolt.Tx, u *upload) error {
+	for i := range u.Parts {
+		if err := u.Parts[i].Manifest.delete(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(uploadBucket).Delete([]byte(u.ID))
+}
+
+// addPart adds p to the upload, replacing any part with the same number or
+// offset. The replaced part is returned so that its chunks can be freed.
+func (u *upload) addPart(p uploadPart) *uploadPart {
+	for i := range u.Parts {
+		old := u.Parts[i]
+		if old.Ranged == p.Ranged && old.Number == p.Number && old.Offset == p.Offset {
+			u.Parts[i] = p
+			return &old
+		}
+	}
+	u.Parts = append(u.Parts, p)
+	sort.Slice(u.Parts, func(i, j int) bool {
+		if u.Parts[i].Number != u.Parts[j].Number {
+			return u.Parts[i].Number < u.Parts[j].Number
+		}
+		return u.Parts[i].Offset < u.Parts[j].Offset
+	})
+	return nil
+}
+
+// replaces returns the part that p would replace, or nil if it would be added.
+func (u *upload) replaces(p uploadPart) *uploadPart {
+	for i := range u.Parts {
+		old := &u.Parts[i]
+		if old.Ranged == p.Ranged && old.Number == p.Number && old.Offset == p.Offset {
+			return old
+		}
+	}
+	return nil
+}
+
+// partsSize returns the total size of the parts received so far, leaving out
+// the part that p would replace.
+func (u *upload) partsSize(p uploadPart) int64 {
+	var size int64
+	old := u.replaces(p)
+	for i := range u.Parts {
+		if &u.Parts[i] != old {
+			size += u.Parts[i].Manifest.Size
+		}
+	}
+	return size
+}
+
+// assemble returns the manifest of the object made by joining the parts of
+// the upload in order. Ranged parts must cover the object without gaps.
+func (u *upload) assemble() (*manifest, error) {
+	if len(u.Parts) == 0 {
+		return nil, errors.New("upload has no parts")
+	}
+	m := &manifest{ID: u.ID}
+	ranged := u.Parts[0].Ranged
+	for _, p := range u.Parts {
+		if p.Ranged != ranged {
+			return nil, errors.New("upload mixes numbered and ranged parts")
+		}
+		if ranged && p.Offset != m.Size {
+			return nil, fmt.Errorf("upload has no data at offset %d", m.Size)
+		}
+		m.Parts = append(m.Parts, p.Manifest)
+		m.Size += p.Manifest.Size
+	}
+	if ranged && u.Size > 0 && m.Size != u.Size {
+		return nil, fmt.Errorf("upload has %d of %d bytes", m.Size, u.Size)
+	}
+	return m, nil
+}
+
+func (u *upload) status() uploadStatus {
+	st := uploadStatus{ID: u.ID, Path: u.Path, Expires: u.Expires, Parts: []partStatus{}}
+	for _, p := range u.Parts {
+		ps := partStatus{Number: p.Number, Size: p.Manifest.Size, ETag: p.ETag}
+		if p.Ranged {
+			offset := p.Offset
+			ps.Offset = &offset
+		}
+		st.Parts = append(st.Parts, ps)
+	}
+	return st
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes first-last/length", where length may be "*". An unknown length is
+// returned as -1.
+func parseContentRange(v string) (first, last, length int64, err error) {
+	errBad := fmt.Errorf("bad Content-Range: %q", v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, 0, errBad
+	}
+	v = strings.TrimPrefix(v, "bytes ")
+	slash := strings.IndexByte(v, '/')
+	dash := strings.IndexByte(v, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, errBad
+	}
+	if first, err = strconv.ParseInt(v[:dash], 10, 64); err != nil {
+		return 0, 0, 0, errBad
+	}
+	if last, err = strconv.ParseInt(v[dash+1:slash], 10, 64); err != nil {
+		return 0, 0, 0, errBad
+	}
+	length = -1
+	if v[slash+1:] != "*" {
+		if length, err = strconv.ParseInt(v[slash+1:], 10, 64); err != nil {
+			return 0, 0, 0, errBad
+		}
+	}
+	if first < 0 || last < first || (length >= 0 && last >= length) {
+		return 0, 0, 0, errBad
+	}
+	return first, last, length, nil
+}
+
+func writeUploadStatus(w http.ResponseWriter, u *upload, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(u.status()); err != nil {
+		log.Println(err)
+	}
+}
+
+// createUpload starts an upload session for the request path. The headers of
+// the request are kept, and stored with the value when the session is
+// committed.
+func (s server) createUpload(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.EscapedPath()
+	if len(splitPath(path)) == 1 {
+		http.Error(w, "Cannot PUT a value in the root bucket.", http.StatusBadRequest)
+		return
+	}
+	id, err := newObjectID()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	u := &upload{
+		ID:      id,
+		Path:    path,
+		Header:  s.extractHeader(req.Header),
+		Expires: time.Now().Add(s.uploadExpiry()).UTC(),
+		Parts:   []uploadPart{},
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return putUpload(tx, u)
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", path+"?upload="+id)
+	writeUploadStatus(w, u, http.StatusCreated)
+}
+
+// serveUpload handles requests for an existing upload session. GET reports
+// the session's parts, PUT uploads a part, POST commits the session and
+// DELETE aborts it.
+func (s server) serveUpload(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("upload")
+	switch req.Method {
+	case "GET", "HEAD":
+		var u *upload
+		err := s.db.View(func(tx *bolt.Tx) error {
+			var err error
+			u, err = getUpload(tx, id, time.Now())
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+			return
+		}
+		if u == nil || u.Path != req.URL.EscapedPath() {
+			http.Error(w, "Not found.", http.StatusNotFound)
+			return
+		}
+		writeUploadStatus(w, u, http.StatusOK)
+	case "PUT":
+		s.putUploadPart(w, req, id)
+	case "POST":
+		s.commitUpload(w, req, id)
+	case "DELETE":
+		s.abortUpload(w, req, id)
+	default:
+		w.Header().Set("Allow", "GET,PUT,POST,DELETE,HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// putUploadPart stores the request body as a part of an upload session. The
+// part is either numbered with the part query parameter, or placed with a
+// Content-Range header. Uploading a part again replaces it.
+func (s server) putUploadPart(w http.ResponseWriter, req *http.Request, id string) {
+	if s.badPutOrDeleteHeaders(w, req) {
+		return
+	}
+	path := req.URL.EscapedPath()
+
+	var (
+		part uploadPart
+		last int64
+		size int64 = -1
+	)
+	if n := req.URL.Query().Get("part"); n != "" {
+		num, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || num < 1 {
+			http.Error(w, "Bad part number.", http.StatusBadRequest)
+			return
+		}
+		part.Number = num
+	} else if cr := req.Header.Get("Content-Range"); cr != "" {
+		first, l, length, err := parseContentRange(cr)
+		if err != nil {
+			http.Error(w, "Bad Content-Range.", http.StatusBadRequest)
+			return
+		}
+		part.Ranged, part.Offset, last, size = true, first, l, length
+	} else {
+		http.Error(w, "A part number or Content-Range is required.", http.StatusBadRequest)
+		return
+	}
+
+	hasher, err := s.newBodyHasher(req.Header)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	// Make sure the session exists, and has room for the part, before asking
+	// for the body. The parts of a session can't add up to more than the
+	// largest object.
+	var (
+		found bool
+		room  int64
+	)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		u, err := getUpload(tx, id, time.Now())
+		if found = u != nil && u.Path == path; found {
+			room = s.maxObjectSize() - u.partsSize(part)
+			if u.replaces(part) == nil && len(u.Parts) >= maxUploadParts {
+				room = 0
+			}
+		}
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	}
+	if room <= 0 || size > s.maxObjectSize() || (part.Ranged && last >= s.maxObjectSize()) || req.ContentLength > room {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	m, err := s.writeChunks(io.TeeReader(req.Body, hasher), room)
+	if err == nil && (m.Size == 0 || (part.Ranged && m.Size != last-part.Offset+1)) {
+		s.freeChunks(m)
+		err = errBadRequest
+	}
+	if err != nil {
+		writeChunksError(w, err)
+		return
+	}
+	if !hasher.verify() {
+		s.freeChunks(m)
+		http.Error(w, "Digest mismatch.", http.StatusBadRequest)
+		return
+	}
+	eTag := etagOf(hasher.etag)
+	part.ETag, part.Manifest = eTag, *m
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		u, err := getUpload(tx, id, time.Now())
+		if err != nil {
+			return err
+		}
+		if u == nil || u.Path != path {
+			return errNotFound
+		}
+		// Other parts may have arrived while this one was being read.
+		if u.partsSize(part)+m.Size > s.maxObjectSize() || (u.replaces(part) == nil && len(u.Parts) >= maxUploadParts) {
+			return errTooLarge
+		}
+		if old := u.addPart(part); old != nil {
+			if err := old.Manifest.delete(tx); err != nil {
+				return err
+			}
+		}
+		if size >= 0 {
+			u.Size = size
+		}
+		if err := claimChunks(tx, m.ID); err != nil {
+			return err
+		}
+		return putUpload(tx, u)
+	})
+	if err != nil {
+		s.freeChunks(m)
+		if err == errNotFound {
+			http.Error(w, "Not found.", http.StatusNotFound)
+			return
+		} else if err == errTooLarge {
+			http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", eTag)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commitUpload joins the parts of an upload session into a large object and
+// stores it at the request path, in a single transaction. Digests sent with
+// the request are checked against the whole object.
+func (s server) commitUpload(w http.ResponseWriter, req *http.Request, id string) {
+	hasher, err := s.newBodyHasher(req.Header)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	ttl, err := parseTTL(req.Header)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	path := req.URL.EscapedPath()
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var (
+		header  http.Header
+		created bool
+	)
+	err = s.update(req, func(tx *bolt.Tx) error {
+		u, err := getUpload(tx, id, time.Now())
+		if err != nil {
+			return err
+		}
+		if u == nil || u.Path != path {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		m, err := u.assemble()
+		if err != nil {
+			msg, status = "Upload incomplete: "+err.Error()+".", http.StatusBadRequest
+			return err
+		}
+		if m.Size > s.maxObjectSize() {
+			msg, status = "Request too large.", http.StatusRequestEntityTooLarge
+			return errTooLarge
+		}
+		content := chunkReader{bucket: tx.Bucket(chunkBucket), m: m}
+		if _, err := io.Copy(hasher, io.NewSectionReader(content, 0, m.Size)); err != nil {
+			return err
+		}
+		if !hasher.verify() {
+			msg, status = "Digest mismatch.", http.StatusBadRequest
+			return errBadRequest
+		}
+
+		oldHeader, err := getLiveHeader(tx, path)
+		if err != nil {
+			return err
+		}
+		if checkPreconditions(oldHeader, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		created = oldHeader == nil
+
+		manifestJSON, _ := json.Marshal(m)
+		header = hasher.valueHeader(u.Header, m.Size)
+		header.Set(manifestHeader, string(manifestJSON))
+		setExpiry(header, ttl)
+		if err := putValue(tx, path, []byte(m.ID), header, oldHeader); err != nil {
+			return err
+		}
+		// The parts' chunks now belong to the object.
+		return tx.Bucket(uploadBucket).Delete([]byte(u.ID))
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	writePutResponse(w, path, header, created)
+}
+
+// abortUpload deletes an upload session and its parts.
+func (s server) abortUpload(w http.ResponseWriter, req *http.Request, id string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		u, err := getUpload(tx, id, time.Now())
+		if err != nil {
+			return err
+		}
+		if u == nil || u.Path != req.URL.EscapedPath() {
+			return errNotFound
+		}
+		return deleteUpload(tx, u)
+	})
+	if err == errNotFound {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireUploads deletes the upload sessions that expired before now, along
+// with their parts. Up to sweepBatchSize sessions are deleted in each
+// transaction.
+func (s server) expireUploads(now time.Time) error {
+	var after []byte
+	for {
+		var n int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			var expired []*upload
+			c := tx.Bucket(uploadBucket).Cursor()
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && n < sweepBatchSize; k, v = c.Next() {
+				n++
+				after = append([]byte(nil), k...)
+				var u upload
+				if err := json.Unmarshal(v, &u); err != nil {
+					return err
+				}
+				if now.After(u.Expires) {
+					expired = append(expired, &u)
+				}
+			}
+			for _, u := range expired {
+				if err := deleteUpload(tx, u); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || n < sweepBatchSize {
+			return err
+		}
+	}
+}
+
+// expireUploadsEvery calls expireUploads every interval, forever.
+func (s server) expireUploadsEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := s.expireUploads(now); err != nil {
+			log.Printf("couldn't expire uploads: %s", err)
+		}
+	}
+}
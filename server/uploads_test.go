@@ -0,0 +1,237 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestParseContentRange(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		Value               string
+		First, Last, Length int64
+		Error               bool
+	}{
+		{Value: "bytes 0-9/10", First: 0, Last: 9, Length: 10},
+		{Value: "bytes 5-9/*", First: 5, Last: 9, Length: -1},
+		{Value: "bytes 5-10/10", Error: true},
+		{Value: "bytes 9-5/*", Error: true},
+		{Value: "bytes */10", Error: true},
+		{Value: "runes 0-9/10", Error: true},
+	}
+	for i, test := range tests {
+		first, last, length, err := parseContentRange(test.Value)
+		if test.Error {
+			if err == nil {
+				t.Errorf("test %d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %s", i, err)
+			continue
+		}
+		if first != test.First || last != test.Last || length != test.Length {
+			t.Errorf("test %d: got %d-%d/%d, want %d-%d/%d", i, first, last, length, test.First, test.Last, test.Length)
+		}
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	srv := server{
+		db:  db,
+		cfg: config.Data{Storage: config.Storage{ChunkSize: 4}},
+	}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url string, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	create := func() string {
+		resp := do("POST", s.URL+"/foo/bar?uploads", "", map[string]string{"Content-Type": "text/plain"})
+		if got, want := resp.StatusCode, http.StatusCreated; got != want {
+			t.Fatalf("bad status: got %d, want %d", got, want)
+		}
+		if got, want := resp.Header.Get("Content-Type"), "application/json; charset=utf-8"; got != want {
+			t.Errorf("bad Content-Type: got %q, want %q", got, want)
+		}
+		return s.URL + resp.Header.Get("Location")
+	}
+
+	// Numbered parts may arrive in any order.
+	session := create()
+	for _, p := range []struct{ Number, Body string }{{"2", "bazqux"}, {"1", "foobar"}, {"2", "baz"}} {
+		resp := do("PUT", session+"&part="+p.Number, p.Body, nil)
+		if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+			t.Fatalf("bad status: got %d, want %d", got, want)
+		}
+	}
+	resp := do("POST", session, "", nil)
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("ETag"), etag([]byte("foobarbaz")); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+
+	resp = do("GET", s.URL+"/foo/bar", "", nil)
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "foobarbaz"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "text/plain"; got != want {
+		t.Errorf("bad Content-Type: got %q, want %q", got, want)
+	}
+
+	// A committed session is gone.
+	if got, want := do("GET", session, "", nil).StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	// Ranged parts resume where the last one left off, and can't be
+	// committed with gaps.
+	session = create()
+	do("PUT", session, "hello", map[string]string{"Content-Range": "bytes 0-4/11"})
+	resp = do("GET", session, "", nil)
+	var status uploadStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Parts) != 1 || status.Parts[0].Size != 5 {
+		t.Errorf("bad upload status: %+v", status)
+	}
+	if got, want := do("POST", session, "", nil).StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp = do("PUT", session, " world", map[string]string{"Content-Range": "bytes 5-10/11"})
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp = do("POST", session, "", map[string]string{"If-Match": etag([]byte("foobarbaz"))})
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	b, err = ioutil.ReadAll(do("GET", s.URL+"/foo/bar", "", nil).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "hello world"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	// The parts of the object that was replaced have been freed.
+	if got, want := countChunks(t, db), 4; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+
+	// Aborted and expired sessions free their parts.
+	session = create()
+	do("PUT", session+"&part=1", "foobar", nil)
+	if got, want := do("DELETE", session, "", nil).StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	session = create()
+	do("PUT", session+"&part=1", "foobar", nil)
+	// More sessions than fit in one batch.
+	sessions := []string{session}
+	for i := 0; i < sweepBatchSize; i++ {
+		sessions = append(sessions, create())
+	}
+	if err := srv.expireUploads(time.Now().Add(48 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range sessions {
+		if got, want := do("GET", session, "", nil).StatusCode, http.StatusNotFound; got != want {
+			t.Errorf("bad status: got %d, want %d", got, want)
+		}
+	}
+	if got, want := countChunks(t, db), 4; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+}
+
+func TestUploadSessionLimit(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	s := httptest.NewServer(server{
+		db: db,
+		cfg: config.Data{
+			Limits:  config.Limits{MaxValueSize: 4, MaxObjectSize: 10},
+			Storage: config.Storage{LargeObjectSize: 2, ChunkSize: 4},
+		},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := do("POST", s.URL+"/foo/bar?uploads", nil)
+	session := s.URL + resp.Header.Get("Location")
+
+	tests := []struct {
+		Part         string
+		Body         io.Reader
+		ExpectedCode int
+	}{
+		{Part: "1", Body: strings.NewReader("123456"), ExpectedCode: http.StatusNoContent},
+		{Part: "2", Body: strings.NewReader("12345"), ExpectedCode: http.StatusRequestEntityTooLarge},
+		// Without a Content-Length, the body is cut off at the limit.
+		{Part: "2", Body: struct{ io.Reader }{strings.NewReader("12345")}, ExpectedCode: http.StatusRequestEntityTooLarge},
+		{Part: "2", Body: strings.NewReader("1234"), ExpectedCode: http.StatusNoContent},
+		{Part: "3", Body: strings.NewReader("1"), ExpectedCode: http.StatusRequestEntityTooLarge},
+		// A part that is replaced doesn't count against the limit.
+		{Part: "1", Body: strings.NewReader("12345"), ExpectedCode: http.StatusNoContent},
+		{Part: "3", Body: strings.NewReader("1"), ExpectedCode: http.StatusNoContent},
+	}
+	for i, test := range tests {
+		if got, want := do("PUT", session+"&part="+test.Part, test.Body).StatusCode, test.ExpectedCode; got != want {
+			t.Errorf("test %d: bad status: got %d, want %d", i, got, want)
+		}
+	}
+	if got, want := do("POST", session, nil).StatusCode, http.StatusCreated; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	// Parts that were refused left no chunks behind.
+	if got, want := countChunks(t, db), 4; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+}
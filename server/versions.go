@@ -0,0 +1,494 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/ranger"
+)
+
+// versionHeader is the header field holding the version ID of a value stored
+// in a bucket with versioning turned on. It is sent to clients as Version-Id.
+const versionHeader = internalHeaderPrefix + "Version"
+
+var (
+	// versioningBucket holds the paths of the buckets that have versioning
+	// turned on.
+	versioningBucket = append([]byte{0}, []byte("versioning")...)
+
+	// versionsBucket holds a bucket for each versioned value, keyed by the
+	// value's path, that holds the value's past versions keyed by version ID.
+	versionsBucket = append([]byte{0}, []byte("versions")...)
+
+	// versionQueries are the query parameters handled by serveVersions.
+	versionQueries = []string{"versioning", "versions", "version", "restore"}
+)
+
+// version is a past version of a value. Past versions of large objects keep
+// their chunks, so Value is the object's ID, as usual.
+type version struct {
+	Header http.Header `json:"header"`
+	Value  []byte      `json:"value"`
+}
+
+// versionInfo describes a version of a value to clients.
+type versionInfo struct {
+	Version      string `json:"version,omitempty"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	Size         int64  `json:"size"`
+	Current      bool   `json:"current,omitempty"`
+}
+
+func createVersionBucketsIfNotExist(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(versioningBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(versionsBucket)
+		return err
+	})
+}
+
+// bucketKey returns the key that the bucket with the given path parts is
+// known by in the versioning bucket.
+func bucketKey(parts [][]byte) []byte {
+	return append([]byte{'/'}, bytes.Join(parts[1:], []byte{'/'})...)
+}
+
+func versionKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// versioningEnabled reports whether versioning is turned on for the bucket
+// that holds the value at path.
+func versioningEnabled(tx *bolt.Tx, path string) bool {
+	parts := splitPath(path)
+	return tx.Bucket(versioningBucket).Get(bucketKey(parts[:len(parts)-1])) != nil
+}
+
+// stampVersion gives header a new version ID, if the value it belongs to is
+// versioned.
+func stampVersion(tx *bolt.Tx, path string, header http.Header) error {
+	if !versioningEnabled(tx, path) {
+		return nil
+	}
+	history, err := tx.Bucket(versionsBucket).CreateBucketIfNotExists([]byte(path))
+	if err != nil {
+		return err
+	}
+	id, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	header.Set(versionHeader, strconv.FormatUint(id, 10))
+	return nil
+}
+
+// archiveVersion adds the value at path to its version history. Values that
+// were stored before versioning was turned on are given a version ID here.
+func archiveVersion(tx *bolt.Tx, path string, header http.Header, value []byte) error {
+	history, err := tx.Bucket(versionsBucket).CreateBucketIfNotExists([]byte(path))
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(header.Get(versionHeader), 10, 64)
+	if err != nil {
+		if id, err = history.NextSequence(); err != nil {
+			return err
+		}
+		header = cloneHeader(header)
+		header.Set(versionHeader, strconv.FormatUint(id, 10))
+	}
+	b, err := json.Marshal(version{Header: header, Value: value})
+	if err != nil {
+		return err
+	}
+	return history.Put(versionKey(id), b)
+}
+
+// getVersion returns the past version of the value at path with the given ID,
+// or nil if there is no such version.
+func getVersion(tx *bolt.Tx, path string, id string) (*version, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	history := tx.Bucket(versionsBucket).Bucket([]byte(path))
+	if history == nil {
+		return nil, nil
+	}
+	b := history.Get(versionKey(n))
+	if b == nil {
+		return nil, nil
+	}
+	var v version
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// deleteVersion removes a past version of the value at path from its
+// history, leaving its content alone.
+func deleteVersion(tx *bolt.Tx, path string, id string) error {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(versionsBucket).Bucket([]byte(path)).Delete(versionKey(n))
+}
+
+// listVersions describes the versions of the value at path, newest first.
+// The current value, if there is one, is listed first.
+func listVersions(tx *bolt.Tx, path string) ([]versionInfo, error) {
+	versions := []versionInfo{}
+	header, err := getLiveHeader(tx, path)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		info := newVersionInfo(header)
+		info.Current = true
+		versions = append(versions, info)
+	}
+	history := tx.Bucket(versionsBucket).Bucket([]byte(path))
+	if history == nil {
+		return versions, nil
+	}
+	c := history.Cursor()
+	for k, b := c.Last(); k != nil; k, b = c.Prev() {
+		var v version
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, newVersionInfo(v.Header))
+	}
+	return versions, nil
+}
+
+func newVersionInfo(header http.Header) versionInfo {
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	return versionInfo{
+		Version:      header.Get(versionHeader),
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Size:         size,
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+func isVersionRequest(req *http.Request) bool {
+	query := req.URL.Query()
+	for _, q := range versionQueries {
+		if _, ok := query[q]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serveVersions handles requests that manage versioning and version history.
+//
+//	GET    /bucket?versioning     reports whether versioning is on
+//	PUT    /bucket?versioning=on  turns versioning on (or off)
+//	GET    /key?versions          lists the versions of a value
+//	GET    /key?version=id        gets a version of a value
+//	DELETE /key?version=id        deletes a past version of a value
+//	POST   /key?restore=id        makes a past version the current value
+func (s server) serveVersions(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var allow string
+	switch {
+	case query["versioning"] != nil:
+		allow = "GET,PUT"
+		switch req.Method {
+		case "GET":
+			s.getVersioning(w, req)
+			return
+		case "PUT":
+			s.putVersioning(w, req, query.Get("versioning"))
+			return
+		}
+	case query["versions"] != nil:
+		allow = "GET"
+		if req.Method == "GET" {
+			s.getVersions(w, req)
+			return
+		}
+	case query["version"] != nil:
+		allow = "GET,DELETE,HEAD"
+		switch req.Method {
+		case "GET", "HEAD":
+			s.getPastVersion(w, req, query.Get("version"))
+			return
+		case "DELETE":
+			s.deletePastVersion(w, req, query.Get("version"))
+			return
+		}
+	case query["restore"] != nil:
+		allow = "POST"
+		if req.Method == "POST" {
+			s.restoreVersion(w, req, query.Get("restore"))
+			return
+		}
+	}
+	w.Header().Set("Allow", allow)
+	http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+}
+
+func (s server) getVersioning(w http.ResponseWriter, req *http.Request) {
+	parts := splitPath(req.URL.EscapedPath())
+	state := "off"
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if getBoltBucket(tx, parts) == nil {
+			return bolt.ErrBucketNotFound
+		}
+		if tx.Bucket(versioningBucket).Get(bucketKey(parts)) != nil {
+			state = "on"
+		}
+		return nil
+	})
+	if err == bolt.ErrBucketNotFound {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, state)
+}
+
+// putVersioning turns versioning on or off for a bucket. Turning it off
+// keeps the history that has been recorded so far.
+func (s server) putVersioning(w http.ResponseWriter, req *http.Request, state string) {
+	if state != "on" && state != "off" {
+		http.Error(w, `Versioning must be "on" or "off".`, http.StatusBadRequest)
+		return
+	}
+	parts := splitPath(req.URL.EscapedPath())
+	err := s.update(req, func(tx *bolt.Tx) error {
+		if getBoltBucket(tx, parts) == nil {
+			return bolt.ErrBucketNotFound
+		}
+		var err error
+		if state == "on" {
+			err = tx.Bucket(versioningBucket).Put(bucketKey(parts), []byte(state))
+		} else {
+			err = tx.Bucket(versioningBucket).Delete(bucketKey(parts))
+		}
+		if err != nil {
+			return err
+		}
+		return recordChange(tx, changeEvent{Op: "versioning", Path: req.URL.EscapedPath()})
+	})
+	if err == bolt.ErrBucketNotFound {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	} else if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s server) getVersions(w http.ResponseWriter, req *http.Request) {
+	var versions []versionInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		versions, err = listVersions(tx, req.URL.EscapedPath())
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(versions); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s server) getPastVersion(w http.ResponseWriter, req *http.Request, id string) {
+	path := req.URL.EscapedPath()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		header, err := getLiveHeader(tx, path)
+		if err != nil {
+			return err
+		}
+		var value []byte
+		if header != nil && header.Get(versionHeader) == id {
+			parts := splitPath(path)
+			bucket := getBoltBucket(tx, parts[:len(parts)-1])
+			if bucket == nil {
+				return bolt.ErrBucketNotFound
+			}
+			value = bucket.Get(parts[len(parts)-1])
+		} else {
+			v, err := getVersion(tx, path, id)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				return bolt.ErrBucketNotFound
+			}
+			header, value = v.Header, v.Value
+		}
+		switch checkPreconditions(header, req) {
+		case http.StatusNotModified:
+			writeNotModified(header, w)
+			return nil
+		case http.StatusPreconditionFailed:
+			return errPreconditionFailed
+		}
+		return writeValue(w, req, tx, header, value)
+	})
+	if err == bolt.ErrBucketNotFound {
+		http.Error(w, "Not found.", http.StatusNotFound)
+	} else if err == ranger.Error {
+		http.Error(w, "Requested range not satisfiable.", http.StatusRequestedRangeNotSatisfiable)
+	} else if err == errBadRequest {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+	} else if err == errPreconditionFailed {
+		http.Error(w, "Precondition failed.", http.StatusPreconditionFailed)
+	} else if err == errNotAcceptable {
+		http.Error(w, "Not acceptable.", http.StatusNotAcceptable)
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+	}
+}
+
+// deletePastVersion permanently deletes a past version of a value. The current
+// version can only be deleted with a plain DELETE.
+func (s server) deletePastVersion(w http.ResponseWriter, req *http.Request, id string) {
+	path := req.URL.EscapedPath()
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	err := s.update(req, func(tx *bolt.Tx) error {
+		header, err := getLiveHeader(tx, path)
+		if err != nil {
+			return err
+		}
+		if header != nil && header.Get(versionHeader) == id {
+			msg, status = "Can't delete the current version.", http.StatusConflict
+			return errBadRequest
+		}
+		v, err := getVersion(tx, path, id)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		if checkPreconditions(v.Header, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		if err := deleteVersion(tx, path, id); err != nil {
+			return err
+		}
+		return deleteContent(tx, v.Header)
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreVersion makes a past version of a value the current one. The value
+// it replaces is kept in the history, if versioning is still on, and the
+// restored value gets a new version ID. The request's preconditions apply to
+// the current value.
+func (s server) restoreVersion(w http.ResponseWriter, req *http.Request, id string) {
+	path := req.URL.EscapedPath()
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	var (
+		header  http.Header
+		created bool
+	)
+	err := s.update(req, func(tx *bolt.Tx) error {
+		oldHeader, err := getLiveHeader(tx, path)
+		if err != nil {
+			return err
+		}
+		if checkPreconditions(oldHeader, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		if oldHeader != nil && oldHeader.Get(versionHeader) == id {
+			header = oldHeader
+			return nil
+		}
+		v, err := getVersion(tx, path, id)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		// The version leaves the history as it becomes current, so that its
+		// chunks are never shared.
+		if err := deleteVersion(tx, path, id); err != nil {
+			return err
+		}
+		header = v.Header
+		header.Del(versionHeader)
+		header.Del(expiresHeader)
+		header.Set("Last-Modified", time.Now().UTC().Format(time.RFC1123Z))
+		created = oldHeader == nil
+		return putValue(tx, path, v.Value, header, oldHeader)
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	writePutResponse(w, path, header, created)
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestVersioning(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	s := httptest.NewServer(server{
+		db:  db,
+		cfg: config.Data{Storage: config.Storage{LargeObjectSize: 8, ChunkSize: 4}},
+	})
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, url string, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	get := func(url string) string {
+		resp := do("GET", url, "", nil)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("%s: bad status: got %d, want %d", url, got, want)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// A value stored before versioning is turned on joins the history when
+	// it is overwritten.
+	do("PUT", s.URL+"/conf/app", "one", nil)
+	if got, want := do("PUT", s.URL+"/nope?versioning=on", "", nil).StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := do("PUT", s.URL+"/conf?versioning=on", "", nil).StatusCode, http.StatusNoContent; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := get(s.URL+"/conf?versioning"), "on\n"; got != want {
+		t.Errorf("bad versioning state: got %q, want %q", got, want)
+	}
+	resp := do("PUT", s.URL+"/conf/app", "two", nil)
+	if got, want := resp.Header.Get("Version-Id"), "2"; got != want {
+		t.Errorf("bad Version-Id: got %q, want %q", got, want)
+	}
+	do("PUT", s.URL+"/conf/app", "three, a large object", nil)
+	do("DELETE", s.URL+"/conf/app", "", nil)
+
+	var versions []versionInfo
+	if err := json.Unmarshal([]byte(get(s.URL+"/conf/app?versions")), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("bad versions: %+v", versions)
+	}
+	for i, want := range []string{"3", "2", "1"} {
+		if got := versions[i].Version; got != want {
+			t.Errorf("version %d: got %q, want %q", i, got, want)
+		}
+	}
+	if got, want := versions[2].ETag, etag([]byte("one")); got != want {
+		t.Errorf("bad ETag: got %q, want %q", got, want)
+	}
+
+	if got, want := get(s.URL+"/conf/app?version=1"), "one"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if got, want := get(s.URL+"/conf/app?version=3"), "three, a large object"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if got, want := do("GET", s.URL+"/conf/app?version=9", "", nil).StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	// Restoring a version makes it current under a new ID.
+	resp = do("POST", s.URL+"/conf/app?restore=3", "", nil)
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Version-Id"), "4"; got != want {
+		t.Errorf("bad Version-Id: got %q, want %q", got, want)
+	}
+	if got, want := get(s.URL+"/conf/app"), "three, a large object"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	resp = do("POST", s.URL+"/conf/app?restore=2", "", map[string]string{"If-Match": etag([]byte("one"))})
+	if got, want := resp.StatusCode, http.StatusPreconditionFailed; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp = do("POST", s.URL+"/conf/app?restore=2", "", nil)
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := get(s.URL+"/conf/app"), "two"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+
+	// Past versions can be deleted for good, along with their chunks.
+	if got, want := do("DELETE", s.URL+"/conf/app?version=5", "", nil).StatusCode, http.StatusConflict; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := do("DELETE", s.URL+"/conf/app?version=4", "", nil).StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := countChunks(t, db), 0; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+
+	// Once versioning is off, overwritten values are gone.
+	do("PUT", s.URL+"/conf?versioning=off", "", nil)
+	do("PUT", s.URL+"/conf/app", "four", nil)
+	if err := json.Unmarshal([]byte(get(s.URL+"/conf/app?versions")), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || !versions[0].Current || versions[1].Version != "1" {
+		t.Errorf("bad versions: %+v", versions)
+	}
+}
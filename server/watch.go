@@ -0,0 +1,327 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// defaultWait is how long a long-polling GET waits for a change when the
+	// request doesn't say.
+	defaultWait = 30 * time.Second
+
+	// maxWait is the longest that a long-polling GET may wait.
+	maxWait = 5 * time.Minute
+
+	// watchBuffer is how many events a watcher may fall behind by before it
+	// is dropped.
+	watchBuffer = 64
+
+	// keepAliveInterval is how often an idle event stream sends a comment,
+	// so that proxies don't time it out.
+	keepAliveInterval = 30 * time.Second
+)
+
+// changeEvent describes a change to a value or bucket. Op is "put" or
+// "delete" for values, and "create_bucket" or "delete_bucket" for buckets.
+// ETag and LastModified are those of a value that was put, and Metadata is
+// set when only the value's metadata was. Seq is the event's sequence number
+// in the change log.
+//
+// Changes to a bucket's versioning, to a resource's dead properties, and to
+// the webhooks at a path are logged too, as "versioning", "properties",
+// "create_webhook" and "delete_webhook", so that followers can replicate
+// them. Hook is the ID of the webhook.
+type changeEvent struct {
+	Seq          uint64 `json:"seq"`
+	Time         string `json:"time"`
+	Op           string `json:"op"`
+	Path         string `json:"path"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Metadata     bool   `json:"metadata,omitempty"`
+	Hook         string `json:"hook,omitempty"`
+}
+
+// watcher receives the change events for a path, or for the values beneath
+// a bucket. Its channel is closed if it falls too far behind.
+type watcher struct {
+	path   string
+	exact  bool
+	events chan changeEvent
+}
+
+func (w *watcher) matches(e changeEvent) bool {
+	if w.exact {
+		return e.Path == w.path
+	}
+	return e.Path == w.path || isWithin(e.Path, w.path)
+}
+
+// watchers holds the watchers of each open database. Databases without
+// watchers have no entry. It also holds the feed of each database that has
+// had a change made to it.
+var watchers = struct {
+	sync.Mutex
+	m     map[*bolt.DB]map[*watcher]bool
+	feeds map[*bolt.DB]*feed
+}{
+	m:     make(map[*bolt.DB]map[*watcher]bool),
+	feeds: make(map[*bolt.DB]*feed),
+}
+
+// feed puts a database's change events in order. Transactions commit one at a
+// time, but their commit handlers run after the next transaction may have
+// begun, so events can be published out of order. Events wait in pending
+// until every one before them has been sent.
+type feed struct {
+	next    uint64
+	pending map[uint64]changeEvent
+}
+
+// watch starts watching path in db. If exact is false, the values beneath
+// the bucket at path are watched instead.
+func watch(db *bolt.DB, path string, exact bool) *watcher {
+	w := &watcher{path: path, exact: exact, events: make(chan changeEvent, watchBuffer)}
+	watchers.Lock()
+	defer watchers.Unlock()
+	if watchers.m[db] == nil {
+		watchers.m[db] = make(map[*watcher]bool)
+	}
+	watchers.m[db][w] = true
+	return w
+}
+
+// stop stops w watching db.
+func (w *watcher) stop(db *bolt.DB) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	if watchers.m[db][w] {
+		w.drop(db)
+	}
+}
+
+// drop closes w and removes it from db's watchers. The caller holds the
+// watchers lock.
+func (w *watcher) drop(db *bolt.DB) {
+	close(w.events)
+	delete(watchers.m[db], w)
+	if len(watchers.m[db]) == 0 {
+		delete(watchers.m, db)
+	}
+}
+
+// publishChange sends e to the watchers of tx's database once tx commits, so
+// that events are never sent for changes that are rolled back. Events are
+// sent in the order of their sequence numbers. Those numbers have no gaps,
+// since a transaction that rolls back gives its numbers back.
+func publishChange(tx *bolt.Tx, e changeEvent) {
+	db := tx.DB()
+	watchers.Lock()
+	if watchers.feeds[db] == nil {
+		// Only one transaction writes at a time, so no change made before
+		// this one, the first since db was opened, is still to be sent.
+		watchers.feeds[db] = &feed{next: e.Seq, pending: make(map[uint64]changeEvent)}
+	}
+	watchers.Unlock()
+	tx.OnCommit(func() {
+		publishCommitted(db, e)
+	})
+}
+
+// publishCommitted sends e, which has been committed to db, along with any
+// events after it that were waiting for it.
+func publishCommitted(db *bolt.DB, e changeEvent) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	f := watchers.feeds[db]
+	f.pending[e.Seq] = e
+	for {
+		e, ok := f.pending[f.next]
+		if !ok {
+			break
+		}
+		delete(f.pending, f.next)
+		f.next++
+		sendChange(db, e)
+	}
+}
+
+// sendChange sends e to the watchers of db that it matches. The caller holds
+// the watchers lock.
+func sendChange(db *bolt.DB, e changeEvent) {
+	for w := range watchers.m[db] {
+		if !w.matches(e) {
+			continue
+		}
+		select {
+		case w.events <- e:
+		default:
+			w.drop(db)
+		}
+	}
+}
+
+// parseWait returns how long a long-polling GET should wait, given the value
+// of its "wait" query parameter, in seconds or as a duration such as "1m".
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultWait, nil
+	}
+	d, err := time.ParseDuration(v)
+	if n, nerr := strconv.ParseInt(v, 10, 64); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad wait: %q", v)
+	}
+	if d > maxWait {
+		d = maxWait
+	}
+	return d, nil
+}
+
+// waitForChange is a long-polling GET. If the value at the request path
+// still has the ETag given in If-None-Match, it waits until the value changes
+// or the wait times out, and then serves the request as a normal GET.
+func (s server) waitForChange(w http.ResponseWriter, req *http.Request) {
+	wait, err := parseWait(req.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	path := cleanPath(req.URL.EscapedPath())
+
+	// Start watching before looking at the value, so that no change is missed
+	// in between.
+	watcher := watch(s.db, path, true)
+	defer watcher.stop(s.db)
+
+	var unchanged bool
+	err = s.db.View(func(tx *bolt.Tx) error {
+		header, err := getLiveHeader(tx, path)
+		unchanged = header != nil && checkPreconditions(header, req) == http.StatusNotModified
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	if unchanged {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-watcher.events:
+		case <-timer.C:
+		case <-req.Context().Done():
+			return
+		}
+	}
+	s.getBucketOrValue(w, req)
+}
+
+// streamChanges streams the changes to the values beneath the bucket at the
+// request path as Server-Sent Events, until the client goes away. Each event
+// is named for its operation, its ID is its sequence number in the change
+// log, and its data is the changeEvent as JSON.
+//
+// A client that sends Last-Event-ID, or the "since" query parameter, is sent
+// the logged changes it missed before the live ones.
+func (s server) streamChanges(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", http.StatusNotImplemented)
+		return
+	}
+	var (
+		since uint64
+		err   error
+	)
+	if v := req.Header.Get("Last-Event-ID"); v != "" {
+		since, err = strconv.ParseUint(v, 10, 64)
+		since++
+	} else if v := req.URL.Query().Get("since"); v != "" {
+		since, err = strconv.ParseUint(v, 10, 64)
+	}
+	if err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	path := cleanPath(req.URL.EscapedPath())
+	watcher := watch(s.db, path, false)
+	defer watcher.stop(s.db)
+
+	var (
+		found   bool
+		missed  []changeEvent
+		lastSeq uint64
+	)
+	err = s.db.View(func(tx *bolt.Tx) (err error) {
+		found = getBoltBucket(tx, splitPath(path)) != nil
+		if found && since > 0 {
+			missed, _, err = readChanges(tx, path, since, 0)
+		}
+		return err
+	})
+	if err == errCompacted {
+		http.Error(w, "Changes no longer available.", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		writeEvent(w, e)
+		lastSeq = e.Seq
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-watcher.events:
+			if !ok {
+				// The client fell behind. It can reconnect with Last-Event-ID
+				// to pick up where it left off.
+				return
+			}
+			if e.Seq <= lastSeq {
+				// Already sent from the change log.
+				continue
+			}
+			writeEvent(w, e)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e changeEvent) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Op, data)
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestWatch(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	do("PUT", "/feed", "", nil)
+	if got, want := do("GET", "/nope?watch", "", nil).StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	resp := do("GET", "/feed?watch", "", nil)
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Fatalf("bad Content-Type: got %q, want %q", got, want)
+	}
+
+	eTag := do("PUT", "/feed/a", "1", nil).Header.Get("ETag")
+	do("PUT", "/other/x", "ignored", nil)
+	// A batch that fails is rolled back, and sends no events.
+	do("POST", "/feed?batch", `{"ops": [{"op": "put", "path": "b", "value": "eA=="}, {"op": "delete", "path": "nope"}]}`, nil)
+	do("DELETE", "/feed/a", "", nil)
+	do("PUT", "/feed/sub/b", "2", nil)
+	// Deleting the bucket is a change to it, too.
+	do("DELETE", "/feed", "", nil)
+
+	expected := []changeEvent{
+		{Op: "put", Path: "/feed/a", ETag: eTag},
+		{Op: "delete", Path: "/feed/a"},
+		{Op: "create_bucket", Path: "/feed/sub"},
+		{Op: "put", Path: "/feed/sub/b", ETag: etag([]byte("2"))},
+		{Op: "delete", Path: "/feed/sub/b"},
+		{Op: "delete_bucket", Path: "/feed/sub"},
+		{Op: "delete_bucket", Path: "/feed"},
+	}
+	r := bufio.NewReader(resp.Body)
+	for i, want := range expected {
+		var name string
+		var e changeEvent
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			if strings.HasPrefix(line, "event: ") {
+				name = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if name != want.Op {
+			t.Errorf("event %d: bad name: got %q, want %q", i, name, want.Op)
+		}
+		if e.Op != want.Op || e.Path != want.Path || e.ETag != want.ETag {
+			t.Errorf("event %d: got %+v, want %+v", i, e, want)
+		}
+		if e.Op == "put" && e.LastModified == "" {
+			t.Errorf("event %d: missing Last-Modified", i)
+		}
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	resp, _ := do("PUT", "/config/v", "old", nil)
+	eTag := resp.Header.Get("ETag")
+
+	resp, _ = do("GET", "/config/v?wait=50ms", "", map[string]string{"If-None-Match": eTag})
+	if got, want := resp.StatusCode, http.StatusNotModified; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	resp, body := do("GET", "/config/v?wait", "", nil)
+	if got, want := body, "old"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	resp, _ = do("GET", "/config/v?wait=soon", "", nil)
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		do("PUT", "/config/other", "unrelated", nil)
+		do("PUT", "/config/v", "new", nil)
+	}()
+	start := time.Now()
+	resp, body = do("GET", "/config/v?wait=10", "", map[string]string{"If-None-Match": eTag})
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+	if got, want := body, "new"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("long poll didn't wake up on change")
+	}
+}
+
+func TestWatchOrder(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		return recordChange(tx, changeEvent{Op: "put", Path: "/a/x"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := watch(db, "/a", false)
+	defer w.stop(db)
+
+	// The commit handler of a later transaction can run first. Its event
+	// waits for the earlier one.
+	publishCommitted(db, changeEvent{Seq: 3, Op: "put", Path: "/a/z"})
+	select {
+	case e := <-w.events:
+		t.Fatalf("event %d sent before event 2", e.Seq)
+	default:
+	}
+	publishCommitted(db, changeEvent{Seq: 2, Op: "put", Path: "/a/y"})
+	for _, want := range []uint64{2, 3} {
+		select {
+		case e := <-w.events:
+			if e.Seq != want {
+				t.Errorf("bad event: got %d, want %d", e.Seq, want)
+			}
+		default:
+			t.Fatalf("event %d not sent", want)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// davNamespace is the XML namespace of WebDAV elements and properties.
+const davNamespace = "DAV:"
+
+// maxDAVBodySize is the largest XML body accepted by the WebDAV methods.
+const maxDAVBodySize = 1 << 20
+
+// propertyBucket holds the dead properties set with PROPPATCH, keyed by the
+// path of the resource they belong to.
+var propertyBucket = append([]byte{0}, []byte("properties")...)
+
+// liveProperties are the WebDAV properties that the server computes from
+// the stored header, and that clients can't set.
+var liveProperties = []string{
+	"resourcetype",
+	"displayname",
+	"getcontentlength",
+	"getcontenttype",
+	"getetag",
+	"getlastmodified",
+	"supportedlock",
+	"lockdiscovery",
+}
+
+// property is a dead property. XML is the property element's content.
+type property struct {
+	Space string `json:"space"`
+	Local string `json:"local"`
+	XML   string `json:"xml,omitempty"`
+}
+
+// davResource is a bucket or a value, as WebDAV sees it. Buckets are
+// collections, and values are resources described by their header.
+type davResource struct {
+	Path       string
+	Collection bool
+	Header     http.Header
+}
+
+// rawProperty is a property element in a request body.
+type rawProperty struct {
+	XMLName  xml.Name
+	InnerXML string `xml:",innerxml"`
+}
+
+// davProp is a prop element, holding properties or just their names.
+type davProp struct {
+	Props []rawProperty `xml:",any"`
+}
+
+// propfind is the body of a PROPFIND request.
+type propfind struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *davProp  `xml:"DAV: prop"`
+}
+
+// propertyUpdate is the body of a PROPPATCH request. Its set and remove
+// instructions are kept in the order they were given.
+type propertyUpdate struct {
+	XMLName      xml.Name `xml:"DAV: propertyupdate"`
+	Instructions []struct {
+		XMLName xml.Name
+		Prop    davProp `xml:"DAV: prop"`
+	} `xml:",any"`
+}
+
+func createPropertyBucketIfNotExists(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(propertyBucket)
+		return err
+	})
+}
+
+// cleanPath returns path without empty segments or a trailing slash, which is
+// how WebDAV resources are known in the reserved buckets.
+func cleanPath(path string) string {
+	return string(bucketKey(splitPath(path)))
+}
+
+// isWithin reports whether path lies beneath the bucket at root.
+func isWithin(path, root string) bool {
+	return root == "/" || strings.HasPrefix(path, root+"/")
+}
+
+func isLiveProperty(name xml.Name) bool {
+	if name.Space != davNamespace {
+		return false
+	}
+	for _, p := range liveProperties {
+		if p == name.Local {
+			return true
+		}
+	}
+	return false
+}
+
+// href returns the URL path of r. The paths of collections end with a slash.
+func (r *davResource) href() string {
+	if r.Collection && r.Path != "/" {
+		return r.Path + "/"
+	}
+	return r.Path
+}
+
+// findResource returns the resource at path, or nil if there is none.
+func findResource(tx *bolt.Tx, path string) (*davResource, error) {
+	parts := splitPath(path)
+	path = string(bucketKey(parts))
+	if len(parts) == 1 {
+		return &davResource{Path: path, Collection: true}, nil
+	}
+	parent := getBoltBucket(tx, parts[:len(parts)-1])
+	if parent == nil {
+		return nil, nil
+	}
+	bucket, value := getBoltBucketOrValue(parent, parts[len(parts)-1])
+	if bucket != nil {
+		return &davResource{Path: path, Collection: true}, nil
+	}
+	if value == nil {
+		return nil, nil
+	}
+	header, err := getLiveHeader(tx, path)
+	if err != nil || header == nil {
+		return nil, err
+	}
+	return &davResource{Path: path, Header: header}, nil
+}
+
+// members returns the resources in the collection r.
+func (r *davResource) members(tx *bolt.Tx) ([]davResource, error) {
+	bucket := getBoltBucket(tx, splitPath(r.Path))
+	if bucket == nil {
+		return nil, bolt.ErrBucketNotFound
+	}
+	var resources []davResource
+	keys, buckets := childKeys(bucket)
+	for i, k := range keys {
+		path := joinPath(r.Path, k)
+		if buckets[i] {
+			resources = append(resources, davResource{Path: path, Collection: true})
+			continue
+		}
+		header, err := getLiveHeader(tx, path)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			resources = append(resources, davResource{Path: path, Header: header})
+		}
+	}
+	return resources, nil
+}
+
+// liveProperty returns the content of the live property of r with the given
+// name, and whether r has it. locks are the locks held on the server.
+func (r *davResource) liveProperty(name string, locks []davLock) (string, bool) {
+	switch name {
+	case "resourcetype":
+		if r.Collection {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		parts := splitPath(r.Path)
+		if len(parts) == 1 {
+			return "", false
+		}
+		name, err := url.PathUnescape(string(parts[len(parts)-1]))
+		if err != nil {
+			name = string(parts[len(parts)-1])
+		}
+		return escapeXML(name), true
+	case "getcontentlength", "getcontenttype":
+		if r.Collection {
+			return "", false
+		}
+		field := "Content-Length"
+		if name == "getcontenttype" {
+			field = "Content-Type"
+		}
+		v := r.Header.Get(field)
+		return escapeXML(v), v != ""
+	case "getetag":
+		if r.Collection || r.Header.Get("ETag") == "" {
+			return "", false
+		}
+		// ETags are base64, so only their quotes would need escaping.
+		return `"` + r.Header.Get("ETag") + `"`, true
+	case "getlastmodified":
+		if r.Collection {
+			return "", false
+		}
+		t, ok := lastModified(r.Header)
+		return t.UTC().Format(http.TimeFormat), ok
+	case "supportedlock":
+		var b bytes.Buffer
+		for _, scope := range []string{"exclusive", "shared"} {
+			fmt.Fprintf(&b, "<D:lockentry><D:lockscope><D:%s/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", scope)
+		}
+		return b.String(), true
+	case "lockdiscovery":
+		var b bytes.Buffer
+		for i := range locks {
+			if locks[i].covers(r.Path) {
+				b.WriteString(locks[i].xml())
+			}
+		}
+		return b.String(), true
+	}
+	return "", false
+}
+
+// propstats returns the properties of r that pf asks for, keyed by status.
+func (r *davResource) propstats(tx *bolt.Tx, pf *propfind, locks []davLock) (map[int][]string, error) {
+	dead, err := getProperties(tx, r.Path)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[int][]string)
+	ok := func(x string) {
+		stats[http.StatusOK] = append(stats[http.StatusOK], x)
+	}
+	if pf.Prop == nil {
+		for _, name := range liveProperties {
+			if v, has := r.liveProperty(name, locks); has {
+				if pf.PropName != nil {
+					v = ""
+				}
+				ok(propertyXML(xml.Name{Space: davNamespace, Local: name}, v))
+			}
+		}
+		for _, p := range dead {
+			v := p.XML
+			if pf.PropName != nil {
+				v = ""
+			}
+			ok(propertyXML(xml.Name{Space: p.Space, Local: p.Local}, v))
+		}
+		return stats, nil
+	}
+	for _, want := range pf.Prop.Props {
+		if isLiveProperty(want.XMLName) {
+			if v, has := r.liveProperty(want.XMLName.Local, locks); has {
+				ok(propertyXML(want.XMLName, v))
+				continue
+			}
+		}
+		if i := findProperty(dead, want.XMLName); i >= 0 {
+			ok(propertyXML(want.XMLName, dead[i].XML))
+			continue
+		}
+		stats[http.StatusNotFound] = append(stats[http.StatusNotFound], propertyXML(want.XMLName, ""))
+	}
+	return stats, nil
+}
+
+// getProperties returns the dead properties of the resource at path.
+func getProperties(tx *bolt.Tx, path string) ([]property, error) {
+	var props []property
+	b := tx.Bucket(propertyBucket).Get([]byte(path))
+	if b == nil {
+		return nil, nil
+	}
+	err := json.Unmarshal(b, &props)
+	return props, err
+}
+
+// putProperties sets the dead properties of the resource at path, and
+// records the change.
+func putProperties(tx *bolt.Tx, path string, props []property) error {
+	if len(props) == 0 {
+		if err := tx.Bucket(propertyBucket).Delete([]byte(path)); err != nil {
+			return err
+		}
+	} else {
+		b, err := json.Marshal(props)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(propertyBucket).Put([]byte(path), b); err != nil {
+			return err
+		}
+	}
+	return recordChange(tx, changeEvent{Op: "properties", Path: path})
+}
+
+func findProperty(props []property, name xml.Name) int {
+	for i, p := range props {
+		if p.Space == name.Space && p.Local == name.Local {
+			return i
+		}
+	}
+	return -1
+}
+
+// propertyPaths returns the paths of the resources at or beneath path that
+// have dead properties.
+func propertyPaths(tx *bolt.Tx, path string) []string {
+	var paths []string
+	c := tx.Bucket(propertyBucket).Cursor()
+	for k, _ := c.Seek([]byte(path)); k != nil && strings.HasPrefix(string(k), path); k, _ = c.Next() {
+		if string(k) == path || isWithin(string(k), path) {
+			paths = append(paths, string(k))
+		}
+	}
+	return paths
+}
+
+// deleteProperties deletes the dead properties of the resource at path, and
+// of everything beneath it.
+func deleteProperties(tx *bolt.Tx, path string) error {
+	for _, p := range propertyPaths(tx, path) {
+		if err := tx.Bucket(propertyBucket).Delete([]byte(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyProperties copies the dead properties of the resource at src to dst,
+// along with those of everything beneath it unless shallow is set. If move
+// is set, they are moved instead.
+func copyProperties(tx *bolt.Tx, src, dst string, shallow, move bool) error {
+	bucket := tx.Bucket(propertyBucket)
+	for _, p := range propertyPaths(tx, src) {
+		if shallow && p != src {
+			continue
+		}
+		b := append([]byte(nil), bucket.Get([]byte(p))...)
+		to := dst + strings.TrimPrefix(p, src)
+		if err := bucket.Put([]byte(to), b); err != nil {
+			return err
+		}
+		if err := recordChange(tx, changeEvent{Op: "properties", Path: to}); err != nil {
+			return err
+		}
+		if move {
+			if err := bucket.Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// escapeXML escapes s for use as XML character data.
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// propertyXML returns a property element with the given name and content.
+// Properties in the DAV: namespace use the D prefix of the multistatus
+// element.
+func propertyXML(name xml.Name, content string) string {
+	var start, end string
+	switch name.Space {
+	case davNamespace:
+		start, end = "D:"+name.Local, "D:"+name.Local
+	case "":
+		start, end = name.Local+` xmlns=""`, name.Local
+	default:
+		start, end = "X:"+name.Local+` xmlns:X="`+escapeXML(name.Space)+`"`, "X:"+name.Local
+	}
+	if content == "" {
+		return "<" + start + "/>"
+	}
+	return "<" + start + ">" + content + "</" + end + ">"
+}
+
+// multistatus builds the body of a 207 Multi-Status response.
+type multistatus struct {
+	bytes.Buffer
+}
+
+func newMultistatus() *multistatus {
+	m := new(multistatus)
+	m.WriteString(xml.Header)
+	m.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	return m
+}
+
+// response adds a response describing the properties of href, keyed by
+// status.
+func (m *multistatus) response(href string, stats map[int][]string) {
+	codes := make([]int, 0, len(stats))
+	for code := range stats {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintf(m, "<D:response><D:href>%s</D:href>", escapeXML(href))
+	for _, code := range codes {
+		m.WriteString("<D:propstat><D:prop>")
+		for _, p := range stats[code] {
+			m.WriteString(p)
+		}
+		fmt.Fprintf(m, "</D:prop><D:status>%s</D:status></D:propstat>", statusLine(code))
+	}
+	m.WriteString("</D:response>")
+}
+
+// write finishes the body and writes it as the response.
+func (m *multistatus) write(w http.ResponseWriter) {
+	m.WriteString("</D:multistatus>\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(m.Bytes())
+}
+
+func statusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// writeDAVError writes an error response whose body names the precondition
+// that failed, as described in RFC 4918 section 16.
+func writeDAVError(w http.ResponseWriter, status int, condition string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `%s<D:error xmlns:D="DAV:"><D:%s/></D:error>`+"\n", xml.Header, condition)
+}
+
+// readDAVBody decodes the XML body of req into v. It returns false if there
+// is no body.
+func readDAVBody(req *http.Request, v interface{}) (bool, error) {
+	b, err := readBody(req, maxDAVBodySize)
+	if err != nil {
+		return false, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return false, nil
+	}
+	return true, xml.Unmarshal(b, v)
+}
+
+// propfind serves the properties of a resource, and of the members of a
+// collection for "Depth: 1". Requests of infinite depth are refused, as the
+// response could be arbitrarily large.
+func (s server) propfind(w http.ResponseWriter, req *http.Request) {
+	depth := req.Header.Get("Depth")
+	switch depth {
+	case "0", "1":
+	case "", "infinity":
+		writeDAVError(w, http.StatusForbidden, "propfind-finite-depth")
+		return
+	default:
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	var pf propfind
+	if _, err := readDAVBody(req, &pf); err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+
+	body := newMultistatus()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		r, err := findResource(tx, req.URL.EscapedPath())
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return errNotFound
+		}
+		locks, err := getLocks(tx)
+		if err != nil {
+			return err
+		}
+		resources := []davResource{*r}
+		if depth == "1" && r.Collection {
+			members, err := r.members(tx)
+			if err != nil {
+				return err
+			}
+			resources = append(resources, members...)
+		}
+		for i := range resources {
+			stats, err := resources[i].propstats(tx, &pf, locks)
+			if err != nil {
+				return err
+			}
+			body.response(resources[i].href(), stats)
+		}
+		return nil
+	})
+	if err == errNotFound {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	body.write(w)
+}
+
+// proppatch sets and removes dead properties. The instructions are applied
+// atomically: if any of them can't be, none are, and the others fail with
+// 424 Failed Dependency.
+func (s server) proppatch(w http.ResponseWriter, req *http.Request) {
+	var update propertyUpdate
+	if ok, err := readDAVBody(req, &update); !ok || err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+
+	body := newMultistatus()
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	err := s.update(req, func(tx *bolt.Tx) error {
+		r, err := findResource(tx, req.URL.EscapedPath())
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		if checkPreconditions(r.Header, req) != 0 {
+			msg, status = "Precondition failed.", http.StatusPreconditionFailed
+			return errPreconditionFailed
+		}
+		props, err := getProperties(tx, r.Path)
+		if err != nil {
+			return err
+		}
+		stats := make(map[int][]string)
+		for _, in := range update.Instructions {
+			set := in.XMLName == (xml.Name{Space: davNamespace, Local: "set"})
+			if !set && in.XMLName != (xml.Name{Space: davNamespace, Local: "remove"}) {
+				msg, status = "Bad request.", http.StatusBadRequest
+				return errBadRequest
+			}
+			for _, p := range in.Prop.Props {
+				name := propertyXML(p.XMLName, "")
+				if isLiveProperty(p.XMLName) {
+					stats[http.StatusForbidden] = append(stats[http.StatusForbidden], name)
+					continue
+				}
+				stats[http.StatusOK] = append(stats[http.StatusOK], name)
+				i := findProperty(props, p.XMLName)
+				if set && i >= 0 {
+					props[i].XML = p.InnerXML
+				} else if set {
+					props = append(props, property{Space: p.XMLName.Space, Local: p.XMLName.Local, XML: p.InnerXML})
+				} else if i >= 0 {
+					props = append(props[:i], props[i+1:]...)
+				}
+			}
+		}
+		if len(stats[http.StatusForbidden]) > 0 {
+			if len(stats[http.StatusOK]) > 0 {
+				stats[http.StatusFailedDependency] = stats[http.StatusOK]
+				delete(stats, http.StatusOK)
+			}
+			body.response(r.href(), stats)
+			return nil
+		}
+		body.response(r.href(), stats)
+		return putProperties(tx, r.Path, props)
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	body.write(w)
+}
+
+// mkcol creates a bucket. Unlike a PUT without a body, it fails if anything
+// is already at the path, or if the enclosing bucket doesn't exist.
+func (s server) mkcol(w http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > 0 || len(req.TransferEncoding) > 0 {
+		http.Error(w, "Unsupported media type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	parts := splitPath(req.URL.EscapedPath())
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	err := s.update(req, func(tx *bolt.Tx) error {
+		r, err := findResource(tx, req.URL.EscapedPath())
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			w.Header().Set("Allow", allowedMethods)
+			msg, status = "Method not allowed.", http.StatusMethodNotAllowed
+			return errBadRequest
+		}
+		if getBoltBucket(tx, parts[:len(parts)-1]) == nil {
+			msg, status = "Conflict.", http.StatusConflict
+			return errBadRequest
+		}
+		_, err = getOrCreateBoltBucket(tx, parts)
+		return err
+	})
+	if err == errLocked {
+		writeDAVError(w, http.StatusLocked, "lock-token-submitted")
+		return
+	}
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Location", req.URL.EscapedPath())
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,444 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// davMultistatus is a 207 Multi-Status response body.
+type davMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Props  davProp `xml:"DAV: prop"`
+			Status string  `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// props returns the properties in the response for href, keyed by local
+// name, along with the status they were returned with.
+func (m *davMultistatus) props(href string) map[string]string {
+	props := make(map[string]string)
+	for _, r := range m.Responses {
+		if r.Href != href {
+			continue
+		}
+		for _, ps := range r.Propstats {
+			for _, p := range ps.Props.Props {
+				props[p.XMLName.Local] = ps.Status + " " + p.InnerXML
+			}
+		}
+	}
+	return props
+}
+
+// davClient runs the requests of a litmus-style conformance suite against a
+// test server.
+type davClient struct {
+	t *testing.T
+	s *httptest.Server
+}
+
+func (c davClient) do(method, path, body string, header map[string]string) *http.Response {
+	req, err := http.NewRequest(method, c.s.URL+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// expect runs a request and checks its status.
+func (c davClient) expect(status int, method, path, body string, header map[string]string) *http.Response {
+	resp := c.do(method, path, body, header)
+	if resp.StatusCode != status {
+		c.t.Errorf("%s %s: bad status: got %d, want %d", method, path, resp.StatusCode, status)
+	}
+	return resp
+}
+
+func (c davClient) propfind(path, depth, body string) *davMultistatus {
+	resp := c.expect(http.StatusMultiStatus, "PROPFIND", path, body, map[string]string{"Depth": depth})
+	var m davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&m); err != nil {
+		c.t.Fatalf("PROPFIND %s: %s", path, err)
+	}
+	return &m
+}
+
+func TestWebDAVBasic(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	c := davClient{t: t, s: s}
+
+	resp := c.expect(http.StatusOK, "OPTIONS", "/", "", nil)
+	if got, want := resp.Header.Get("DAV"), "1, 2"; got != want {
+		t.Errorf("bad DAV header: got %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Allow"); !strings.Contains(got, "PROPFIND") {
+		t.Errorf("bad Allow header: %q", got)
+	}
+
+	c.expect(http.StatusCreated, "MKCOL", "/litmus", "", nil)
+	c.expect(http.StatusMethodNotAllowed, "MKCOL", "/litmus", "", nil)
+	c.expect(http.StatusConflict, "MKCOL", "/nope/coll", "", nil)
+	c.expect(http.StatusUnsupportedMediaType, "MKCOL", "/litmus/body", "junk", nil)
+	c.expect(http.StatusCreated, "PUT", "/litmus/res", "This is a test file.", map[string]string{"Content-Type": "text/plain"})
+	c.expect(http.StatusMethodNotAllowed, "MKCOL", "/litmus/res", "", nil)
+	c.expect(http.StatusCreated, "MKCOL", "/litmus/coll/", "", nil)
+
+	// PROPFIND
+	c.expect(http.StatusForbidden, "PROPFIND", "/litmus", "", nil)
+	c.expect(http.StatusNotFound, "PROPFIND", "/litmus/nope", "", map[string]string{"Depth": "0"})
+	c.expect(http.StatusBadRequest, "PROPFIND", "/litmus", "<propfind", map[string]string{"Depth": "0"})
+	m := c.propfind("/litmus", "1", "")
+	if got, want := len(m.Responses), 3; got != want {
+		t.Fatalf("bad number of responses: got %d, want %d", got, want)
+	}
+	if got, want := m.props("/litmus/")["resourcetype"], "HTTP/1.1 200 OK <D:collection/>"; got != want {
+		t.Errorf("bad resourcetype: got %q, want %q", got, want)
+	}
+	props := m.props("/litmus/res")
+	for name, want := range map[string]string{
+		"resourcetype":     "HTTP/1.1 200 OK ",
+		"getcontentlength": "HTTP/1.1 200 OK 20",
+		"getcontenttype":   "HTTP/1.1 200 OK text/plain",
+		"getetag":          `HTTP/1.1 200 OK "` + etag([]byte("This is a test file.")) + `"`,
+		"displayname":      "HTTP/1.1 200 OK res",
+	} {
+		if got := props[name]; got != want {
+			t.Errorf("bad %s: got %q, want %q", name, got, want)
+		}
+	}
+	if _, ok := props["getlastmodified"]; !ok {
+		t.Error("missing getlastmodified")
+	}
+	if _, ok := m.props("/litmus/coll/")["displayname"]; !ok {
+		t.Error("missing collection member")
+	}
+	m = c.propfind("/litmus/res", "0", `<?xml version="1.0"?><propfind xmlns="DAV:"><propname/></propfind>`)
+	if got, want := m.props("/litmus/res")["getcontentlength"], "HTTP/1.1 200 OK "; got != want {
+		t.Errorf("bad propname: got %q, want %q", got, want)
+	}
+
+	// DELETE
+	c.expect(http.StatusCreated, "PUT", "/litmus/coll/inner", "inner", nil)
+	c.expect(http.StatusNoContent, "DELETE", "/litmus/coll", "", nil)
+	c.expect(http.StatusNotFound, "GET", "/litmus/coll/inner", "", nil)
+	c.expect(http.StatusNotFound, "DELETE", "/litmus/coll", "", nil)
+	c.expect(http.StatusNoContent, "DELETE", "/litmus/res", "", nil)
+	c.expect(http.StatusNotFound, "PROPFIND", "/litmus/res", "", map[string]string{"Depth": "0"})
+}
+
+func TestWebDAVProps(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	c := davClient{t: t, s: s}
+
+	c.expect(http.StatusCreated, "PUT", "/res", "foo", nil)
+
+	set := `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="http://example.com/ns">
+  <D:set><D:prop><Z:author>Jane</Z:author><Z:color>red</Z:color></D:prop></D:set>
+  <D:remove><D:prop><Z:missing/></D:prop></D:remove>
+</D:propertyupdate>`
+	c.expect(http.StatusMultiStatus, "PROPPATCH", "/res", set, nil)
+	c.expect(http.StatusNotFound, "PROPPATCH", "/nope", set, nil)
+	c.expect(http.StatusBadRequest, "PROPPATCH", "/res", "", nil)
+
+	query := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:Z="http://example.com/ns">
+<D:prop><Z:author/><Z:color/><Z:size/><D:getcontentlength/></D:prop></D:propfind>`
+	props := c.propfind("/res", "0", query).props("/res")
+	for name, want := range map[string]string{
+		"author":           "HTTP/1.1 200 OK Jane",
+		"color":            "HTTP/1.1 200 OK red",
+		"size":             "HTTP/1.1 404 Not Found ",
+		"getcontentlength": "HTTP/1.1 200 OK 3",
+	} {
+		if got := props[name]; got != want {
+			t.Errorf("bad %s: got %q, want %q", name, got, want)
+		}
+	}
+
+	// Live properties can't be set, and nothing else in the same request is.
+	live := `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="http://example.com/ns">
+  <D:remove><D:prop><Z:author/></D:prop></D:remove>
+  <D:set><D:prop><D:getetag>x</D:getetag></D:prop></D:set>
+</D:propertyupdate>`
+	resp := c.expect(http.StatusMultiStatus, "PROPPATCH", "/res", live, nil)
+	var m davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"author":  "HTTP/1.1 424 Failed Dependency ",
+		"getetag": "HTTP/1.1 403 Forbidden ",
+	} {
+		if got := m.props("/res")[name]; got != want {
+			t.Errorf("bad %s: got %q, want %q", name, got, want)
+		}
+	}
+
+	remove := `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="http://example.com/ns">
+  <D:remove><D:prop><Z:author/></D:prop></D:remove>
+</D:propertyupdate>`
+	c.expect(http.StatusMultiStatus, "PROPPATCH", "/res", remove, nil)
+	props = c.propfind("/res", "0", query).props("/res")
+	if got, want := props["author"], "HTTP/1.1 404 Not Found "; got != want {
+		t.Errorf("bad author: got %q, want %q", got, want)
+	}
+	if got, want := props["color"], "HTTP/1.1 200 OK red"; got != want {
+		t.Errorf("bad color: got %q, want %q", got, want)
+	}
+
+	// Dead properties follow their resource around, and go away with it.
+	c.expect(http.StatusNotFound, "COPY", "/copy", "", map[string]string{"Destination": "/res2"})
+	c.expect(http.StatusCreated, "COPY", "/res", "", map[string]string{"Destination": "/res2"})
+	if got, want := c.propfind("/res2", "0", query).props("/res2")["color"], "HTTP/1.1 200 OK red"; got != want {
+		t.Errorf("bad copied color: got %q, want %q", got, want)
+	}
+	c.expect(http.StatusNoContent, "DELETE", "/res2", "", nil)
+	c.expect(http.StatusCreated, "PUT", "/res2", "bar", nil)
+	if got, want := c.propfind("/res2", "0", query).props("/res2")["color"], "HTTP/1.1 404 Not Found "; got != want {
+		t.Errorf("bad color after delete: got %q, want %q", got, want)
+	}
+}
+
+func TestWebDAVCopyMove(t *testing.T) {
+	t.Parallel()
+	db := getBoltDB(t)
+	srv := server{db: db}
+	srv.cfg.Storage.LargeObjectSize = 8
+	srv.cfg.Storage.ChunkSize = 4
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	c := davClient{t: t, s: s}
+
+	get := func(path string) string {
+		resp := c.expect(http.StatusOK, "GET", path, "", nil)
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	dest := func(path string, extra ...string) map[string]string {
+		h := map[string]string{"Destination": s.URL + path}
+		for i := 0; i < len(extra); i += 2 {
+			h[extra[i]] = extra[i+1]
+		}
+		return h
+	}
+
+	c.expect(http.StatusCreated, "PUT", "/src", "a large object", nil)
+	c.expect(http.StatusCreated, "PUT", "/other", "small", nil)
+
+	c.expect(http.StatusCreated, "COPY", "/src", "", dest("/dst"))
+	c.expect(http.StatusPreconditionFailed, "COPY", "/src", "", dest("/dst", "Overwrite", "F"))
+	c.expect(http.StatusNoContent, "COPY", "/other", "", dest("/dst"))
+	c.expect(http.StatusConflict, "COPY", "/src", "", dest("/nope/dst"))
+	c.expect(http.StatusForbidden, "COPY", "/src", "", dest("/src"))
+	c.expect(http.StatusBadGateway, "COPY", "/src", "", map[string]string{"Destination": "http://elsewhere.example.com/dst"})
+	c.expect(http.StatusPreconditionFailed, "COPY", "/src", "", dest("/dst2", "If-Match", `"nope"`))
+	if got, want := get("/dst"), "small"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	c.expect(http.StatusCreated, "COPY", "/src", "", dest("/dst2"))
+	c.expect(http.StatusNoContent, "DELETE", "/src", "", nil)
+	if got, want := get("/dst2"), "a large object"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+
+	// Collections
+	c.expect(http.StatusCreated, "MKCOL", "/coll", "", nil)
+	c.expect(http.StatusCreated, "MKCOL", "/coll/sub", "", nil)
+	c.expect(http.StatusCreated, "PUT", "/coll/sub/big", "another large object", nil)
+	c.expect(http.StatusCreated, "PUT", "/coll/small", "small", nil)
+	c.expect(http.StatusForbidden, "COPY", "/coll", "", dest("/coll/sub/copy"))
+	c.expect(http.StatusCreated, "COPY", "/coll", "", dest("/shallow", "Depth", "0"))
+	if got := c.propfind("/shallow", "1", ""); len(got.Responses) != 1 {
+		t.Errorf("shallow copy has members: %+v", got.Responses)
+	}
+	c.expect(http.StatusCreated, "COPY", "/coll", "", dest("/deep"))
+	c.expect(http.StatusNoContent, "DELETE", "/coll", "", nil)
+	if got, want := get("/deep/sub/big"), "another large object"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+
+	// MOVE
+	c.expect(http.StatusBadRequest, "MOVE", "/deep", "", dest("/moved", "Depth", "0"))
+	c.expect(http.StatusCreated, "MOVE", "/deep", "", dest("/moved"))
+	c.expect(http.StatusNotFound, "GET", "/deep/small", "", nil)
+	if got, want := get("/moved/sub/big"), "another large object"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+	c.expect(http.StatusPreconditionFailed, "MOVE", "/dst2", "", dest("/dst", "Overwrite", "F"))
+	c.expect(http.StatusNoContent, "MOVE", "/dst2", "", dest("/dst"))
+	if got, want := get("/dst"), "a large object"; got != want {
+		t.Errorf("bad body: got %q, want %q", got, want)
+	}
+
+	c.expect(http.StatusNoContent, "DELETE", "/dst", "", nil)
+	c.expect(http.StatusNoContent, "DELETE", "/moved", "", nil)
+	if got, want := countChunks(t, db), 0; got != want {
+		t.Errorf("bad number of chunks: got %d, want %d", got, want)
+	}
+}
+
+func TestWebDAVLocks(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	c := davClient{t: t, s: s}
+
+	lockinfo := `<?xml version="1.0"?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:%s/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner>litmus test suite</D:owner>
+</D:lockinfo>`
+	exclusive := strings.Replace(lockinfo, "%s", "exclusive", 1)
+	shared := strings.Replace(lockinfo, "%s", "shared", 1)
+
+	c.expect(http.StatusCreated, "PUT", "/res", "foo", nil)
+	resp := c.expect(http.StatusOK, "LOCK", "/res", exclusive, map[string]string{"Timeout": "Second-60"})
+	token := resp.Header.Get("Lock-Token")
+	if !strings.HasPrefix(token, "<opaquelocktoken:") {
+		t.Fatalf("bad Lock-Token: %q", token)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(b), "<D:timeout>Second-") || !strings.Contains(string(b), "litmus test suite") {
+		t.Errorf("bad lock discovery: %s", b)
+	}
+	props := c.propfind("/res", "0", "").props("/res")
+	if !strings.Contains(props["lockdiscovery"], token[1:len(token)-1]) {
+		t.Errorf("bad lockdiscovery: %q", props["lockdiscovery"])
+	}
+
+	c.expect(http.StatusLocked, "LOCK", "/res", exclusive, nil)
+	c.expect(http.StatusLocked, "PUT", "/res", "bar", nil)
+	c.expect(http.StatusLocked, "DELETE", "/res", "", nil)
+	c.expect(http.StatusLocked, "COPY", "/res", "", map[string]string{"Destination": "/res"})
+	c.expect(http.StatusPreconditionFailed, "PUT", "/res", "bar", map[string]string{"If": "(<opaquelocktoken:nope>)"})
+	c.expect(http.StatusLocked, "PUT", "/res", "bar", map[string]string{"If": "(Not <DAV:no-lock>)"})
+	c.expect(http.StatusBadRequest, "PUT", "/res", "bar", map[string]string{"If": "<nope"})
+	c.expect(http.StatusNoContent, "PUT", "/res", "bar", map[string]string{"If": "(" + token + ")"})
+	c.expect(http.StatusCreated, "COPY", "/res", "", map[string]string{"Destination": "/copy"})
+	c.expect(http.StatusOK, "LOCK", "/res", "", map[string]string{"If": "(" + token + ")"})
+	c.expect(http.StatusPreconditionFailed, "LOCK", "/res", "", map[string]string{"If": "(<opaquelocktoken:nope>)"})
+
+	c.expect(http.StatusConflict, "UNLOCK", "/copy", "", map[string]string{"Lock-Token": token})
+	c.expect(http.StatusNoContent, "UNLOCK", "/res", "", map[string]string{"Lock-Token": token})
+	c.expect(http.StatusConflict, "UNLOCK", "/res", "", map[string]string{"Lock-Token": token})
+	c.expect(http.StatusNoContent, "PUT", "/res", "baz", nil)
+
+	// Shared locks can be held together, but not with an exclusive one.
+	resp = c.expect(http.StatusOK, "LOCK", "/res", shared, nil)
+	c.expect(http.StatusOK, "LOCK", "/res", shared, nil)
+	c.expect(http.StatusLocked, "LOCK", "/res", exclusive, nil)
+	c.expect(http.StatusNoContent, "UNLOCK", "/res", "", map[string]string{"Lock-Token": resp.Header.Get("Lock-Token")})
+
+	// A lock on a collection covers its members, and locking an unmapped URL
+	// creates an empty value.
+	c.expect(http.StatusCreated, "MKCOL", "/coll", "", nil)
+	resp = c.expect(http.StatusOK, "LOCK", "/coll", exclusive, nil)
+	coll := resp.Header.Get("Lock-Token")
+	c.expect(http.StatusLocked, "PUT", "/coll/new", "new", nil)
+	c.expect(http.StatusLocked, "MOVE", "/res", "", map[string]string{"Destination": "/coll/res"})
+	c.expect(http.StatusLocked, "LOCK", "/coll/new", exclusive, nil)
+	c.expect(http.StatusCreated, "PUT", "/coll/new", "new", map[string]string{"If": "(" + coll + ")"})
+	c.expect(http.StatusCreated, "LOCK", "/unmapped", exclusive, nil)
+	c.expect(http.StatusOK, "GET", "/unmapped", "", nil)
+	c.expect(http.StatusConflict, "LOCK", "/nope/unmapped", exclusive, nil)
+
+	// Locks go away with their resource.
+	c.expect(http.StatusNoContent, "DELETE", "/coll", "", map[string]string{"If": "(" + coll + ")"})
+	c.expect(http.StatusCreated, "PUT", "/coll/new", "new", nil)
+}
+
+func TestWebDAVLocksCoverSideDoors(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	c := davClient{t: t, s: s}
+
+	c.expect(http.StatusCreated, "PUT", "/lk/v", "one", nil)
+	c.expect(http.StatusNoContent, "PUT", "/lk?versioning=on", "", nil)
+	c.expect(http.StatusNoContent, "PUT", "/lk/v", "two", nil)
+	session := c.expect(http.StatusCreated, "POST", "/lk/v?uploads", "", nil).Header.Get("Location")
+
+	resp := c.expect(http.StatusOK, "LOCK", "/lk", `<?xml version="1.0"?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+</D:lockinfo>`, nil)
+	token := resp.Header.Get("Lock-Token")
+
+	// Parts can be uploaded, but not committed over the locked value.
+	c.expect(http.StatusNoContent, "PUT", session+"&part=1", "three", nil)
+	c.expect(http.StatusLocked, "POST", session, "", nil)
+	c.expect(http.StatusLocked, "POST", "/lk/v?restore=1", "", nil)
+	c.expect(http.StatusLocked, "DELETE", "/lk/v?version=1", "", nil)
+	c.expect(http.StatusLocked, "PUT", "/lk?versioning=off", "", nil)
+
+	c.expect(http.StatusNoContent, "PUT", "/lk?versioning=off", "", map[string]string{"If": "(" + token + ")"})
+}
+
+func TestWebDAVLockTakenBeforeWrite(t *testing.T) {
+	t.Parallel()
+	s := server{db: getBoltDB(t)}
+	l := davLock{Token: "opaquelocktoken:late", Root: "/late", Deep: true, Timeout: time.Hour, Expires: time.Now().Add(time.Hour)}
+
+	// The lock is taken after the request's locks were checked, as if it
+	// committed between checkLocks and the write.
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getOrCreateBoltBucket(tx, splitPath("/late")); err != nil {
+			return err
+		}
+		return putLock(tx, &l)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Method, Path string
+		Handler      func(http.ResponseWriter, *http.Request)
+	}{
+		{"PUT", "/late/x", s.putBucketOrValue},
+		{"DELETE", "/late", s.deleteBucketOrKey},
+		{"PUT", "/late?versioning=on", func(w http.ResponseWriter, req *http.Request) { s.putVersioning(w, req, "on") }},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		test.Handler(w, httptest.NewRequest(test.Method, test.Path, strings.NewReader("v")))
+		if got, want := w.Code, http.StatusLocked; got != want {
+			t.Errorf("%s %s: bad status: got %d, want %d", test.Method, test.Path, got, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/late/x", strings.NewReader("v"))
+	req.Header.Set("If", "(<"+l.Token+">)")
+	s.putBucketOrValue(w, req)
+	if got, want := w.Code, http.StatusCreated; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+}
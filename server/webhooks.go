@@ -0,0 +1,554 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// webhookSignatureHeader is the request header field holding the
+	// hex-encoded HMAC-SHA256 of a delivery's body, keyed with the hook's
+	// secret, as "sha256=<hex>".
+	webhookSignatureHeader = "X-Bolt-Signature"
+
+	// webhookIDHeader and webhookDeliveryHeader name the hook a delivery is
+	// for, and the delivery itself. A delivery keeps its ID across retries.
+	webhookIDHeader       = "X-Bolt-Hook"
+	webhookDeliveryHeader = "X-Bolt-Delivery"
+
+	// webhookTimeout is how long a receiver has to answer a delivery.
+	webhookTimeout = 10 * time.Second
+
+	// webhookRetry is how long a failed delivery waits before it is first
+	// retried. The wait doubles with each attempt, up to webhookMaxRetry.
+	webhookRetry    = 10 * time.Second
+	webhookMaxRetry = time.Hour
+
+	// webhookMaxAttempts is how many times a delivery is attempted before it
+	// is given up on.
+	webhookMaxAttempts = 20
+
+	// deliveryBatchSize is the most deliveries attempted in a single pass
+	// over the outbox.
+	deliveryBatchSize = 100
+)
+
+// webhookBucket holds webhook subscriptions, keyed by ID. outboxBucket holds
+// the deliveries that haven't been made yet, keyed by sequence number,
+// big-endian, so that they are attempted in the order they were made.
+var (
+	webhookBucket = append([]byte{0}, []byte("webhooks")...)
+	outboxBucket  = append([]byte{0}, []byte("outbox")...)
+)
+
+var (
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+
+	// publicWebhookClient is used unless webhooks.allow_private_targets is
+	// set. It checks the address of every connection it makes, after the
+	// receiver's name has been resolved, and refuses the ones that aren't
+	// public. It uses no proxy, since that would hide the address.
+	publicWebhookClient = &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: webhookTimeout,
+				Control: refusePrivateTargets,
+			}).DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+	}
+
+	errPrivateTarget = errors.New("receiver address isn't public")
+)
+
+// webhook is a subscription to the puts and deletes of the values at or
+// beneath Prefix. Each one is POSTed to URL, signed with Secret.
+type webhook struct {
+	ID      string    `json:"id"`
+	Prefix  string    `json:"prefix"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// delivery is a change event waiting in the outbox to be sent to a hook.
+type delivery struct {
+	ID          string          `json:"id"`
+	Hook        string          `json:"hook"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts,omitempty"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+func createWebhookBucketsIfNotExist(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(webhookBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(outboxBucket)
+		return err
+	})
+}
+
+func getWebhook(tx *bolt.Tx, id string) (*webhook, error) {
+	b := tx.Bucket(webhookBucket).Get([]byte(id))
+	if b == nil {
+		return nil, nil
+	}
+	var h webhook
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// enqueueWebhooks puts a delivery of e in the outbox for each hook whose
+// prefix it falls under, so that it is sent if and only if tx commits.
+// Followers leave deliveries to their primary.
+func enqueueWebhooks(tx *bolt.Tx, e changeEvent) error {
+	if e.Op != "put" && e.Op != "delete" {
+		return nil
+	}
+	if tx.Bucket(replicationBucket) != nil {
+		return nil
+	}
+	outbox := tx.Bucket(outboxBucket)
+	var payload []byte
+	return tx.Bucket(webhookBucket).ForEach(func(k, v []byte) error {
+		var h webhook
+		if err := json.Unmarshal(v, &h); err != nil {
+			return err
+		}
+		if e.Path != h.Prefix && !isWithin(e.Path, h.Prefix) {
+			return nil
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(e); err != nil {
+				return err
+			}
+		}
+		seq, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+		d := delivery{
+			ID:          fmt.Sprintf("%s-%d", h.ID, e.Seq),
+			Hook:        h.ID,
+			Payload:     payload,
+			NextAttempt: time.Now().UTC(),
+		}
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return outbox.Put(changeKey(seq), b)
+	})
+}
+
+// signPayload returns the signature of payload, as sent in the
+// webhookSignatureHeader.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay returns how long to wait before the next attempt of a delivery
+// that has failed attempts times.
+func retryDelay(attempts int) time.Duration {
+	d := webhookRetry
+	for i := 1; i < attempts && d < webhookMaxRetry; i++ {
+		d *= 2
+	}
+	if d > webhookMaxRetry {
+		d = webhookMaxRetry
+	}
+	return d
+}
+
+// isPublicIP reports whether ip is an address that webhooks may be delivered
+// to without webhooks.allow_private_targets.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// refusePrivateTargets is the dialer control function of
+// publicWebhookClient.
+func refusePrivateTargets(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return errPrivateTarget
+	}
+	return nil
+}
+
+// webhookClient returns the client that deliveries are sent with.
+func (s server) webhookClient() *http.Client {
+	if s.cfg.Webhooks.AllowPrivateTargets {
+		return webhookClient
+	}
+	return publicWebhookClient
+}
+
+// send POSTs the delivery to the hook's URL with client. Any 2xx response is
+// success.
+func (d *delivery) send(client *http.Client, h *webhook) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bolt-server")
+	req.Header.Set(webhookIDHeader, h.ID)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	req.Header.Set(webhookSignatureHeader, signPayload(h.Secret, d.Payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver sent %s", resp.Status)
+	}
+	return nil
+}
+
+// deliverWebhooks attempts the deliveries in the outbox that are due at now.
+// Deliveries that succeed are removed; those that fail are rescheduled, or
+// dropped once they have been attempted webhookMaxAttempts times. Each hook's
+// deliveries are sent in order, alongside those of other hooks, so that a
+// slow receiver only holds up its own. Once a delivery to a hook fails, the
+// hook's later deliveries wait for the next pass, so that a receiver that is
+// up gets them in order.
+func (s server) deliverWebhooks(now time.Time) error {
+	type due struct {
+		key  []byte
+		d    delivery
+		hook *webhook
+	}
+	var (
+		batch   []due
+		orphans [][]byte
+	)
+	blocked := make(map[string]bool)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.First(); k != nil && len(batch) < deliveryBatchSize; k, v = c.Next() {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if blocked[d.Hook] {
+				continue
+			}
+			if d.NextAttempt.After(now) {
+				blocked[d.Hook] = true
+				continue
+			}
+			h, err := getWebhook(tx, d.Hook)
+			if err != nil {
+				return err
+			}
+			key := append([]byte(nil), k...)
+			if h == nil {
+				// The hook has been deleted.
+				orphans = append(orphans, key)
+				continue
+			}
+			batch = append(batch, due{key: key, d: d, hook: h})
+		}
+		return nil
+	})
+	if err == nil && len(orphans) > 0 {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			for _, k := range orphans {
+				if err := tx.Bucket(outboxBucket).Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	var hooks []string
+	byHook := make(map[string][]due)
+	for _, b := range batch {
+		if byHook[b.d.Hook] == nil {
+			hooks = append(hooks, b.d.Hook)
+		}
+		byHook[b.d.Hook] = append(byHook[b.d.Hook], b)
+	}
+	client := s.webhookClient()
+	errs := make(chan error, len(hooks))
+	var wg sync.WaitGroup
+	for _, id := range hooks {
+		wg.Add(1)
+		go func(batch []due) {
+			defer wg.Done()
+			for _, b := range batch {
+				ok, err := s.deliver(client, b.key, b.d, b.hook, now)
+				if err != nil {
+					errs <- err
+				}
+				if !ok || err != nil {
+					return
+				}
+			}
+		}(byHook[id])
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// deliver attempts delivery d, stored in the outbox under key, and removes or
+// reschedules it. It reports whether the attempt succeeded.
+func (s server) deliver(client *http.Client, key []byte, d delivery, h *webhook, now time.Time) (bool, error) {
+	sendErr := d.send(client, h)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		if sendErr == nil {
+			return outbox.Delete(key)
+		}
+		d.Attempts++
+		if d.Attempts >= webhookMaxAttempts {
+			log.Printf("giving up on delivery %s to %s: %s", d.ID, h.URL, sendErr)
+			return outbox.Delete(key)
+		}
+		d.NextAttempt = now.Add(retryDelay(d.Attempts)).UTC()
+		d.LastError = sendErr.Error()
+		v, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return outbox.Put(key, v)
+	})
+	return sendErr == nil, err
+}
+
+// deliverWebhooksEvery calls deliverWebhooks every interval, forever.
+func (s server) deliverWebhooksEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := s.deliverWebhooks(now); err != nil {
+			log.Printf("couldn't deliver webhooks: %s", err)
+		}
+	}
+}
+
+// serveWebhooks handles requests for the webhooks of the request path. POST
+// subscribes a new hook to the changes beneath the path, GET lists the hooks
+// at or beneath it, or shows the one named by the "webhooks" query
+// parameter, and DELETE removes that one.
+func (s server) serveWebhooks(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("webhooks")
+	switch {
+	case req.Method == "POST" && id == "":
+		s.createWebhook(w, req)
+	case req.Method == "GET":
+		s.getWebhooks(w, req, id)
+	case req.Method == "DELETE" && id != "":
+		s.deleteWebhook(w, req, id)
+	default:
+		if id == "" {
+			w.Header().Set("Allow", "GET,POST")
+		} else {
+			w.Header().Set("Allow", "GET,DELETE")
+		}
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// createWebhook subscribes a hook, given as JSON with a "url" and optionally
+// a "secret", to the changes at or beneath the request path. If no secret is
+// given, one is made up. The secret is only ever sent back in the response.
+func (s server) createWebhook(w http.ResponseWriter, req *http.Request) {
+	body, err := readBody(req, s.maxValueSize())
+	if err == errTooLarge {
+		http.Error(w, "Request too large.", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	var h webhook
+	if err := json.Unmarshal(body, &h); err != nil {
+		http.Error(w, "Bad request.", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "Bad request: url must be an absolute http or https URL.", http.StatusBadRequest)
+		return
+	}
+	// Names are checked as they are resolved, when the hook is delivered.
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublicIP(ip) && !s.cfg.Webhooks.AllowPrivateTargets {
+		http.Error(w, "Bad request: url must have a public address.", http.StatusBadRequest)
+		return
+	}
+	if h.ID, err = newObjectID(); err == nil && h.Secret == "" {
+		h.Secret, err = newObjectID()
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	h.Prefix = cleanPath(req.URL.EscapedPath())
+	h.Created = time.Now().UTC()
+	b, err := json.Marshal(h)
+	if err == nil {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(webhookBucket).Put([]byte(h.ID), b); err != nil {
+				return err
+			}
+			return recordChange(tx, changeEvent{Op: "create_webhook", Path: h.Prefix, Hook: h.ID})
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", h.Prefix+"?webhooks="+h.ID)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h)
+}
+
+// getWebhooks writes the hook with the given ID, or if id is empty, the hooks
+// at or beneath the request path, without their secrets. Along with each
+// hook is the number of deliveries waiting for it.
+func (s server) getWebhooks(w http.ResponseWriter, req *http.Request, id string) {
+	type hookStatus struct {
+		webhook
+		Pending int `json:"pending"`
+	}
+	path := cleanPath(req.URL.EscapedPath())
+	hooks := []*hookStatus{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		byID := make(map[string]*hookStatus)
+		err := tx.Bucket(webhookBucket).ForEach(func(k, v []byte) error {
+			var h webhook
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			if id != "" && (h.ID != id || h.Prefix != path) {
+				return nil
+			}
+			if id == "" && h.Prefix != path && !isWithin(h.Prefix, path) {
+				return nil
+			}
+			h.Secret = ""
+			st := &hookStatus{webhook: h}
+			hooks = append(hooks, st)
+			byID[h.ID] = st
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if st := byID[d.Hook]; st != nil {
+				st.Pending++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Out of cheese.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if id == "" {
+		json.NewEncoder(w).Encode(hooks)
+		return
+	}
+	if len(hooks) == 0 {
+		http.Error(w, "Not found.", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(hooks[0])
+}
+
+// deleteWebhook removes the hook with the given ID, along with any deliveries
+// waiting for it.
+func (s server) deleteWebhook(w http.ResponseWriter, req *http.Request, id string) {
+	msg, status := "Out of cheese.", http.StatusInternalServerError
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		h, err := getWebhook(tx, id)
+		if err != nil {
+			return err
+		}
+		if h == nil || h.Prefix != cleanPath(req.URL.EscapedPath()) {
+			msg, status = "Not found.", http.StatusNotFound
+			return errNotFound
+		}
+		outbox := tx.Bucket(outboxBucket)
+		var keys [][]byte
+		err = outbox.ForEach(func(k, v []byte) error {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.Hook == id {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := outbox.Delete(k); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(webhookBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return recordChange(tx, changeEvent{Op: "delete_webhook", Path: h.Prefix, Hook: id})
+	})
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,315 @@
+// Copyright 2017 Eric Chlebek. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/echlebek/bolt-server/config"
+)
+
+func TestWebhooks(t *testing.T) {
+	t.Parallel()
+
+	type received struct {
+		Header http.Header
+		Body   []byte
+	}
+	var (
+		mu       sync.Mutex
+		requests []received
+		failures = 1
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, received{req.Header, body})
+		if failures > 0 {
+			failures--
+			http.Error(w, "Not now.", http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	sent := func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received(nil), requests...)
+	}
+
+	// The receiver is on the loopback interface.
+	cfg := config.Data{Webhooks: config.Webhooks{AllowPrivateTargets: true}}
+	srv := server{db: getBoltDB(t), cfg: cfg}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	client := &http.Client{}
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+	pending := func() int {
+		var n int
+		srv.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(outboxBucket).Stats().KeyN
+			return nil
+		})
+		return n
+	}
+
+	resp, body := do("POST", "/config?webhooks", `{"url": "`+receiver.URL+`", "secret": "s3cret"}`)
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	var hook webhook
+	if err := json.Unmarshal([]byte(body), &hook); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Header.Get("Location"), "/config?webhooks="+hook.ID; got != want {
+		t.Errorf("bad Location: got %q, want %q", got, want)
+	}
+	if hook.Prefix != "/config" || hook.Secret != "s3cret" {
+		t.Errorf("bad hook: %+v", hook)
+	}
+	resp, _ = do("POST", "/config?webhooks", `{"url": "ftp://example.com"}`)
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("bad status: got %d, want %d", got, want)
+	}
+
+	// Secrets aren't listed.
+	_, body = do("GET", "/?webhooks", "")
+	if strings.Contains(body, "s3cret") || !strings.Contains(body, hook.ID) {
+		t.Errorf("bad listing: %s", body)
+	}
+
+	resp, _ = do("PUT", "/config/app", "v1")
+	eTag := resp.Header.Get("ETag")
+	do("PUT", "/other/x", "ignored")
+	do("DELETE", "/config/app", "")
+	if got, want := pending(), 2; got != want {
+		t.Fatalf("bad outbox: got %d deliveries, want %d", got, want)
+	}
+
+	// The first attempt fails, and holds back the delivery after it.
+	now := time.Now()
+	if err := srv.deliverWebhooks(now); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(sent()), 1; got != want {
+		t.Fatalf("bad deliveries: got %d, want %d", got, want)
+	}
+	if err := srv.deliverWebhooks(now); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(sent()), 1; got != want {
+		t.Fatalf("delivery retried too soon: got %d, want %d", got, want)
+	}
+	_, body = do("GET", "/config?webhooks="+hook.ID, "")
+	if !strings.Contains(body, `"pending":2`) {
+		t.Errorf("bad hook: %s", body)
+	}
+
+	// The outbox is in the database, so a restarted server picks it up.
+	restarted := server{db: srv.db, cfg: cfg}
+	if err := restarted.deliverWebhooks(now.Add(webhookRetry)); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := sent()
+	if got, want := len(deliveries), 3; got != want {
+		t.Fatalf("bad deliveries: got %d, want %d", got, want)
+	}
+	if got, want := pending(), 0; got != want {
+		t.Errorf("bad outbox: got %d deliveries, want %d", got, want)
+	}
+	expected := []changeEvent{
+		{Op: "put", Path: "/config/app", ETag: eTag},
+		{Op: "put", Path: "/config/app", ETag: eTag},
+		{Op: "delete", Path: "/config/app"},
+	}
+	for i, want := range expected {
+		r := deliveries[i]
+		if got, want := r.Header.Get(webhookSignatureHeader), signPayload("s3cret", r.Body); got != want {
+			t.Errorf("request %d: bad signature: got %q, want %q", i, got, want)
+		}
+		if got, want := r.Header.Get(webhookIDHeader), hook.ID; got != want {
+			t.Errorf("request %d: bad hook: got %q, want %q", i, got, want)
+		}
+		var e changeEvent
+		if err := json.Unmarshal(r.Body, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Op != want.Op || e.Path != want.Path || e.ETag != want.ETag {
+			t.Errorf("request %d: got %+v, want %+v", i, e, want)
+		}
+	}
+	if a, b := deliveries[0].Header.Get(webhookDeliveryHeader), deliveries[1].Header.Get(webhookDeliveryHeader); a != b {
+		t.Errorf("retry has a new delivery ID: %q, %q", a, b)
+	}
+
+	// Deleting a hook stops its deliveries.
+	if resp, _ := do("DELETE", "/?webhooks="+hook.ID, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bad status: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if resp, _ := do("DELETE", "/config?webhooks="+hook.ID, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("bad status: got %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	do("PUT", "/config/app", "v2")
+	if got, want := pending(), 0; got != want {
+		t.Errorf("bad outbox: got %d deliveries, want %d", got, want)
+	}
+	if resp, _ := do("GET", "/config?webhooks="+hook.ID, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bad status: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestWebhookPrivateTargets(t *testing.T) {
+	t.Parallel()
+	var received int
+	var mu sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received++
+	}))
+	defer receiver.Close()
+
+	srv := server{db: getBoltDB(t)}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	post := func(url string) *http.Response {
+		resp, err := http.Post(s.URL+"/config?webhooks", "application/json", strings.NewReader(`{"url": "`+url+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, url := range []string{receiver.URL, "http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/", "http://[::1]/"} {
+		if got, want := post(url).StatusCode, http.StatusBadRequest; got != want {
+			t.Errorf("%s: bad status: got %d, want %d", url, got, want)
+		}
+	}
+
+	// A name is only resolved when the hook is delivered, and refused then.
+	url := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+	if got, want := post(url).StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("bad status: got %d, want %d", got, want)
+	}
+	req, err := http.NewRequest("PUT", s.URL+"/config/app", strings.NewReader("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.deliverWebhooks(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if received != 0 {
+		t.Errorf("delivered to a loopback address")
+	}
+	err = srv.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(outboxBucket).Cursor().First()
+		var d delivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		if !strings.Contains(d.LastError, errPrivateTarget.Error()) {
+			t.Errorf("bad delivery error: %q", d.LastError)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhooksConcurrent(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	got := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got <- struct{}{}
+	}))
+	defer fast.Close()
+
+	srv := server{db: getBoltDB(t), cfg: config.Data{Webhooks: config.Webhooks{AllowPrivateTargets: true}}}
+	s := httptest.NewServer(srv)
+	defer s.Close()
+	do := func(method, path, body string) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	do("POST", "/a?webhooks", `{"url": "`+slow.URL+`"}`)
+	do("POST", "/b?webhooks", `{"url": "`+fast.URL+`"}`)
+	do("PUT", "/a/x", "1")
+	do("PUT", "/b/y", "2")
+
+	// The slow receiver's delivery comes first, but doesn't hold up the
+	// other hook's.
+	done := make(chan error)
+	go func() {
+		done <- srv.deliverWebhooks(time.Now())
+	}()
+	select {
+	case <-got:
+	case <-time.After(webhookTimeout / 2):
+		t.Errorf("delivery held up by another hook's receiver")
+	}
+	release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		Attempts int
+		Expected time.Duration
+	}{
+		{1, webhookRetry},
+		{2, 2 * webhookRetry},
+		{4, 8 * webhookRetry},
+		{webhookMaxAttempts, webhookMaxRetry},
+	}
+	for _, test := range tests {
+		if got, want := retryDelay(test.Attempts), test.Expected; got != want {
+			t.Errorf("retryDelay(%d): got %s, want %s", test.Attempts, got, want)
+		}
+	}
+}